@@ -0,0 +1,637 @@
+package goink
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// header of the compiled story, the version is increased whenever
+// the format is changed, so that the files of older builds are rejected
+const (
+	binaryMagic   = "GOINK"
+	binaryVersion = 3
+)
+
+// kinds of the serialized nodes
+const (
+	kindStart = iota
+	kindEnd
+	kindDone
+	kindKnot
+	kindStitch
+	kindLine
+	kindGather
+	kindOpt
+	kindOptions
+	kindLogic
+	kindThread
+	kindBlock
+	kindBranch
+)
+
+// kinds of the serialized segments
+const (
+	segPlain = iota
+	segInline
+	segConditional
+	segAlternatives
+)
+
+func init() {
+	// lists and divert targets are held by the variables
+	gob.Register(List{})
+	gob.Register(DivertTarget(""))
+}
+
+// binStory is the serialized story
+type binStory struct {
+	ID    string
+	Nodes []binNode
+	Paths map[string]int
+	Knots []int
+	Funcs map[string]int // ink functions by their names
+
+	Defaults map[string]interface{}
+	Consts   map[string]interface{}
+	Lists    map[string][]ListItem
+	Items    map[string]interface{}
+
+	Externals []binExternal
+	Todos     []Todo
+}
+
+// binExternal is the declaration of the external function
+type binExternal struct {
+	Name   string
+	Params []binParam
+}
+
+// binParam is the parameter of the knot, stitch or function
+type binParam struct {
+	Name string
+	Ref  bool
+}
+
+// binNode is the serialized node, only the fields of its kind are set,
+// the nodes are referred by their indexes plus one, so that zero is nil
+type binNode struct {
+	Kind int
+	Path string
+	File string
+	LN   int
+
+	Parent int
+	Next   int
+
+	// knot and stitch
+	Name     string
+	Params   []binParam
+	Tags     []string
+	Function bool
+	Return   int
+	Stitches []int
+	Knot     int
+
+	// line, which is embedded in the gather and option
+	Raw      string
+	Comment  string
+	Text     string
+	Content  []binSegment
+	Conds    int
+	Divert   *binDest
+	Tunnels  []binDest
+	Back     bool
+	Labelled bool
+
+	// options and option
+	Opts       []int
+	Gather     int
+	Nesting    int
+	Sticky     bool
+	Fallback   bool
+	Conditions []string
+	Before     []binSegment
+	Middle     []binSegment
+	After      []binSegment
+
+	// logic and thread
+	Temp   bool
+	Ret    bool
+	Value  *string // also the value of the switch block
+	Target string
+
+	// block and branch
+	Branches  []int
+	Closed    bool
+	Block     int
+	Condition *string
+	Implicit  bool
+}
+
+// binDest is the divert with its arguments
+type binDest struct {
+	Path string
+	Name string
+	Args []string
+}
+
+// binSegment is the segment of the content, the expression
+// is kept as its source, which is compiled when loading
+type binSegment struct {
+	Kind  int
+	Text  string
+	Alt   int
+	Idx   int
+	Items [][]binSegment // branches of the conditional, or items of the alternatives
+}
+
+// MarshalBinary serializes the parsed story, which is loaded by UnmarshalStory
+// without parsing again, the bound externals and observers are not kept
+func (s *Story) MarshalBinary() ([]byte, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.engine != nil {
+		return nil, errors.New("can not marshal the compiled story")
+	}
+
+	m := &marshaler{index: make(map[Node]int)}
+	b, err := m.story(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "can not marshal the story")
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(binaryMagic)
+	_ = binary.Write(&buf, binary.BigEndian, uint16(binaryVersion))
+
+	if err := gob.NewEncoder(&buf).Encode(b); err != nil {
+		return nil, errors.Wrap(err, "can not marshal the story")
+	}
+
+	return buf.Bytes(), nil
+}
+
+// UnmarshalStory loads the story serialized by MarshalBinary,
+// the externals should be bound again
+func UnmarshalStory(data []byte) (*Story, error) {
+	header := len(binaryMagic) + 2
+	if len(data) < header || string(data[:len(binaryMagic)]) != binaryMagic {
+		return nil, errors.New("data is not a compiled story")
+	}
+
+	if v := binary.BigEndian.Uint16(data[len(binaryMagic):]); v != binaryVersion {
+		return nil, errors.Errorf("compiled story version %d is not supported, it should be %d", v, binaryVersion)
+	}
+
+	var b binStory
+	if err := gob.NewDecoder(bytes.NewReader(data[header:])).Decode(&b); err != nil {
+		return nil, errors.Wrap(err, "invalid compiled story")
+	}
+
+	u := &unmarshaler{story: Default()}
+	return u.load(&b)
+}
+
+// marshaler of the story, which indexes the nodes
+type marshaler struct {
+	index map[Node]int
+}
+
+// story serialized with its nodes
+func (m *marshaler) story(s *Story) (*binStory, error) {
+	b := &binStory{
+		ID: s.id, Paths: make(map[string]int), Funcs: make(map[string]int),
+		Defaults: s.defaults, Consts: s.consts,
+		Lists: s.lists, Items: s.items, Todos: s.todos,
+	}
+
+	var nodes []Node
+	for _, n := range s.paths {
+		if _, ok := m.index[n]; ok {
+			continue
+		}
+		m.index[n] = 0
+		nodes = append(nodes, n)
+
+		// the implicit return is not in the paths
+		if k, ok := n.(*knot); ok && k.function {
+			m.index[k.ret] = 0
+			nodes = append(nodes, k.ret)
+		}
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Path() < nodes[j].Path()
+	})
+	for i, n := range nodes {
+		m.index[n] = i + 1
+	}
+
+	for _, n := range nodes {
+		bn, err := m.node(n)
+		if err != nil {
+			return nil, err
+		}
+		b.Nodes = append(b.Nodes, bn)
+	}
+
+	for path, n := range s.paths {
+		b.Paths[path] = m.ref(n)
+	}
+
+	for _, k := range s.knots {
+		b.Knots = append(b.Knots, m.ref(k))
+		if k.function {
+			b.Funcs[k.name] = m.ref(k)
+		}
+	}
+
+	var names []string
+	for name := range s.externals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		b.Externals = append(b.Externals, binExternal{Name: name, Params: m.params(s.externals[name].params)})
+	}
+
+	return b, nil
+}
+
+// ref of the node, zero is nil
+func (m *marshaler) ref(n Node) int {
+	return m.index[n]
+}
+
+// node serialized by its kind, the unknown node is an error,
+// or it would be loaded as the start
+func (m *marshaler) node(node Node) (binNode, error) {
+	b := binNode{Path: node.Path(), File: node.File(), LN: node.LN(), Parent: m.ref(node.Parent())}
+
+	switch n := node.(type) {
+	case *start:
+		b.Kind, b.Next = kindStart, m.ref(n.next)
+	case *end:
+		b.Kind = kindEnd
+	case *done:
+		b.Kind = kindDone
+	case *knot:
+		b.Kind, b.Next, b.Name, b.Tags = kindKnot, m.ref(n.next), n.name, n.tags
+		b.Params, b.Function, b.Return = m.params(n.params), n.function, m.ref(n.ret)
+		for _, st := range n.stitches {
+			b.Stitches = append(b.Stitches, m.ref(st))
+		}
+	case *stitch:
+		b.Kind, b.Next, b.Name, b.Tags = kindStitch, m.ref(n.next), n.name, n.tags
+		b.Params, b.Knot = m.params(n.params), m.ref(n.knot)
+	case *line:
+		b.Kind = kindLine
+		m.line(&b, n)
+	case *gather:
+		b.Kind, b.Nesting = kindGather, n.nesting
+		m.line(&b, n.line)
+	case *opt:
+		b.Kind, b.Sticky, b.Fallback = kindOpt, n.sticky, n.fallback
+		m.line(&b, n.line)
+		for _, c := range n.conditions {
+			b.Conditions = append(b.Conditions, c.raw)
+		}
+		b.Before, b.Middle, b.After = m.content(n.before), m.content(n.middle), m.content(n.after)
+	case *options:
+		b.Kind, b.Gather, b.Nesting = kindOptions, m.ref(n.gather), n.nesting
+		for _, o := range n.opts {
+			b.Opts = append(b.Opts, m.ref(o))
+		}
+	case *logic:
+		b.Kind, b.Next, b.Raw = kindLogic, m.ref(n.next), n.raw
+		b.Temp, b.Ret, b.Name, b.Value = n.temp, n.ret, n.name, source(n.value)
+	case *thread:
+		b.Kind, b.Next, b.Target = kindThread, m.ref(n.next), n.target
+	case *block:
+		b.Kind, b.Next, b.Value, b.Closed = kindBlock, m.ref(n.next), source(n.value), n.closed
+		for _, br := range n.branches {
+			b.Branches = append(b.Branches, m.ref(br))
+		}
+	case *branch:
+		b.Kind, b.Next, b.Block = kindBranch, m.ref(n.next), m.ref(n.block)
+		b.Condition, b.Implicit = source(n.condition), n.implicit
+	default:
+		return b, errors.Errorf("unknown node: %T %s", node, node.Path())
+	}
+
+	return b, nil
+}
+
+// line fields of the node
+func (m *marshaler) line(b *binNode, l *line) {
+	b.Next, b.Raw, b.Comment, b.Text = m.ref(l.next), l.raw, l.comment, l.text
+	b.Tags, b.Back, b.Labelled = l.tags, l.back, l.labelled
+	b.Content, b.Conds = m.content(l.content), l.conds
+
+	if l.divert != nil {
+		d := m.dest(l.divert)
+		b.Divert = &d
+	}
+	for _, t := range l.tunnels {
+		b.Tunnels = append(b.Tunnels, m.dest(t))
+	}
+}
+
+// dest of the divert
+func (m *marshaler) dest(d *dest) binDest {
+	b := binDest{Path: d.path, Name: d.name}
+	for _, a := range d.args {
+		b.Args = append(b.Args, a.raw)
+	}
+	return b
+}
+
+// params of the knot, stitch or function
+func (m *marshaler) params(params []param) (list []binParam) {
+	for _, p := range params {
+		list = append(list, binParam{Name: p.name, Ref: p.ref})
+	}
+	return
+}
+
+// content serialized with the sources of the expressions
+func (m *marshaler) content(c content) (list []binSegment) {
+	for _, seg := range c {
+		switch seg := seg.(type) {
+		case plain:
+			list = append(list, binSegment{Kind: segPlain, Text: string(seg)})
+		case *inline:
+			list = append(list, binSegment{Kind: segInline, Text: seg.raw})
+		case *conditional:
+			b := binSegment{Kind: segConditional, Text: seg.condition.raw}
+			for _, br := range seg.branches {
+				b.Items = append(b.Items, m.content(br))
+			}
+			list = append(list, b)
+		case *alternatives:
+			b := binSegment{Kind: segAlternatives, Alt: seg.kind, Idx: seg.idx}
+			for _, item := range seg.items {
+				b.Items = append(b.Items, m.content(item))
+			}
+			list = append(list, b)
+		}
+	}
+
+	return
+}
+
+// source of the optional expression
+func source(c *exprc) *string {
+	if c == nil {
+		return nil
+	}
+	return &c.raw
+}
+
+// unmarshaler of the story, which links the nodes
+// and compiles the expressions
+type unmarshaler struct {
+	story   *Story
+	nodes   []Node
+	patcher *patcher
+	err     error
+}
+
+// load the story from the serialized one
+func (u *unmarshaler) load(b *binStory) (*Story, error) {
+	s := u.story
+	s.id, s.todos = b.ID, b.Todos
+
+	for k, v := range b.Defaults {
+		s.vars[k], s.defaults[k] = v, v
+	}
+	for k, v := range b.Consts {
+		s.consts[k] = v
+	}
+	for k, v := range b.Lists {
+		s.lists[k] = v
+	}
+	for k, v := range b.Items {
+		s.items[k] = v
+	}
+	for _, e := range b.Externals {
+		s.externals[e.Name] = newExternal(s, e.Name, u.params(e.Params))
+	}
+
+	// the expressions are patched as post parsing
+	u.patcher = s.patcher()
+
+	bases := make([]*base, len(b.Nodes))
+	u.nodes = make([]Node, len(b.Nodes))
+	for i, bn := range b.Nodes {
+		bs := &base{story: s, path: bn.Path, ln: bn.LN, file: bn.File}
+
+		var n Node
+		switch bn.Kind {
+		case kindStart:
+			n, bs = s.start, nil
+		case kindEnd:
+			n, bs = s.end, nil
+		case kindDone:
+			n, bs = s.done, nil
+		case kindKnot:
+			n = &knot{base: bs}
+		case kindStitch:
+			n = &stitch{base: bs}
+		case kindLine:
+			n = &line{base: bs}
+		case kindGather:
+			n = &gather{line: &line{base: bs}}
+		case kindOpt:
+			n = &opt{line: &line{base: bs}}
+		case kindOptions:
+			n = &options{base: bs}
+		case kindLogic:
+			n = &logic{base: bs}
+		case kindThread:
+			n = &thread{base: bs}
+		case kindBlock:
+			n = &block{base: bs}
+		case kindBranch:
+			n = &branch{base: bs}
+		default:
+			return nil, errors.Errorf("invalid compiled story, unknown node: %d", bn.Kind)
+		}
+
+		u.nodes[i], bases[i] = n, bs
+	}
+
+	for i, bn := range b.Nodes {
+		if bases[i] != nil {
+			bases[i].parent = u.ref(bn.Parent)
+		}
+		u.node(u.nodes[i], bn)
+	}
+
+	if u.err != nil {
+		return nil, errors.Wrap(u.err, "invalid compiled story")
+	}
+
+	for path, i := range b.Paths {
+		s.paths[path] = u.ref(i)
+	}
+
+	for _, i := range b.Knots {
+		k, _ := u.ref(i).(*knot)
+		s.knots = append(s.knots, k)
+	}
+
+	for name, i := range b.Funcs {
+		k, _ := u.ref(i).(*knot)
+		s.funcs[name] = s.function(k)
+	}
+
+	// the expressions are patched in the scopes of their nodes
+	if errs := s.patch(); len(errs) > 0 {
+		return nil, errors.Wrap(errs[0], "invalid compiled story")
+	}
+
+	return s, nil
+}
+
+// ref of the node, nil for zero
+func (u *unmarshaler) ref(i int) Node {
+	if i <= 0 || i > len(u.nodes) {
+		return nil
+	}
+	return u.nodes[i-1]
+}
+
+// node linked by its kind
+func (u *unmarshaler) node(node Node, b binNode) {
+	switch n := node.(type) {
+	case *start:
+		n.next = u.ref(b.Next)
+	case *knot:
+		n.next, n.name, n.tags = u.ref(b.Next), b.Name, b.Tags
+		n.params, n.function, n.ret = u.params(b.Params), b.Function, u.ref(b.Return)
+		for _, i := range b.Stitches {
+			st, _ := u.ref(i).(*stitch)
+			n.stitches = append(n.stitches, st)
+		}
+	case *stitch:
+		n.next, n.name, n.tags, n.params = u.ref(b.Next), b.Name, b.Tags, u.params(b.Params)
+		n.knot, _ = u.ref(b.Knot).(*knot)
+	case *line:
+		u.line(n, b)
+	case *gather:
+		n.nesting = b.Nesting
+		u.line(n.line, b)
+	case *opt:
+		n.sticky, n.fallback = b.Sticky, b.Fallback
+		u.line(n.line, b)
+		for _, c := range b.Conditions {
+			n.conditions = append(n.conditions, u.exprc(c))
+		}
+		n.before, n.middle, n.after = u.content(b.Before), u.content(b.Middle), u.content(b.After)
+	case *options:
+		n.gather, _ = u.ref(b.Gather).(*gather)
+		n.nesting = b.Nesting
+		for _, i := range b.Opts {
+			o, _ := u.ref(i).(*opt)
+			n.opts = append(n.opts, o)
+		}
+	case *logic:
+		n.next, n.raw, n.temp, n.ret, n.name = u.ref(b.Next), b.Raw, b.Temp, b.Ret, b.Name
+		n.value = u.optional(b.Value)
+	case *thread:
+		n.next, n.target = u.ref(b.Next), b.Target
+	case *block:
+		n.next, n.value, n.closed = u.ref(b.Next), u.optional(b.Value), b.Closed
+		for _, i := range b.Branches {
+			br, _ := u.ref(i).(*branch)
+			n.branches = append(n.branches, br)
+		}
+	case *branch:
+		n.next, n.condition, n.implicit = u.ref(b.Next), u.optional(b.Condition), b.Implicit
+		n.block, _ = u.ref(b.Block).(*block)
+	}
+}
+
+// line fields of the node
+func (u *unmarshaler) line(l *line, b binNode) {
+	l.next, l.raw, l.comment, l.text = u.ref(b.Next), b.Raw, b.Comment, b.Text
+	l.tags, l.back, l.labelled = b.Tags, b.Back, b.Labelled
+	l.content, l.conds = u.content(b.Content), b.Conds
+	if (l.conds < 0 || l.conds > len(l.content)) && u.err == nil {
+		u.err = errors.Errorf("invalid conditions of the line: %s", b.Path)
+	}
+
+	if b.Divert != nil {
+		l.divert = u.dest(*b.Divert)
+	}
+	for _, t := range b.Tunnels {
+		l.tunnels = append(l.tunnels, u.dest(t))
+	}
+}
+
+// dest of the divert
+func (u *unmarshaler) dest(b binDest) *dest {
+	d := &dest{path: b.Path, name: b.Name}
+	for _, a := range b.Args {
+		d.args = append(d.args, u.exprc(a))
+	}
+	return d
+}
+
+// params of the knot, stitch or function
+func (u *unmarshaler) params(list []binParam) (params []param) {
+	for _, p := range list {
+		params = append(params, param{name: p.Name, ref: p.Ref})
+	}
+	return
+}
+
+// content with the compiled expressions
+func (u *unmarshaler) content(list []binSegment) (c content) {
+	for _, b := range list {
+		switch b.Kind {
+		case segPlain:
+			c = append(c, plain(b.Text))
+		case segInline:
+			c = append(c, &inline{exprc: u.exprc(b.Text)})
+		case segConditional:
+			seg := &conditional{condition: u.exprc(b.Text)}
+			for _, br := range b.Items {
+				seg.branches = append(seg.branches, u.content(br))
+			}
+			c = append(c, seg)
+		case segAlternatives:
+			seg := &alternatives{kind: b.Alt, idx: b.Idx}
+			for _, item := range b.Items {
+				seg.items = append(seg.items, u.content(item))
+			}
+			c = append(c, seg)
+		}
+	}
+
+	return
+}
+
+// exprc compiled from the source, the first error is kept
+func (u *unmarshaler) exprc(raw string) *exprc {
+	c := &exprc{raw: raw}
+	if err := c.compile(u.patcher); err != nil && u.err == nil {
+		u.err = err
+	}
+	return c
+}
+
+// optional expression
+func (u *unmarshaler) optional(raw *string) *exprc {
+	if raw == nil {
+		return nil
+	}
+	return u.exprc(*raw)
+}
@@ -0,0 +1,186 @@
+package goink
+
+import (
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarshalBinary(t *testing.T) {
+	input := `
+	LIST doors = (open), closed
+	VAR coins = 3
+	CONST PRICE = 2
+	EXTERNAL greet(name)
+	Hello. {greet("hero")} {doors ? open: The door is open.}
+	-> shop
+	== shop
+	= counter
+	<- extras
+	{shop.counter > 1: Welcome back.|Welcome.} {&tick|tock}
+	* {coins >= PRICE} [Buy a hat]
+	  ~ coins -= PRICE
+	  You buy a hat.
+	  -> counter
+	* (leave) Leave
+	- Goodbye, you have {double(coins)} half coins.
+	{
+	- shop.counter.leave: You left.
+	- else: You stayed.
+	}
+	-> END
+	== extras
+	+ [Look] -> shop.counter
+	== function double(x)
+	~ return x * 2
+	`
+
+	story := Default()
+	assert.Nil(t, story.Parse(input))
+	assert.Nil(t, story.PostParsing())
+	assert.Nil(t, story.BindExternal("greet", func(name string) string { return "Hi, " + name + "." }))
+
+	data, err := story.MarshalBinary()
+	assert.Nil(t, err)
+
+	loaded, err := UnmarshalStory(data)
+	assert.Nil(t, err)
+
+	// the bound functions are not kept
+	_, e := loaded.Resume(NewContext())
+	assert.Contains(t, e.Error(), "external is not bound: greet")
+	assert.Nil(t, loaded.BindExternal("greet", func(name string) string { return "Hi, " + name + "." }))
+
+	ctx, lctx := NewContext(), NewContext()
+	lctx.Seed = ctx.Seed
+
+	sec, e := story.Resume(ctx)
+	assert.Nil(t, e)
+	lsec, le := loaded.Resume(lctx)
+	assert.Nil(t, le)
+	assert.Equal(t, sec, lsec)
+	assert.Equal(t, "Hello. Hi, hero. The door is open.\nWelcome. tick", lsec.Text)
+	assert.Equal(t, []string{"Buy a hat", "Leave", "Look"}, lsec.Opts)
+
+	for _, idx := range []int{0, 1, 0} {
+		sec, e = story.Pick(ctx, idx)
+		assert.Nil(t, e)
+		lsec, le = loaded.Pick(lctx, idx)
+		assert.Nil(t, le)
+
+		assert.Equal(t, sec, lsec)
+		assert.Equal(t, ctx, lctx)
+	}
+	assert.Equal(t, "Leave\nGoodbye, you have 2 half coins.\nYou left.", lsec.Text)
+	assert.True(t, lsec.End)
+
+	assert.Equal(t, story.Todos(), loaded.Todos())
+}
+
+func TestMarshalLineConditions(t *testing.T) {
+	input := `
+	VAR gold = 3
+	{gold > 5} Rich line
+	{gold < 5} Poor line
+	- {gold < 5} {gold > 1} Gathered.
+	-> END
+	`
+
+	story := Default()
+	assert.Nil(t, story.Parse(input))
+	assert.Nil(t, story.PostParsing())
+
+	data, err := story.MarshalBinary()
+	assert.Nil(t, err)
+	loaded, err := UnmarshalStory(data)
+	assert.Nil(t, err)
+
+	sec, err := story.Resume(NewContext())
+	assert.Nil(t, err)
+	lsec, err := loaded.Resume(NewContext())
+	assert.Nil(t, err)
+
+	assert.Equal(t, "Poor line\nGathered.", sec.Text)
+	assert.Equal(t, sec.Text, lsec.Text)
+}
+
+func TestUnmarshalStoryErrors(t *testing.T) {
+	story := Default()
+	assert.Nil(t, story.Parse("Hello."))
+
+	data, err := story.MarshalBinary()
+	assert.Nil(t, err)
+
+	// built by the older version
+	old := append([]byte{}, data...)
+	old[len(binaryMagic)+1] = binaryVersion - 1
+	_, err = UnmarshalStory(old)
+	assert.Equal(t, "compiled story version 2 is not supported, it should be 3", err.Error())
+
+	_, err = UnmarshalStory([]byte("Hello."))
+	assert.Equal(t, "data is not a compiled story", err.Error())
+
+	_, err = UnmarshalStory(data[:len(data)-4])
+	assert.Contains(t, err.Error(), "invalid compiled story")
+
+	compiled, _ := LoadJSON([]byte(shopJSON))
+	_, err = compiled.MarshalBinary()
+	assert.Equal(t, "can not marshal the compiled story", err.Error())
+}
+
+// layouts of the compiled story by its version, the version should be
+// bumped, and its layout recorded here, whenever the format is changed
+var binaryLayouts = map[int]string{
+	1: "1201d775f59a0871",
+	2: "af436b404041565d",
+	3: "c120d1b47870304e",
+}
+
+func TestBinaryLayout(t *testing.T) {
+	layout := binaryLayout(reflect.TypeOf(binStory{}), make(map[reflect.Type]bool))
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(layout))
+
+	assert.Equal(t, binaryLayouts[binaryVersion], fmt.Sprintf("%x", h.Sum64()), "binaryVersion should be bumped, when the format is changed: %s", layout)
+}
+
+// binaryLayout of the type, with the names and types of its fields
+func binaryLayout(t reflect.Type, seen map[reflect.Type]bool) string {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice:
+		return t.Kind().String() + " " + binaryLayout(t.Elem(), seen)
+	case reflect.Map:
+		return "map[" + binaryLayout(t.Key(), seen) + "]" + binaryLayout(t.Elem(), seen)
+	case reflect.Struct:
+		if seen[t] {
+			return t.Name()
+		}
+		seen[t] = true
+
+		var fields []string
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			fields = append(fields, f.Name+" "+binaryLayout(f.Type, seen))
+		}
+		return t.Name() + "{" + strings.Join(fields, "; ") + "}"
+	}
+
+	return t.String()
+}
+
+func TestMarshalUnknownNode(t *testing.T) {
+	story := Default()
+	assert.Nil(t, story.Parse("Hello."))
+	story.paths["unknown"] = &unknownNode{base: &base{path: "unknown"}}
+
+	_, err := story.MarshalBinary()
+	assert.Equal(t, "can not marshal the story: unknown node: *goink.unknownNode unknown", err.Error())
+}
+
+type unknownNode struct {
+	*base
+}
@@ -0,0 +1,211 @@
+package goink
+
+import (
+	"math"
+	"math/rand"
+
+	"github.com/pkg/errors"
+)
+
+// signatures of the built-in functions, which are checked when compiling,
+// the functions of the story are unknown until they are called
+var signatures = map[string]interface{}{
+	"TURNS":        (func() int)(nil),
+	"TURNS_SINCE":  (func(interface{}) int)(nil),
+	"CHOICE_COUNT": (func() int)(nil),
+	"RANDOM":       (func(interface{}, interface{}) int)(nil),
+	"SEED_RANDOM":  (func(interface{}) interface{})(nil),
+	"INT":          (func(interface{}) int)(nil),
+	"FLOOR":        (func(interface{}) float64)(nil),
+	"FLOAT":        (func(interface{}) float64)(nil),
+	"MIN":          (func(interface{}, interface{}) interface{})(nil),
+	"MAX":          (func(interface{}, interface{}) interface{})(nil),
+	"POW":          (func(interface{}, interface{}) interface{})(nil),
+	"_visits":      (func(string) int)(nil),
+	"_target":      (func(string) DivertTarget)(nil),
+
+	"_add":        (func(interface{}, interface{}) interface{})(nil),
+	"_sub":        (func(interface{}, interface{}) interface{})(nil),
+	"_has":        (func(interface{}, interface{}) interface{})(nil),
+	"_hasnt":      (func(interface{}, interface{}) interface{})(nil),
+	"_intersect":  (func(interface{}, interface{}) interface{})(nil),
+	"_list":       (func(...interface{}) interface{})(nil),
+	"_compare":    (func(string, interface{}, interface{}) bool)(nil),
+	"LIST_COUNT":  (func(interface{}) interface{})(nil),
+	"LIST_MIN":    (func(interface{}) interface{})(nil),
+	"LIST_MAX":    (func(interface{}) interface{})(nil),
+	"LIST_VALUE":  (func(interface{}) interface{})(nil),
+	"LIST_ALL":    (func(interface{}) interface{})(nil),
+	"LIST_INVERT": (func(interface{}) interface{})(nil),
+}
+
+// builtins functions of ink, which are used by the expressions
+func (s *Story) builtins() map[string]interface{} {
+	return map[string]interface{}{
+		"TURNS": func() int {
+			return s.turns
+		},
+		"_visits": func(path string) int {
+			return s.visits[path]
+		},
+		"_target": func(path string) DivertTarget {
+			return DivertTarget(path)
+		},
+		"TURNS_SINCE": func(target interface{}) int {
+			v, err := s.turnsSince(target)
+			if err != nil {
+				s.raise(err)
+			}
+			return v
+		},
+		"CHOICE_COUNT": func() int {
+			return s.choices
+		},
+		"RANDOM": func(min, max interface{}) int {
+			v, err := s.random(min, max)
+			if err != nil {
+				s.raise(err)
+			}
+			return v
+		},
+		"SEED_RANDOM": func(seed interface{}) interface{} {
+			if err := s.seedRandom(seed); err != nil {
+				s.raise(err)
+			}
+			return nil
+		},
+		"INT": func(v interface{}) int {
+			return int(s.float("INT", v))
+		},
+		"FLOOR": func(v interface{}) float64 {
+			return math.Floor(s.float("FLOOR", v))
+		},
+		"FLOAT": func(v interface{}) float64 {
+			return s.float("FLOAT", v)
+		},
+		"MIN": func(a, b interface{}) interface{} {
+			if s.float("MIN", a) <= s.float("MIN", b) {
+				return a
+			}
+			return b
+		},
+		"MAX": func(a, b interface{}) interface{} {
+			if s.float("MAX", a) >= s.float("MAX", b) {
+				return a
+			}
+			return b
+		},
+		"POW": func(a, b interface{}) interface{} {
+			v := math.Pow(s.float("POW", a), s.float("POW", b))
+
+			// integers' power is still an integer
+			_, ia := a.(int)
+			_, ib := b.(int)
+			if ia && ib && v == math.Trunc(v) {
+				return int(v)
+			}
+			return v
+		},
+	}
+}
+
+// turnsSince the target is visited, -1 if it is never visited
+func (s *Story) turnsSince(target interface{}) (int, error) {
+	path, ok := target.(DivertTarget)
+	if !ok {
+		return 0, errors.Errorf("TURNS_SINCE needs divert target, but got: %v", target)
+	}
+
+	n := s.divert(string(path), s.current)
+	if n == nil {
+		return 0, errors.Errorf("can not find the divert: %s", path)
+	}
+
+	if turn, ok := s.seen[n.Path()]; ok {
+		return s.turns - turn, nil
+	}
+	return -1, nil
+}
+
+// random integer between min and max, both are included
+func (s *Story) random(min, max interface{}) (int, error) {
+	a, err := intArg("RANDOM", min)
+	if err != nil {
+		return 0, err
+	}
+
+	b, err := intArg("RANDOM", max)
+	if err != nil {
+		return 0, err
+	}
+
+	if b < a {
+		a, b = b, a
+	}
+
+	return a + rand.New(s.rng).Intn(b-a+1), nil
+}
+
+// seedRandom resets the random sequence
+func (s *Story) seedRandom(seed interface{}) error {
+	v, err := intArg("SEED_RANDOM", seed)
+	if err != nil {
+		return err
+	}
+
+	s.rng = newSource(int64(v), 0)
+	return nil
+}
+
+// randSource of the random numbers, which is seeded by the context,
+// and replayed to its rolls when the context is loaded
+type randSource struct {
+	rand.Source
+	seed  int64
+	rolls int
+}
+
+// newSource with the seed, which has been rolled the times
+func newSource(seed int64, rolls int) *randSource {
+	src := &randSource{Source: rand.NewSource(seed), seed: seed}
+	for src.rolls < rolls {
+		src.Int63()
+	}
+	return src
+}
+
+// Int63 rolls the source
+func (src *randSource) Int63() int64 {
+	src.rolls++
+	return src.Source.Int63()
+}
+
+// float argument of the built-in function, the error is raised
+func (s *Story) float(name string, v interface{}) float64 {
+	f, err := floatArg(name, v)
+	if err != nil {
+		s.raise(err)
+	}
+	return f
+}
+
+// intArg returns the integer argument
+func intArg(name string, v interface{}) (int, error) {
+	if i, ok := intOf(v); ok {
+		return i, nil
+	}
+
+	return 0, errors.Errorf("%s needs integer argument, but got: %v", name, v)
+}
+
+// floatArg returns the number argument as float
+func floatArg(name string, v interface{}) (float64, error) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	}
+
+	return 0, errors.Errorf("%s needs number argument, but got: %v", name, v)
+}
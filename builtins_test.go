@@ -0,0 +1,121 @@
+package goink
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuiltins(t *testing.T) {
+	input := `
+	{INT(3.7)} {FLOOR(-1.5)} {FLOAT(2)} {MIN(3, 1)} {MAX(2.5, 1)} {POW(2, 3)} {POW(2, 0.5) > 1.4}
+	-> hub
+	== hub
+	Turn {TURNS()}, shop {TURNS_SINCE(-> shop)}, counter {TURNS_SINCE(-> shop.counter)}.
+	+ {CHOICE_COUNT() == 0} [First] -> shop
+	+ {CHOICE_COUNT() == 1} [Second] -> hub
+	* {CHOICE_COUNT() == 5} [Never] -> END
+	== shop
+	= counter
+	In the shop. -> hub
+	`
+
+	story := Default()
+	err := story.Parse(input)
+	assert.Nil(t, err)
+	assert.Nil(t, story.PostParsing())
+
+	ctx := NewContext()
+	sec, err := story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "3 -2 2 1 2.5 8 true\nTurn 0, shop -1, counter -1.", sec.Text)
+	assert.Equal(t, []string{"First", "Second"}, sec.Opts)
+
+	sec, err = story.Pick(ctx, 0)
+	assert.Nil(t, err)
+	assert.Contains(t, sec.Text, "In the shop.\nTurn 1, shop 0, counter 0.")
+	assert.Equal(t, 1, ctx.Turns)
+
+	sec, err = story.Pick(ctx, 1)
+	assert.Nil(t, err)
+	assert.Contains(t, sec.Text, "Turn 2, shop 1, counter 1.")
+	assert.Equal(t, 1, ctx.Seen["shop"])
+
+	_, err = story.Resume(&Context{Current: "start"})
+	assert.Nil(t, err)
+
+	input = `
+	{POW(2)}
+	`
+	story = Default()
+	err = story.Parse(input)
+	assert.Contains(t, err.Error(), "not enough arguments to call POW")
+}
+
+func TestRandom(t *testing.T) {
+	input := `
+	~ SEED_RANDOM(42)
+	{RANDOM(1, 6)} {RANDOM(1, 6)} {RANDOM(1, 6)}
+	-> END
+	`
+
+	story := Default()
+	err := story.Parse(input)
+	assert.Nil(t, err)
+
+	ctx := NewContext()
+	sec, err := story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 42, int(ctx.Seed))
+	assert.Equal(t, 3, ctx.Rolls)
+
+	// same seed, same sequence
+	again, err := story.Resume(NewContext())
+	assert.Nil(t, err)
+	assert.Equal(t, sec.Text, again.Text)
+
+	for _, n := range []int{0, 2, 4} {
+		assert.True(t, sec.Text[n] >= '1' && sec.Text[n] <= '6')
+	}
+
+	input = `
+	{RANDOM("a", 6)}
+	-> END
+	`
+
+	story = Default()
+	err = story.Parse(input)
+	assert.Nil(t, err)
+
+	_, err = story.Resume(NewContext())
+	assert.Contains(t, err.Error(), "RANDOM needs integer argument, but got: a")
+}
+
+func TestRandomSource(t *testing.T) {
+	input := `
+	-> roll
+	== roll
+	{RANDOM(1, 100)} {RANDOM(1, 100)}
+	+ [Again] -> roll
+	`
+
+	story := Default()
+	assert.Nil(t, story.Parse(input))
+	assert.Nil(t, story.PostParsing())
+
+	// one source per context, which is continued after loading
+	r := rand.New(rand.NewSource(7))
+	ctx := NewContext()
+	ctx.Seed = 7
+
+	sec, err := story.Resume(ctx)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, err)
+		a := 1 + r.Intn(100)
+		assert.Equal(t, fmt.Sprintf("%d %d", a, 1+r.Intn(100)), sec.Text)
+		sec, err = story.Pick(ctx, 0)
+	}
+	assert.Equal(t, 8, ctx.Rolls)
+}
@@ -0,0 +1,77 @@
+package goink
+
+import (
+	"regexp"
+	"strings"
+)
+
+var todoReg = regexp.MustCompile(`^TODO\s*:\s*(.*)$`)
+
+// Todo note of the writer
+type Todo struct {
+	LN   int    `json:"ln"`
+	File string `json:"file,omitempty"`
+	Text string `json:"text"`
+}
+
+// readTodo collects the TODO line of the story
+func readTodo(s *Story, input string, ln int) error {
+	res := todoReg.FindStringSubmatch(input)
+	if res == nil {
+		return errNotMatch
+	}
+
+	s.todos = append(s.todos, Todo{LN: ln, File: s.file, Text: strings.TrimSpace(res[1])})
+	return nil
+}
+
+// Todos of the story, in order of parsing
+func (s *Story) Todos() []Todo {
+	return s.todos
+}
+
+// stripBlockComments removes the /* ... */ comments of the line,
+// commenting tells if the line starts or ends inside a block comment
+func stripBlockComments(line string, commenting bool) (string, bool) {
+	var out strings.Builder
+	for {
+		if commenting {
+			end := strings.Index(line, "*/")
+			if end < 0 {
+				return out.String(), true
+			}
+
+			line = line[end+2:]
+			commenting = false
+			continue
+		}
+
+		// block comment after the line comment is ignored
+		start := indexComment(line)
+		if start < 0 || strings.HasPrefix(line[start:], "//") {
+			out.WriteString(line)
+			return out.String(), false
+		}
+
+		out.WriteString(line[:start])
+		line = line[start+2:]
+		commenting = true
+	}
+}
+
+// indexComment returns the index of the first "/*" or "//",
+// which is not in the quoted string
+func indexComment(line string) int {
+	quoted := false
+	for i := 0; i+1 < len(line); i++ {
+		switch {
+		case line[i] == '"':
+			quoted = !quoted
+		case quoted:
+		case line[i] == '/' && (line[i+1] == '*' || line[i+1] == '/'):
+			return i
+		}
+	}
+
+	return -1
+}
@@ -0,0 +1,76 @@
+package goink
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlockComments(t *testing.T) {
+	line, commenting := stripBlockComments("a /* b */ c /* d", false)
+	assert.Equal(t, "a  c ", line)
+	assert.True(t, commenting)
+
+	line, commenting = stripBlockComments("still d */ e", true)
+	assert.Equal(t, " e", line)
+	assert.False(t, commenting)
+
+	line, commenting = stripBlockComments("f // g /* h", false)
+	assert.Equal(t, "f // g /* h", line)
+	assert.False(t, commenting)
+
+	line, commenting = stripBlockComments(`say "/* not a comment */" /* x */ ok`, false)
+	assert.Equal(t, `say "/* not a comment */"  ok`, line)
+	assert.False(t, commenting)
+
+	input := `
+	Hello /* inline */ world.
+	/*
+	-> invalid divert
+	* invalid choice
+	*/
+	Bye. /* the end
+	of the story */ -> END
+	`
+
+	story := Default()
+	err := story.Parse(input)
+	assert.Nil(t, err)
+	assert.Nil(t, story.PostParsing())
+
+	sec, err := story.Resume(NewContext())
+	assert.Nil(t, err)
+	assert.Equal(t, "Hello  world.\nBye.", sec.Text)
+
+	input = `
+	Hello.
+	/* unclosed
+	-> END
+	`
+
+	story = Default()
+	err = story.Parse(input)
+	assert.Equal(t, "block comment is not closed ln: 3", err.Error())
+}
+
+func TestTodos(t *testing.T) {
+	input := `
+	TODO: write the opening
+	Hello. -> knot
+	== knot
+	TODO:   check the tone
+	/* TODO: commented */
+	Bye. -> END
+	`
+
+	story := Default()
+	err := story.Parse(input)
+	assert.Nil(t, err)
+	assert.Nil(t, story.PostParsing())
+
+	assert.Equal(t, []Todo{{LN: 2, Text: "write the opening"}, {LN: 5, Text: "check the tone"}}, story.Todos())
+
+	sec, err := story.Resume(NewContext())
+	assert.Nil(t, err)
+	assert.Equal(t, "Hello.\nBye.", sec.Text)
+}
@@ -0,0 +1,431 @@
+package goink
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// content is the parsed text of a line,
+// which is mixed with plain text and inline expressions
+type content []segment
+
+// segment of the content
+type segment interface {
+	render(n Node) (string, error)
+}
+
+// plain text segment
+type plain string
+
+func (p plain) render(n Node) (string, error) {
+	return string(p), nil
+}
+
+// inline expression segment: {expr}
+type inline struct {
+	*exprc
+}
+
+func (i *inline) render(n Node) (string, error) {
+	s := n.Story()
+	mark := len(s.output)
+
+	v, err := s.eval(i.exprc)
+	// output of the called functions
+	out := s.flush(mark)
+	if err != nil {
+		return "", err
+	}
+
+	return out + stringify(v), nil
+}
+
+// inline conditional segment: {cond: a|b}
+type conditional struct {
+	condition *exprc
+	branches  []content
+}
+
+func (c *conditional) render(n Node) (string, error) {
+	b, err := n.Story().test(c.condition)
+	if err != nil {
+		return "", err
+	}
+
+	if b {
+		return c.branches[0].render(n)
+	} else if len(c.branches) > 1 {
+		return c.branches[1].render(n)
+	}
+
+	return "", nil
+}
+
+// kinds of the alternatives
+const (
+	stopping = iota // {a|b|c}
+	cycle           // {&a|b|c}
+	shuffle         // {~a|b|c}
+	once            // {!a|b|c}
+)
+
+// alternatives segment, which renders one of its items by visit count
+type alternatives struct {
+	kind  int
+	items []content
+	idx   int // index of the alternatives in the line
+}
+
+// key of the visit count in story's visits
+func (a *alternatives) key(n Node) string {
+	return n.Path() + PathSplit + "s" + strconv.Itoa(a.idx)
+}
+
+// render the item by the visit count, which is advanced
+// when the step is done, so rendering again shows the same one
+func (a *alternatives) render(n Node) (string, error) {
+	s := n.Story()
+	key := a.key(n)
+
+	count := s.visits[key]
+	if s.shown != nil {
+		s.shown[key] = true
+	}
+
+	size := len(a.items)
+	idx := -1
+
+	switch a.kind {
+	case stopping:
+		idx = count
+		if idx >= size {
+			idx = size - 1
+		}
+	case cycle:
+		idx = count % size
+	case shuffle:
+		// every cycle has its own shuffled order, which is decided by the seed
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(key))
+		r := rand.New(rand.NewSource(s.rng.seed + int64(h.Sum64()) + int64(count/size)))
+		idx = r.Perm(size)[count%size]
+	case once:
+		if count < size {
+			idx = count
+		}
+	}
+
+	if idx < 0 {
+		return "", nil
+	}
+	return a.items[idx].render(n)
+}
+
+// render all segments of the content
+func (c content) render(n Node) (string, error) {
+	var sb strings.Builder
+	for _, seg := range c {
+		str, err := seg.render(n)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(str)
+	}
+
+	return sb.String(), nil
+}
+
+// blank content, which has only spaces
+func (c content) blank() bool {
+	for _, seg := range c {
+		if p, ok := seg.(plain); !ok || strings.TrimSpace(string(p)) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// exprcs of the content's segments
+func (c content) exprcs() (list []*exprc) {
+	for _, seg := range c {
+		switch s := seg.(type) {
+		case *inline:
+			list = append(list, s.exprc)
+		case *conditional:
+			list = append(list, s.condition)
+			for _, b := range s.branches {
+				list = append(list, b.exprcs()...)
+			}
+		case *alternatives:
+			for _, i := range s.items {
+				list = append(list, i.exprcs()...)
+			}
+		}
+	}
+
+	return
+}
+
+// parseContent splits the text into plain and inline segments
+func parseContent(text string) (c content, err error) {
+	for len(text) > 0 {
+		start := strings.IndexAny(text, "{}")
+		if start < 0 {
+			c = append(c, plain(text))
+			break
+		}
+
+		if text[start] == '}' {
+			return nil, errors.Errorf("unbalanced braces: %s", text)
+		}
+
+		end := matchBrace(text, start)
+		if end < 0 {
+			return nil, errors.Errorf("unclosed brace: %s", text)
+		}
+
+		if start > 0 {
+			c = append(c, plain(text[:start]))
+		}
+
+		seg, err := parseInline(text[start+1 : end])
+		if err != nil {
+			return nil, err
+		}
+		c = append(c, seg)
+
+		text = text[end+1:]
+	}
+
+	return
+}
+
+// parseInline parses the code between the braces
+func parseInline(code string) (segment, error) {
+	code = strings.TrimLeft(code, " \t")
+	if len(strings.TrimSpace(code)) == 0 {
+		return nil, errors.New("empty inline expression")
+	}
+
+	// alternatives with prefix
+	switch code[0] {
+	case '&':
+		return parseAlternatives(cycle, code[1:])
+	case '~':
+		return parseAlternatives(shuffle, code[1:])
+	case '!':
+		return parseAlternatives(once, code[1:])
+	}
+
+	// conditional text, unless the colon belongs to a ternary operator
+	if parts := splitTop(code, ':'); len(parts) > 1 {
+		if strings.Contains(parts[0], "?") {
+			if e, err := newExprc(strings.TrimSpace(code)); err == nil {
+				return &inline{exprc: e}, nil
+			}
+		}
+		return parseConditional(parts[0], strings.Join(parts[1:], ":"))
+	}
+
+	// sequence
+	if parts := splitTop(code, '|'); len(parts) > 1 {
+		return parseAlternatives(stopping, code)
+	}
+
+	e, err := newExprc(strings.TrimSpace(code))
+	if err != nil {
+		return nil, err
+	}
+
+	return &inline{exprc: e}, nil
+}
+
+// parseConditional parses the condition and its branches
+func parseConditional(cond, text string) (segment, error) {
+	e, err := newExprc(strings.TrimSpace(cond))
+	if err != nil {
+		return nil, err
+	}
+
+	c := &conditional{condition: e}
+	branches := splitTop(text, '|')
+	if len(branches) > 2 {
+		return nil, errors.Errorf("too many branches of the condition: %s", text)
+	}
+
+	for _, b := range branches {
+		b = strings.TrimSpace(b)
+		// quoted text
+		if len(b) > 1 && b[0] == '"' && b[len(b)-1] == '"' && !strings.Contains(b[1:len(b)-1], "\"") {
+			b = b[1 : len(b)-1]
+		}
+
+		bc, err := parseContent(b)
+		if err != nil {
+			return nil, err
+		}
+		c.branches = append(c.branches, bc)
+	}
+
+	return c, nil
+}
+
+// parseAlternatives parses the items of the alternatives
+func parseAlternatives(kind int, text string) (segment, error) {
+	a := &alternatives{kind: kind}
+	for _, item := range splitTop(text, '|') {
+		c, err := parseContent(strings.TrimSpace(item))
+		if err != nil {
+			return nil, err
+		}
+		a.items = append(a.items, c)
+	}
+
+	return a, nil
+}
+
+// index all the alternatives in the content, starting from the given index
+func (c content) index(idx int) int {
+	for _, seg := range c {
+		switch seg := seg.(type) {
+		case *alternatives:
+			seg.idx = idx
+			idx++
+			for _, item := range seg.items {
+				idx = item.index(idx)
+			}
+		case *conditional:
+			for _, b := range seg.branches {
+				idx = b.index(idx)
+			}
+		}
+	}
+
+	return idx
+}
+
+// splitTop splits the code by the separator, which is not
+// nested in braces, brackets or quotes, and "||" is not a separator
+func splitTop(code string, sep byte) (parts []string) {
+	depth := 0
+	quoted := false
+	last := 0
+
+	for i := 0; i < len(code); i++ {
+		ch := code[i]
+		if quoted {
+			quoted = ch != '"'
+			continue
+		}
+
+		switch ch {
+		case '"':
+			quoted = true
+		case '{', '(', '[':
+			depth++
+		case '}', ')', ']':
+			depth--
+		case sep:
+			if depth != 0 {
+				continue
+			}
+
+			if sep == '|' && i+1 < len(code) && code[i+1] == '|' {
+				i++
+				continue
+			}
+
+			parts = append(parts, code[last:i])
+			last = i + 1
+		}
+	}
+
+	return append(parts, code[last:])
+}
+
+// matchBrace returns the index of the brace which closes
+// the one at start, quoted and nested braces are skipped
+func matchBrace(text string, start int) int {
+	depth := 0
+	quoted := false
+
+	for i := start; i < len(text); i++ {
+		ch := text[i]
+		if quoted {
+			quoted = ch != '"'
+			continue
+		}
+
+		switch ch {
+		case '"':
+			quoted = depth > 0
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+// intOf the value, which may be decoded from json as float64
+func intOf(v interface{}) (int, bool) {
+	switch v := v.(type) {
+	case int:
+		return v, true
+	case float64:
+		return int(v), v == float64(int(v))
+	}
+
+	return 0, false
+}
+
+// indexTop returns the index of the first sub string,
+// which is out of braces and quoted strings
+func indexTop(text, sub string) int {
+	depth := 0
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case '"':
+			// the unclosed quote is plain text
+			if end := strings.IndexByte(text[i+1:], '"'); end >= 0 {
+				i += end + 1
+				continue
+			}
+			fallthrough
+		default:
+			if depth == 0 && strings.HasPrefix(text[i:], sub) {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+// stringify the value of an expression for output
+func stringify(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
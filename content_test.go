@@ -0,0 +1,217 @@
+package goink
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContentParsing(t *testing.T) {
+	c, err := parseContent("You have {gold} coins")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(c))
+
+	c, err = parseContent(`{"{braces}"} in quotes`)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(c))
+
+	c, err = parseContent("plain text only")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(c))
+
+	_, err = parseContent("unclosed {gold")
+	assert.Contains(t, err.Error(), "unclosed brace")
+
+	_, err = parseContent("unbalanced } brace")
+	assert.Contains(t, err.Error(), "unbalanced braces")
+
+	_, err = parseContent("empty {  } expression")
+	assert.Contains(t, err.Error(), "empty inline")
+
+	_, err = parseContent("invalid {gold >} expression")
+	assert.NotNil(t, err)
+}
+
+func TestVariableInterpolation(t *testing.T) {
+	input := `
+	VAR gold = 10
+	VAR name = "Joe"
+	VAR price = 2.5
+	Hi {name}, you have {gold} coins. # {tag}
+	* [Buy for {price}] You bought it for {price * 2}.
+	* {gold > 100} Buy all
+	- Now {gold + 1}. -> END
+	`
+
+	story := Default()
+	err := story.Parse(input)
+	assert.Nil(t, err)
+
+	ctx := NewContext()
+	sec, err := story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Contains(t, sec.Text, "Hi Joe, you have 10 coins.")
+	assert.Equal(t, 1, len(sec.Opts))
+	assert.Equal(t, "Buy for 2.5", sec.Opts[0])
+
+	sec, err = story.Pick(ctx, 0)
+	assert.Nil(t, err)
+	assert.Contains(t, sec.Text, "You bought it for 5.\nNow 11.")
+	assert.Equal(t, 10, ctx.Vars["gold"])
+}
+
+func TestInlineConditional(t *testing.T) {
+	c, err := parseContent(`{met_blacksmith: "Hello again"|"Who are you?"}`)
+	assert.Nil(t, err)
+	assert.IsType(t, &conditional{}, c[0])
+	assert.Equal(t, 2, len(c[0].(*conditional).branches))
+
+	c, err = parseContent(`{a || b: yes}`)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(c[0].(*conditional).branches))
+
+	_, err = parseContent(`{a: b|c|d}`)
+	assert.Contains(t, err.Error(), "too many branches")
+
+	_, err = parseContent(`{a >: b|c}`)
+	assert.NotNil(t, err)
+
+	// the colon of the ternary operator, or in quotes
+	c, err = parseContent(`{x ? "a" : "b"}`)
+	assert.Nil(t, err)
+	assert.IsType(t, &inline{}, c[0])
+
+	c, err = parseContent(`{"a:b" == x}`)
+	assert.Nil(t, err)
+	assert.IsType(t, &inline{}, c[0])
+
+	c, err = parseContent(`{inventory ? sword: You are armed.}`)
+	assert.Nil(t, err)
+	assert.IsType(t, &conditional{}, c[0])
+
+	input := `
+	VAR met_blacksmith = false
+	VAR gold = 3
+	{met_blacksmith: "Hello again"|"Who are you?"}, said the {gold > 2: rich|poor} man{gold > 2 ? "!" : "."}
+	* {met_blacksmith: Leave|Greet} him
+	  -> END
+	`
+
+	story := Default()
+	err = story.Parse(input)
+	assert.Nil(t, err)
+
+	ctx := NewContext()
+	sec, err := story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Contains(t, sec.Text, "Who are you?, said the rich man!")
+	assert.Equal(t, "Greet him", sec.Opts[0])
+
+	ctx = NewContext()
+	ctx.Vars["met_blacksmith"] = true
+	sec, err = story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Contains(t, sec.Text, "Hello again, said")
+	assert.Equal(t, "Leave him", sec.Opts[0])
+}
+
+func TestAlternatives(t *testing.T) {
+	c, err := parseContent("{a|b} {&c|{d|e}} {~f|g} {!h}")
+	assert.Nil(t, err)
+	assert.Equal(t, 5, c.index(0))
+	assert.Equal(t, stopping, c[0].(*alternatives).kind)
+	assert.Equal(t, cycle, c[2].(*alternatives).kind)
+	assert.Equal(t, shuffle, c[4].(*alternatives).kind)
+	assert.Equal(t, once, c[6].(*alternatives).kind)
+
+	input := `
+	-> knot
+	== knot
+	{I bought a red car.|I bought a blue car.|I bought a car.} # {&Mon|Tue}
+	It is {&Mon|Tue|Wed}day. {!First!|Second!} {~A|B|C}
+	+ [again] -> knot
+	`
+
+	story := Default()
+	err = story.Parse(input)
+	assert.Nil(t, err)
+
+	var texts []string
+	shuffled := make(map[string]int)
+
+	ctx := NewContext()
+	sec, err := story.Resume(ctx)
+	assert.Nil(t, err)
+	texts = append(texts, sec.Text)
+
+	for i := 0; i < 5; i++ {
+		shuffled[sec.Text[len(sec.Text)-1:]]++
+		sec, err = story.Pick(ctx, 0)
+		assert.Nil(t, err)
+		texts = append(texts, sec.Text)
+	}
+
+	assert.Contains(t, texts[0], "I bought a red car.\nIt is Monday. First!")
+	assert.Contains(t, texts[1], "I bought a blue car.\nIt is Tueday. Second!")
+	assert.Contains(t, texts[2], "I bought a car.\nIt is Wedday. ")
+	assert.Contains(t, texts[3], "I bought a car.\nIt is Monday. ")
+
+	// every item appears once in a shuffled cycle
+	assert.Equal(t, 3, len(shuffled))
+
+	// the counts are kept apart from the vars
+	assert.Equal(t, 6, ctx.Visits["knot__i__s0"])
+	assert.NotContains(t, ctx.Vars, "knot__i__s0")
+}
+
+func TestAlternativesOnce(t *testing.T) {
+	input := `
+	-> hub
+	== hub
+	{&Tick|Tock}.
+	+ {&Red|Blue} pill
+	  -> hub
+	+ {~Left|Right}
+	  -> hub
+	`
+
+	story := Default()
+	assert.Nil(t, story.Parse(input))
+	assert.Nil(t, story.PostParsing())
+
+	// listing and explaining the options never advance them
+	ctx := NewContext()
+	sec, err := story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "Tick.", sec.Text)
+	assert.Equal(t, "Red pill", sec.Opts[0])
+
+	_, err = story.Explain(ctx)
+	assert.Nil(t, err)
+	again, err := story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, sec.Opts, again.Opts)
+
+	// the picked option is rendered as it is listed
+	sec, err = story.Pick(ctx, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "Red pill\nTock.", sec.Text)
+	assert.Equal(t, "Blue pill", sec.Opts[0])
+	assert.Equal(t, 1, ctx.Visits["hub__i__c__0__s0"])
+
+	// shuffle is decided by the seed of the context
+	shuffled := func(seed int64) []string {
+		ctx := NewContext()
+		ctx.Seed = seed
+		var picked []string
+		for i := 0; i < 4; i++ {
+			sec, err := story.Resume(ctx)
+			assert.Nil(t, err)
+			picked = append(picked, sec.Opts[1])
+			_, err = story.Pick(ctx, 1)
+			assert.Nil(t, err)
+		}
+		return picked
+	}
+	assert.Equal(t, shuffled(3), shuffled(3))
+}
@@ -0,0 +1,1379 @@
+package goink
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	spacesReg = regexp.MustCompile(`[ \t]{2,}`)
+	glueReg   = regexp.MustCompile(`\n*(\x00\n*)+`)
+)
+
+// engine runs the story compiled by inklecate
+type engine struct {
+	story      *Story
+	root       *container
+	containers map[string]*container
+
+	// call stacks of the threads, the last one is the current
+	threads [][]*frame
+	evals   []interface{}
+	output  []interface{}
+	choices []*Choice
+
+	diverted *pointer
+	previous pointer
+}
+
+// pointer to the content of the container,
+// the index -1 means the container itself
+type pointer struct {
+	c *container
+	i int
+}
+
+// resolve the content of the pointer
+func (p pointer) resolve() interface{} {
+	if p.c == nil {
+		return nil
+	}
+	if p.i < 0 || len(p.c.content) == 0 {
+		return p.c
+	}
+	if p.i >= len(p.c.content) {
+		return nil
+	}
+
+	return p.c.content[p.i]
+}
+
+// String of the pointer: path:index
+func (p pointer) String() string {
+	if p.c == nil {
+		return ""
+	}
+	return p.c.path + ":" + strconv.Itoa(p.i)
+}
+
+// frame of the call stack
+type frame struct {
+	ptr   pointer
+	kind  FrameKind
+	temps map[string]interface{}
+	eval  bool // in expression evaluation
+}
+
+// Choice of the compiled story, which is kept in the context
+// with the call stack of the thread where it is generated
+type Choice struct {
+	Text  string   `json:"text"`
+	Path  string   `json:"path"`
+	Tags  []string `json:"tags"`
+	Stack []Frame  `json:"stack"`
+
+	invisible bool
+}
+
+// markers of the output stream
+type (
+	beginString struct{}
+	beginTag    struct{}
+)
+
+// stack of the current thread
+func (e *engine) stack() []*frame {
+	return e.threads[len(e.threads)-1]
+}
+
+// current frame of the current thread
+func (e *engine) current() *frame {
+	st := e.stack()
+	return st[len(st)-1]
+}
+
+// declare the global variables by running the "global decl" container
+func (e *engine) declare() error {
+	e.reset(nil)
+
+	s := e.story
+	if c, ok := e.root.named["global decl"]; ok {
+		e.current().ptr = pointer{c: c, i: 0}
+		if err := e.run(); err != nil {
+			return err
+		}
+	}
+
+	for k, v := range s.vars {
+		s.defaults[k] = v
+	}
+	return nil
+}
+
+// reset the state of the engine with the call stack
+func (e *engine) reset(stack []*frame) {
+	if len(stack) == 0 {
+		stack = []*frame{{kind: pushTunnel, temps: make(map[string]interface{})}}
+	}
+
+	e.threads = [][]*frame{stack}
+	e.evals, e.output, e.choices = nil, nil, nil
+	e.diverted, e.previous = nil, pointer{}
+}
+
+// resume the compiled story from the context
+func (e *engine) resume(ctx *Context) (*Section, error) {
+	if err := e.load(ctx); err != nil {
+		return nil, err
+	}
+
+	// keep waiting for the choice
+	if len(ctx.Choices) > 0 || ctx.End {
+		return e.section(ctx, "", nil), nil
+	}
+
+	e.current().ptr = pointer{c: e.root, i: 0}
+	if ctx.Current != "start" {
+		p, err := e.parse(ctx.Current)
+		if err != nil {
+			return nil, err
+		}
+		e.current().ptr = p
+	}
+
+	return e.continues(ctx)
+}
+
+// pick the choice of the compiled story
+func (e *engine) pick(ctx *Context, idx int) (*Section, error) {
+	if err := e.load(ctx); err != nil {
+		return nil, err
+	}
+
+	if len(ctx.Choices) == 0 {
+		return nil, errors.New("current line is not an option")
+	}
+	if idx < 0 || idx >= len(ctx.Choices) {
+		return nil, errors.Errorf("no option available [%s] at idx: %d", ctx.Current, idx)
+	}
+
+	ch := ctx.Choices[idx]
+	stack, err := e.frames(ch.Stack)
+	if err != nil {
+		return nil, err
+	}
+	e.reset(stack)
+
+	e.story.turns++
+	if err := e.choose(ch.Path); err != nil {
+		return nil, err
+	}
+
+	return e.continues(ctx)
+}
+
+// choose the path of the choice
+func (e *engine) choose(path string) error {
+	c, ok := e.containers[path]
+	if !ok {
+		return errors.Errorf("can not find the choice: %s", path)
+	}
+
+	e.current().ptr = pointer{c: c, i: 0}
+	e.visitChanged()
+	return nil
+}
+
+// continues the story until the choices or the end
+func (e *engine) continues(ctx *Context) (*Section, error) {
+	var text []string
+	var tags []string
+	for {
+		if err := e.run(); err != nil {
+			return nil, err
+		}
+
+		t, tg := e.flush()
+		text = append(text, t)
+		tags = append(tags, tg...)
+
+		// follow the invisible default choice, when it is the only one
+		var visible []*Choice
+		for _, c := range e.choices {
+			if !c.invisible {
+				visible = append(visible, c)
+			}
+		}
+
+		if len(visible) == 0 && len(e.choices) > 0 {
+			c := e.choices[0]
+			stack, err := e.frames(c.Stack)
+			if err != nil {
+				return nil, err
+			}
+
+			e.reset(stack)
+			if err := e.choose(c.Path); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		*ctx = e.save(visible)
+		return e.section(ctx, cleanText(strings.Join(text, "\n")), tags), nil
+	}
+}
+
+// section of the context with the rendered text
+func (e *engine) section(ctx *Context, text string, tags []string) *Section {
+	sec := &Section{Text: text, Tags: tags}
+	for _, c := range ctx.Choices {
+		sec.Opts = append(sec.Opts, c.Text)
+		sec.OptsTags = append(sec.OptsTags, c.Tags)
+	}
+
+	sec.End = len(sec.Opts) == 0
+	return sec
+}
+
+// load the state from the context, which is copied,
+// so that it is not changed when the story is failed
+func (e *engine) load(ctx *Context) error {
+	s := e.story
+	s.vars = copy(ctx.Vars)
+	s.declare(s.vars)
+
+	s.turns, s.rng = ctx.Turns, newSource(ctx.Seed, ctx.Rolls)
+	s.seen, s.visits = counts(ctx.Seen), counts(ctx.Visits)
+
+	stack, err := e.frames(ctx.Stack)
+	if err != nil {
+		return err
+	}
+
+	e.reset(stack)
+	return nil
+}
+
+// save the state into the context, with the visible choices
+func (e *engine) save(choices []*Choice) Context {
+	s := e.story
+	ctx := Context{Vars: copy(s.vars), Temps: make(map[string]interface{}), End: len(choices) == 0}
+	ctx.Turns, ctx.Seed, ctx.Rolls = s.turns, s.rng.seed, s.rng.rolls
+
+	ctx.Seen, ctx.Visits = counts(s.seen), counts(s.visits)
+
+	for _, c := range choices {
+		ctx.Choices = append(ctx.Choices, *c)
+	}
+
+	return ctx
+}
+
+// framesOf the call stack
+func framesOf(stack []*frame) (frames []Frame) {
+	for _, f := range stack {
+		frames = append(frames, Frame{Path: f.ptr.String(), Kind: f.kind, Temps: copy(f.temps)})
+	}
+	return
+}
+
+// frames of the call stack from the context
+func (e *engine) frames(frames []Frame) ([]*frame, error) {
+	var stack []*frame
+	for _, f := range frames {
+		p, err := e.parse(f.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		temps := copy(f.Temps)
+		if temps == nil {
+			temps = make(map[string]interface{})
+		}
+		stack = append(stack, &frame{ptr: p, kind: f.Kind, temps: temps})
+	}
+
+	return stack, nil
+}
+
+// parse the pointer from path:index
+func (e *engine) parse(str string) (pointer, error) {
+	if str == "" {
+		return pointer{}, nil
+	}
+
+	i := strings.LastIndex(str, ":")
+	if i < 0 {
+		return pointer{}, errors.Errorf("current path [%s] is not existed", str)
+	}
+
+	c, ok := e.containers[str[:i]]
+	idx, err := strconv.Atoi(str[i+1:])
+	if !ok || err != nil {
+		return pointer{}, errors.Errorf("current path [%s] is not existed", str)
+	}
+
+	return pointer{c: c, i: idx}, nil
+}
+
+// flush the output stream into text and tags
+func (e *engine) flush() (string, []string) {
+	var sb strings.Builder
+	var tags []string
+	for _, o := range e.output {
+		switch o := o.(type) {
+		case string:
+			sb.WriteString(o)
+		case glue:
+			sb.WriteByte(0)
+		case tag:
+			tags = append(tags, o.text)
+		}
+	}
+
+	e.output = nil
+	return glueReg.ReplaceAllString(sb.String(), ""), tags
+}
+
+// cleanText trims the spaces of the lines, and drops the empty ones
+func cleanText(text string) string {
+	var lines []string
+	for _, l := range strings.Split(text, "\n") {
+		if l = strings.TrimSpace(spacesReg.ReplaceAllString(l, " ")); l != "" {
+			lines = append(lines, l)
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// run the steps until the pointer is null
+func (e *engine) run() error {
+	for !e.current().ptr.null() {
+		if err := e.step(); err != nil {
+			return errors.Wrapf(err, "running failed: %s", e.current().ptr)
+		}
+	}
+
+	return nil
+}
+
+// null pointer
+func (p pointer) null() bool {
+	return p.c == nil
+}
+
+// step into the content of the current pointer
+func (e *engine) step() error {
+	p := e.current().ptr
+
+	// enter the container at its start
+	for c, ok := p.resolve().(*container); ok; c, ok = p.resolve().(*container) {
+		e.visit(c, true)
+		if len(c.content) == 0 {
+			break
+		}
+		p = pointer{c: c, i: 0}
+	}
+	e.current().ptr = p
+
+	obj := p.resolve()
+	flow, err := e.perform(obj)
+	if err != nil {
+		return err
+	}
+
+	if e.current().ptr.null() {
+		return nil
+	}
+
+	if cp, ok := obj.(*choicePoint); ok {
+		if err := e.choice(cp); err != nil {
+			return err
+		}
+	} else if _, ok := obj.(*container); !ok && !flow {
+		e.push(obj)
+	}
+
+	if err := e.next(); err != nil {
+		return err
+	}
+
+	// the thread is started after the increment,
+	// so that it returns to the content after the command
+	if obj == command("thread") {
+		e.threads = append(e.threads, copyStack(e.stack()))
+	}
+
+	return nil
+}
+
+// push the object into evaluation stack or output stream
+func (e *engine) push(obj interface{}) {
+	if v, ok := obj.(value); ok {
+		if vp, ok := v.v.(varPointer); ok && vp.ci == -1 {
+			vp.ci = e.context(vp.name)
+			obj = value{vp}
+		}
+	}
+
+	if e.current().eval {
+		switch o := obj.(type) {
+		case value:
+			e.evals = append(e.evals, o.v)
+		case void:
+			e.evals = append(e.evals, o)
+		}
+		return
+	}
+
+	switch o := obj.(type) {
+	case value:
+		e.output = append(e.output, text(o.v))
+	case glue, tag:
+		e.output = append(e.output, o)
+	}
+}
+
+// text of the value
+func text(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case int:
+		return strconv.Itoa(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case DivertTarget:
+		return v.String()
+	case List:
+		return v.String()
+	case void:
+		return ""
+	}
+
+	return ""
+}
+
+// next content of the pointer, after diverting or incrementing
+func (e *engine) next() error {
+	e.previous = e.current().ptr
+
+	if e.diverted != nil {
+		e.current().ptr, e.diverted = *e.diverted, nil
+		e.visitChanged()
+		if !e.current().ptr.null() {
+			return nil
+		}
+	}
+
+	if e.increment() {
+		return nil
+	}
+
+	popped := false
+	st := e.stack()
+	if len(st) > 1 && e.current().kind == pushFunction {
+		if err := e.pop(pushFunction); err != nil {
+			return err
+		}
+		if e.current().eval {
+			e.evals = append(e.evals, void{})
+		}
+		popped = true
+	} else if len(e.threads) > 1 {
+		e.threads = e.threads[:len(e.threads)-1]
+		popped = true
+	}
+
+	if popped && !e.current().ptr.null() {
+		return e.next()
+	}
+	return nil
+}
+
+// increment the pointer, it goes out of the container at the end
+func (e *engine) increment() bool {
+	p := e.current().ptr
+	p.i++
+
+	for p.i >= len(p.c.content) {
+		parent := p.c.parent
+		if parent == nil {
+			e.current().ptr = pointer{}
+			return false
+		}
+
+		idx := -1
+		for i, o := range parent.content {
+			if o == p.c {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			e.current().ptr = pointer{}
+			return false
+		}
+
+		p = pointer{c: parent, i: idx + 1}
+	}
+
+	e.current().ptr = p
+	return true
+}
+
+// visit the container, and count it
+func (e *engine) visit(c *container, start bool) {
+	if c.flags&countStartOnly != 0 && !start {
+		return
+	}
+
+	if c.flags&countVisits != 0 {
+		e.story.visits[c.path]++
+	}
+	if c.flags&countTurns != 0 {
+		e.story.seen[c.path] = e.story.turns
+	}
+}
+
+// visitChanged containers, which are entered by the divert
+func (e *engine) visitChanged() {
+	p := e.current().ptr
+	if p.null() || p.i < 0 {
+		return
+	}
+
+	prev := make(map[*container]bool)
+	if !e.previous.null() {
+		c, ok := e.previous.resolve().(*container)
+		if !ok {
+			c = e.previous.c
+		}
+		for ; c != nil; c = c.parent {
+			prev[c] = true
+		}
+	}
+
+	child := p.resolve()
+	if child == nil {
+		return
+	}
+
+	var ancestor *container
+	if c, ok := child.(*container); ok {
+		ancestor = c.parent
+	} else {
+		ancestor = p.c
+	}
+
+	atStart := true
+	for ancestor != nil && (!prev[ancestor] || ancestor.flags&countStartOnly != 0) {
+		entering := len(ancestor.content) > 0 && ancestor.content[0] == child && atStart
+		if !entering {
+			atStart = false
+		}
+		e.visit(ancestor, entering)
+
+		child, ancestor = ancestor, ancestor.parent
+	}
+}
+
+// copyStack of the thread
+func copyStack(stack []*frame) []*frame {
+	st := make([]*frame, len(stack))
+	for i, f := range stack {
+		c := *f
+		c.temps = copy(f.temps)
+		st[i] = &c
+	}
+	return st
+}
+
+// pop the frame of the call stack
+func (e *engine) pop(kind FrameKind) error {
+	st := e.stack()
+	if len(st) <= 1 || st[len(st)-1].kind != kind {
+		return errors.New("mismatched return of the tunnel or function")
+	}
+
+	e.threads[len(e.threads)-1] = st[:len(st)-1]
+	return nil
+}
+
+// pop the value of the evaluation stack
+func (e *engine) popValue() (interface{}, error) {
+	if len(e.evals) == 0 {
+		return nil, errors.New("evaluation stack is empty")
+	}
+
+	v := e.evals[len(e.evals)-1]
+	e.evals = e.evals[:len(e.evals)-1]
+	return v, nil
+}
+
+// perform the logic and flow control of the object
+func (e *engine) perform(obj interface{}) (bool, error) {
+	switch o := obj.(type) {
+	case *jsonDivert:
+		return true, e.divert(o)
+	case command:
+		return true, e.command(o)
+	case *varAssign:
+		v, err := e.popValue()
+		if err != nil {
+			return true, err
+		}
+		return true, e.assign(o, v)
+	case *varRef:
+		if o.count != nil {
+			e.evals = append(e.evals, e.story.visits[o.count.path])
+			return true, nil
+		}
+
+		v, ok := e.variable(o.name, -1)
+		if !ok {
+			return true, errors.Errorf("variable is not declared: %s", o.name)
+		}
+		e.evals = append(e.evals, v)
+		return true, nil
+	case native:
+		return true, e.call(o)
+	}
+
+	return false, nil
+}
+
+// divert to the target
+func (e *engine) divert(d *jsonDivert) error {
+	if d.cond {
+		v, err := e.popValue()
+		if err != nil {
+			return err
+		}
+		if !truthy(v) {
+			return nil
+		}
+	}
+
+	target := d.target
+	switch {
+	case d.variable:
+		v, ok := e.variable(d.path, -1)
+		path, isPath := v.(DivertTarget)
+		if !ok || !isPath {
+			return errors.Errorf("variable is not a divert target: %s", d.path)
+		}
+
+		c, idx, err := e.content(e.root, string(path))
+		if err != nil {
+			return err
+		}
+		if idx < 0 {
+			idx = 0
+		}
+		target = pointer{c: c, i: idx}
+	case d.external:
+		return e.external(d)
+	}
+
+	if d.push {
+		st := e.stack()
+		f := &frame{ptr: e.current().ptr, kind: d.kind, temps: make(map[string]interface{})}
+		e.threads[len(e.threads)-1] = append(st, f)
+	}
+
+	e.diverted = &target
+	return nil
+}
+
+// external function, or the ink function with the same name
+func (e *engine) external(d *jsonDivert) error {
+	args := make([]interface{}, d.args)
+	for i := d.args - 1; i >= 0; i-- {
+		v, err := e.popValue()
+		if err != nil {
+			return err
+		}
+		args[i] = v
+	}
+
+	s := e.story
+	ex, ok := s.externals[d.path]
+	if ok && ex.fn.IsValid() {
+		v, err := s.external(ex, args)
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			v = void{}
+		}
+		e.evals = append(e.evals, v)
+		return nil
+	}
+
+	// the fallback function
+	c, ok := e.root.named[d.path]
+	if !ok {
+		return errors.Errorf("external is not bound: %s", d.path)
+	}
+
+	e.evals = append(e.evals, args...)
+	return e.divert(&jsonDivert{target: pointer{c: c, i: 0}, push: true, kind: pushFunction})
+}
+
+// command of the evaluation and flow
+func (e *engine) command(c command) error {
+	s := e.story
+	switch c {
+	case "ev":
+		e.current().eval = true
+	case "/ev":
+		e.current().eval = false
+	case "out":
+		if len(e.evals) > 0 {
+			v, _ := e.popValue()
+			if _, ok := v.(void); !ok {
+				e.output = append(e.output, text(v))
+			}
+		}
+	case "nop":
+	case "du":
+		if len(e.evals) == 0 {
+			return errors.New("evaluation stack is empty")
+		}
+		e.evals = append(e.evals, e.evals[len(e.evals)-1])
+	case "pop":
+		if _, err := e.popValue(); err != nil {
+			return err
+		}
+	case "~ret", "->->":
+		kind := pushFunction
+		var override interface{}
+		if c == "->->" {
+			kind = pushTunnel
+			v, err := e.popValue()
+			if err != nil {
+				return err
+			}
+			if _, ok := v.(void); !ok {
+				override = v
+			}
+		}
+
+		if err := e.pop(kind); err != nil {
+			return err
+		}
+
+		if path, ok := override.(DivertTarget); ok {
+			p, err := e.pointer(e.root, string(path))
+			if err != nil {
+				return err
+			}
+			e.diverted = &p
+		}
+	case "str":
+		e.output = append(e.output, beginString{})
+		e.current().eval = false
+	case "/str":
+		var parts []string
+		i := len(e.output) - 1
+		for ; i >= 0; i-- {
+			if _, ok := e.output[i].(beginString); ok {
+				break
+			}
+			if str, ok := e.output[i].(string); ok {
+				parts = append([]string{str}, parts...)
+			}
+		}
+		if i < 0 {
+			i = 0
+		}
+
+		e.output = e.output[:i]
+		e.current().eval = true
+		e.evals = append(e.evals, strings.Join(parts, ""))
+	case "#":
+		e.output = append(e.output, beginTag{})
+	case "/#":
+		var parts []string
+		i := len(e.output) - 1
+		for ; i >= 0; i-- {
+			if _, ok := e.output[i].(beginTag); ok {
+				break
+			}
+			if str, ok := e.output[i].(string); ok {
+				parts = append([]string{str}, parts...)
+			}
+		}
+		if i < 0 {
+			i = 0
+		}
+
+		e.output = append(e.output[:i], tag{text: strings.TrimSpace(strings.Join(parts, ""))})
+	case "choiceCnt":
+		e.evals = append(e.evals, len(e.choices))
+	case "turn":
+		e.evals = append(e.evals, s.turns)
+	case "turns", "readc":
+		v, err := e.popValue()
+		if err != nil {
+			return err
+		}
+
+		path, _ := v.(DivertTarget)
+		target, err := e.resolve(e.root, string(path))
+		if err != nil {
+			return err
+		}
+
+		if c == "readc" {
+			e.evals = append(e.evals, s.visits[target.path])
+		} else if turn, ok := s.seen[target.path]; ok {
+			e.evals = append(e.evals, s.turns-turn)
+		} else {
+			e.evals = append(e.evals, -1)
+		}
+	case "rnd":
+		max, err := e.popValue()
+		if err != nil {
+			return err
+		}
+		min, err := e.popValue()
+		if err != nil {
+			return err
+		}
+
+		v, err := s.random(min, max)
+		if err != nil {
+			return err
+		}
+		e.evals = append(e.evals, v)
+	case "srnd":
+		v, err := e.popValue()
+		if err != nil {
+			return err
+		}
+
+		if err := s.seedRandom(v); err != nil {
+			return err
+		}
+		e.evals = append(e.evals, void{})
+	case "visit":
+		e.evals = append(e.evals, s.visits[e.current().ptr.c.path]-1)
+	case "listInt":
+		n, err := e.popValue()
+		if err != nil {
+			return err
+		}
+		name, err := e.popValue()
+		if err != nil {
+			return err
+		}
+
+		v, err := intArg("listInt", n)
+		if err != nil {
+			return err
+		}
+		origin, _ := name.(string)
+		items, ok := s.lists[origin]
+		if !ok {
+			return errors.Errorf("can not find the list: %v", name)
+		}
+
+		var found []ListItem
+		for _, i := range items {
+			if i.Value == v {
+				found = append(found, i)
+			}
+		}
+		e.evals = append(e.evals, newList(found, origin))
+	case "range":
+		max, err := e.popValue()
+		if err != nil {
+			return err
+		}
+		min, err := e.popValue()
+		if err != nil {
+			return err
+		}
+		v, err := e.popValue()
+		if err != nil {
+			return err
+		}
+
+		l, ok := v.(List)
+		if !ok {
+			return errors.Errorf("LIST_RANGE needs list argument, but got: %v", v)
+		}
+		lo, err := bound(min, true)
+		if err != nil {
+			return err
+		}
+		hi, err := bound(max, false)
+		if err != nil {
+			return err
+		}
+		e.evals = append(e.evals, l.between(lo, hi))
+	case "lrnd":
+		v, err := e.popValue()
+		if err != nil {
+			return err
+		}
+
+		l, ok := v.(List)
+		if !ok {
+			return errors.Errorf("LIST_RANDOM needs list argument, but got: %v", v)
+		}
+		if len(l.Items) > 0 {
+			i := rand.New(s.rng).Intn(len(l.Items))
+			l = newList(l.Items[i:i+1], l.Origins...)
+		}
+		e.evals = append(e.evals, l)
+	case "seq":
+		n, err := e.popValue()
+		if err != nil {
+			return err
+		}
+		count, err := e.popValue()
+		if err != nil {
+			return err
+		}
+
+		c, err := intArg("seq", count)
+		if err != nil {
+			return err
+		}
+		size, err := intArg("seq", n)
+		if err != nil {
+			return err
+		}
+		e.evals = append(e.evals, e.shuffle(c, size))
+	case "thread":
+		// the thread is started after the increment
+	case "done":
+		if len(e.threads) > 1 {
+			e.threads = e.threads[:len(e.threads)-1]
+		} else {
+			e.current().ptr = pointer{}
+		}
+	case "end":
+		e.threads = [][]*frame{{{kind: pushTunnel, temps: make(map[string]interface{})}}}
+		e.choices = nil
+	default:
+		return errors.Errorf("unsupported command: %s", c)
+	}
+
+	return nil
+}
+
+// bound of the list's range, the list is its min or max item's value
+func bound(v interface{}, min bool) (int, error) {
+	l, ok := v.(List)
+	if !ok {
+		return intArg("LIST_RANGE", v)
+	}
+
+	if len(l.Items) == 0 {
+		return 0, nil
+	} else if min {
+		return l.Items[0].Value, nil
+	}
+	return l.value(), nil
+}
+
+// shuffle index of the sequence, each loop has its own order
+func (e *engine) shuffle(count, n int) int {
+	if n <= 0 {
+		return 0
+	}
+
+	hash := 0
+	for _, r := range e.current().ptr.c.path {
+		hash += int(r)
+	}
+
+	loop, iteration := count/n, count%n
+	r := rand.New(rand.NewSource(int64(hash+loop) + e.story.rng.seed))
+	return r.Perm(n)[iteration]
+}
+
+// choice of the choice point, which is generated if it is shown
+func (e *engine) choice(cp *choicePoint) error {
+	show := true
+	if cp.flags&choiceCondition != 0 {
+		v, err := e.popValue()
+		if err != nil {
+			return err
+		}
+		show = truthy(v)
+	}
+
+	var start, only string
+	if cp.flags&choiceOnlyContent != 0 {
+		v, err := e.popValue()
+		if err != nil {
+			return err
+		}
+		only = text(v)
+	}
+	if cp.flags&choiceStartContent != 0 {
+		v, err := e.popValue()
+		if err != nil {
+			return err
+		}
+		start = text(v)
+	}
+
+	if cp.flags&choiceOnceOnly != 0 && e.story.visits[cp.path] > 0 {
+		show = false
+	}
+
+	if show {
+		c := &Choice{
+			Text:      strings.Trim(start+only, " \t"),
+			Path:      cp.path,
+			Stack:     framesOf(e.stack()),
+			invisible: cp.flags&choiceInvisible != 0,
+		}
+		e.choices = append(e.choices, c)
+	}
+
+	return nil
+}
+
+// context index of the variable: 0 is global, others are the frame index plus 1
+func (e *engine) context(name string) int {
+	if _, ok := e.current().temps[name]; ok {
+		return len(e.stack())
+	}
+	return 0
+}
+
+// variable of the name, the pointer is dereferenced
+func (e *engine) variable(name string, ci int) (interface{}, bool) {
+	v, ok := e.raw(name, ci)
+	if vp, isPointer := v.(varPointer); ok && isPointer {
+		return e.variable(vp.name, vp.ci)
+	}
+	return v, ok
+}
+
+// raw value of the variable in the context
+func (e *engine) raw(name string, ci int) (interface{}, bool) {
+	if ci == 0 || ci == -1 {
+		if v, ok := e.story.vars[name]; ok {
+			return v, true
+		}
+	}
+
+	if ci == -1 {
+		ci = len(e.stack())
+	}
+	if ci <= 0 || ci > len(e.stack()) {
+		return nil, false
+	}
+
+	v, ok := e.stack()[ci-1].temps[name]
+	return v, ok
+}
+
+// assign the value to the variable
+func (e *engine) assign(a *varAssign, v interface{}) error {
+	name, ci := a.name, -1
+	global := a.global
+
+	if a.decl {
+		if vp, ok := v.(varPointer); ok {
+			// the pointer to pointer is resolved
+			if inner, ok := e.raw(vp.name, vp.ci); ok {
+				if ip, ok := inner.(varPointer); ok {
+					v = ip
+				}
+			}
+		}
+	} else {
+		_, global = e.story.vars[name]
+		for {
+			raw, ok := e.raw(name, ci)
+			vp, isPointer := raw.(varPointer)
+			if !ok || !isPointer {
+				break
+			}
+			name, ci = vp.name, vp.ci
+			global = ci == 0
+		}
+	}
+
+	if global {
+		e.story.set(name, v)
+		return nil
+	}
+
+	if ci == -1 {
+		ci = len(e.stack())
+	}
+	if ci <= 0 || ci > len(e.stack()) {
+		return errors.Errorf("can not find the variable: %s", name)
+	}
+
+	temps := e.stack()[ci-1].temps
+	if _, ok := temps[name]; !ok && !a.decl {
+		return errors.Errorf("can not find the temporary variable: %s", name)
+	}
+
+	temps[name] = v
+	return nil
+}
+
+// truthy of the value
+func truthy(v interface{}) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case int:
+		return v != 0
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	case List:
+		return len(v.Items) > 0
+	}
+
+	return false
+}
+
+// call the native function with the values on the evaluation stack
+func (e *engine) call(fn native) error {
+	n := natives[string(fn)]
+	args := make([]interface{}, n)
+	for i := n - 1; i >= 0; i-- {
+		v, err := e.popValue()
+		if err != nil {
+			return err
+		}
+		if _, ok := v.(void); ok {
+			return errors.Errorf("void can not be used in %s", fn)
+		}
+		args[i] = v
+	}
+
+	v, err := e.operate(string(fn), args)
+	if err != nil {
+		return err
+	}
+
+	e.evals = append(e.evals, v)
+	return nil
+}
+
+// operate the native function, the lists are operated as the parsed story,
+// and they are the values of their max items with other types
+func (e *engine) operate(op string, args []interface{}) (interface{}, error) {
+	s := e.story
+	if strings.HasPrefix(op, "LIST_") {
+		l, err := lists(op, args[0])
+		if err != nil {
+			return nil, err
+		}
+		return s.listFunc(op, l[0]), nil
+	}
+
+	if len(args) != 2 {
+		return operate(op, args)
+	}
+
+	a, la := args[0].(List)
+	b, lb := args[1].(List)
+	switch {
+	case la && lb:
+		switch op {
+		case "+":
+			return a.union(b), nil
+		case "-":
+			return a.without(b), nil
+		case "?", "!?":
+			return a.contains(b) == (op == "?"), nil
+		case "L^":
+			return a.intersect(b), nil
+		case "==", "!=":
+			return a.equal(b) == (op == "=="), nil
+		case ">", ">=", "<", "<=":
+			return a.compare(op, b), nil
+		}
+		return nil, errors.Errorf("%s can not be applied to the lists", op)
+	case la:
+		if n, ok := args[1].(int); ok && (op == "+" || op == "-") {
+			if op == "-" {
+				n = -n
+			}
+			return s.shift(a, n), nil
+		}
+		args = []interface{}{a.value(), args[1]}
+	case lb:
+		args = []interface{}{args[0], b.value()}
+	}
+
+	return operate(op, args)
+}
+
+// operate the native function
+func operate(op string, args []interface{}) (interface{}, error) {
+	if len(args) == 1 {
+		a := args[0]
+		switch op {
+		case "!":
+			return !truthy(a), nil
+		case "_":
+			if f, ok := a.(float64); ok {
+				return -f, nil
+			}
+			return -numberOf(a), nil
+		case "FLOOR", "CEILING":
+			if i, ok := a.(int); ok {
+				return i, nil
+			}
+			if op == "FLOOR" {
+				return math.Floor(floatOf(a)), nil
+			}
+			return math.Ceil(floatOf(a)), nil
+		case "INT":
+			return int(floatOf(a)), nil
+		case "FLOAT":
+			return floatOf(a), nil
+		}
+	}
+
+	a, b := args[0], args[1]
+	switch op {
+	case "&&":
+		return truthy(a) && truthy(b), nil
+	case "||":
+		return truthy(a) || truthy(b), nil
+	case "?", "!?":
+		sa, ok1 := a.(string)
+		sb, ok2 := b.(string)
+		if !ok1 || !ok2 {
+			return nil, errors.Errorf("%s needs string arguments", op)
+		}
+		return strings.Contains(sa, sb) == (op == "?"), nil
+	case "==", "!=":
+		eq := reflect.DeepEqual(a, b)
+		if isNumber(a) && isNumber(b) {
+			eq = floatOf(a) == floatOf(b)
+		}
+		return eq == (op == "=="), nil
+	}
+
+	// strings are joined
+	if _, ok := a.(string); ok && op == "+" {
+		return a.(string) + text(b), nil
+	}
+
+	if !isNumber(a) || !isNumber(b) {
+		return nil, errors.Errorf("%s can not be applied to: %v, %v", op, a, b)
+	}
+
+	_, fa := a.(float64)
+	_, fb := b.(float64)
+	if fa || fb {
+		x, y := floatOf(a), floatOf(b)
+		switch op {
+		case "+":
+			return x + y, nil
+		case "-":
+			return x - y, nil
+		case "*":
+			return x * y, nil
+		case "/", "%":
+			if y == 0 {
+				return nil, errors.New("divided by zero")
+			}
+			if op == "/" {
+				return x / y, nil
+			}
+			return math.Mod(x, y), nil
+		}
+	} else {
+		x, y := numberOf(a), numberOf(b)
+		switch op {
+		case "+":
+			return x + y, nil
+		case "-":
+			return x - y, nil
+		case "*":
+			return x * y, nil
+		case "/", "%":
+			if y == 0 {
+				return nil, errors.New("divided by zero")
+			}
+			if op == "/" {
+				return x / y, nil
+			}
+			return x % y, nil
+		}
+	}
+
+	x, y := floatOf(a), floatOf(b)
+	switch op {
+	case ">":
+		return x > y, nil
+	case "<":
+		return x < y, nil
+	case ">=":
+		return x >= y, nil
+	case "<=":
+		return x <= y, nil
+	case "POW":
+		return math.Pow(x, y), nil
+	case "MIN", "MAX":
+		if (x < y) == (op == "MIN") {
+			return a, nil
+		}
+		return b, nil
+	}
+
+	return nil, errors.Errorf("unsupported function: %s", op)
+}
+
+// isNumber of the value, bool is treated as number
+func isNumber(v interface{}) bool {
+	switch v.(type) {
+	case int, float64, bool:
+		return true
+	}
+	return false
+}
+
+// numberOf the int or bool value
+func numberOf(v interface{}) int {
+	switch v := v.(type) {
+	case int:
+		return v
+	case float64:
+		return int(v)
+	case bool:
+		if v {
+			return 1
+		}
+	}
+	return 0
+}
+
+// floatOf the number value
+func floatOf(v interface{}) float64 {
+	if f, ok := v.(float64); ok {
+		return f
+	}
+	return float64(numberOf(v))
+}
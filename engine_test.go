@@ -0,0 +1,150 @@
+package goink
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// simplified json compiled from:
+//
+//	<- extras
+//	~ temp x = add(1, 2)
+//	Sum {x}.
+//	-> tunnel ->
+//	Back.
+//	* Stay
+//	  Stayed.
+//	  -> END
+//	== extras
+//	* Extra
+//	  Extra picked.
+//	  -> END
+//	- -> DONE
+//	== tunnel
+//	In tunnel.
+//	->->
+//	== function add(a, b)
+//	~ return a + b
+const flowJSON = `{"inkVersion":21,"root":[["thread",{"->":"extras"},
+"ev",1,2,{"f()":"add"},"/ev",{"temp=":"x"},
+"^Sum ","ev",{"VAR?":"x"},"out","/ev","^.","\n",
+{"->t->":"tunnel"},"^Back.","\n",
+"ev","str","^Stay","/str","/ev",{"*":".^.c-0","flg":20},
+{"c-0":["^Stay","\n","^Stayed.","\n","end",{"#f":5}]}],"done",{
+"extras":["ev","str","^Extra","/str","/ev",{"*":".^.c-0","flg":20},"done",{"c-0":["^Extra","\n","^Extra picked.","\n","end",{"#f":5}]}],
+"tunnel":["^In tunnel.","\n","ev","void","/ev","->->",null],
+"add":[{"temp=":"b"},{"temp=":"a"},"ev",{"VAR?":"a"},{"VAR?":"b"},"+","/ev","~ret",null]}],"listDefs":{}}`
+
+func TestEngineFlow(t *testing.T) {
+	story, err := LoadJSON([]byte(flowJSON))
+	assert.Nil(t, err)
+
+	ctx := NewContext()
+	sec, e := story.Resume(ctx)
+	assert.Nil(t, e)
+	assert.Equal(t, "Sum 3.\nIn tunnel.\nBack.", sec.Text)
+	assert.Equal(t, []string{"Extra", "Stay"}, sec.Opts)
+
+	extra := *ctx
+	sec, e = story.Pick(&extra, 0)
+	assert.Nil(t, e)
+	assert.Equal(t, "Extra\nExtra picked.", sec.Text)
+	assert.True(t, sec.End)
+
+	sec, e = story.Pick(ctx, 1)
+	assert.Nil(t, e)
+	assert.Equal(t, "Stay\nStayed.", sec.Text)
+	assert.True(t, sec.End)
+}
+
+// the fixtures in testdata are written by hand in the format of inklecate,
+// each one is compiled from the ink file with the same name
+func loadFixture(t *testing.T, name string) *Story {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name+".ink.json"))
+	assert.Nil(t, err)
+
+	story, err := LoadJSON(data)
+	assert.Nil(t, err)
+	return story
+}
+
+func TestEngineFixtureFlow(t *testing.T) {
+	story := loadFixture(t, "flow")
+
+	ctx := NewContext()
+	sec, e := story.Resume(ctx)
+	assert.Nil(t, e)
+	assert.Equal(t, "You are in town.", sec.Text)
+	assert.Equal(t, []string{"Listen", "Visit the smith", "Leave"}, sec.Opts)
+	assert.False(t, ctx.End)
+	start := *ctx
+
+	// the choice of the thread
+	listen := *ctx
+	sec, e = story.Pick(&listen, 0)
+	assert.Nil(t, e)
+	assert.Equal(t, "You hear a rumour.", sec.Text)
+	assert.True(t, sec.End)
+	assert.True(t, listen.End)
+
+	// the tunnel calls the function, and the knot is counted twice
+	sec, e = story.Pick(ctx, 1)
+	assert.Nil(t, e)
+	assert.Equal(t, "The smith nods 2 times.\nBack in town.\nYou are in town. Again.", sec.Text)
+	assert.Equal(t, []string{"Listen", "Leave"}, sec.Opts)
+	assert.Equal(t, 2, ctx.Vars["met"])
+	assert.Equal(t, 1, ctx.Visits["town.0.c-0"])
+
+	sec, e = story.Pick(ctx, 1)
+	assert.Nil(t, e)
+	assert.Equal(t, "You leave after 2 visits.", sec.Text)
+	assert.True(t, ctx.End)
+	assert.Equal(t, 2, ctx.Visits["town"])
+
+	// the context of the failed pick is untouched
+	failed := start
+	failed.Vars = map[string]interface{}{"met": "many"}
+	_, e = story.Pick(&failed, 1)
+	assert.Contains(t, e.Error(), "can not be applied to")
+	assert.Equal(t, map[string]interface{}{"met": "many"}, failed.Vars)
+	assert.Equal(t, start.Visits, failed.Visits)
+	assert.Equal(t, start.Choices, failed.Choices)
+}
+
+func TestEngineFixtureLists(t *testing.T) {
+	story := loadFixture(t, "lists")
+	assert.Equal(t, []ListItem{{"mood", "sad", 1}, {"mood", "neutral", 2}, {"mood", "happy", 3}}, story.lists["mood"])
+
+	ctx := NewContext()
+	sec, e := story.Resume(ctx)
+	assert.Nil(t, e)
+	assert.Equal(t, "Mood happy, 3. Cheerful.\nTools hammer, saw: 2, hammer, saw.\nHas saw. sad, neutral\nAll sad, neutral, happy, sad, saw.\nLeft hammer true hammer", sec.Text)
+	assert.Equal(t, newList([]ListItem{{"tools", "hammer", 2}}, "tools"), ctx.Vars["items"])
+
+	// the lists are decoded from json
+	data, err := json.Marshal(ctx)
+	assert.Nil(t, err)
+	loaded := &Context{}
+	assert.Nil(t, json.Unmarshal(data, loaded))
+	loaded.End = false
+
+	sec, e = story.Resume(loaded)
+	assert.Nil(t, e)
+	assert.Equal(t, newList([]ListItem{{"mood", "happy", 3}}, "mood"), story.vars["mood"])
+}
+
+func TestEngineDivideByZero(t *testing.T) {
+	for _, op := range []string{`1,0,"/"`, `1,0,"%"`, `1.5,0,"/"`, `1.5,0.0,"%"`} {
+		story, err := LoadJSON([]byte(`{"inkVersion":21,"root":[["ev",` + op + `,"out","/ev","\n","end",null],"done",null]}`))
+		assert.Nil(t, err)
+
+		_, err = story.Resume(NewContext())
+		if assert.NotNil(t, err, op) {
+			assert.Contains(t, err.Error(), "divided by zero", op)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package goink
+
+import (
+	"strings"
+)
+
+// the characters which could be escaped by backslash: \# \/ \[ ...
+const escapable = `#/\[]{}()<>|~*+-=:`
+
+// the escaped characters are kept in the private use area of unicode,
+// so that they are never matched by the parsers
+const escapeBase = 0xE000
+
+// escape the backslashed characters of the raw input
+func escape(input string) string {
+	if !strings.Contains(input, `\`) {
+		return input
+	}
+
+	var out strings.Builder
+	for i := 0; i < len(input); i++ {
+		if input[i] == '\\' && i+1 < len(input) && strings.IndexByte(escapable, input[i+1]) >= 0 {
+			out.WriteRune(rune(escapeBase + int(input[i+1])))
+			i++
+			continue
+		}
+		out.WriteByte(input[i])
+	}
+
+	return out.String()
+}
+
+// unescape the escaped characters into plain ones
+func unescape(text string) string {
+	return strings.Map(func(r rune) rune {
+		if r > escapeBase && r < escapeBase+0x80 {
+			return r - escapeBase
+		}
+		return r
+	}, text)
+}
+
+// unescape the rendered text, tags and options of the section
+func (s *Section) unescape() {
+	s.Text = unescape(s.Text)
+	for i, t := range s.Tags {
+		s.Tags[i] = unescape(t)
+	}
+
+	for i, o := range s.Opts {
+		s.Opts[i] = unescape(o)
+	}
+	for _, tags := range s.OptsTags {
+		for i, t := range tags {
+			tags[i] = unescape(t)
+		}
+	}
+}
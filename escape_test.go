@@ -0,0 +1,74 @@
+package goink
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEscapes(t *testing.T) {
+	input := `
+	Visit https:\/\/ink.example.com \# not a tag#tag // comment
+	Press \[A\] to \{jump\} \-> go. \<\>
+	Glued.
+	* Pick \[1\] or \#2 [\[ok\]] done
+	  -> END
+	`
+
+	story := Default()
+	err := story.Parse(input)
+	assert.Nil(t, err)
+	assert.Nil(t, story.PostParsing())
+
+	ctx := NewContext()
+	sec, err := story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "Visit https://ink.example.com # not a tag\nPress [A] to {jump} -> go. <>\nGlued.", sec.Text)
+	assert.Contains(t, sec.Tags, "tag")
+	assert.Equal(t, []string{"Pick [1] or #2 [ok]"}, sec.Opts)
+
+	sec, err = story.Pick(ctx, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "Pick [1] or #2  done", sec.Text)
+
+	assert.Equal(t, `a\b`, unescape(escape(`a\\b`)))
+	assert.Equal(t, `\n`, unescape(escape(`\n`)))
+}
+
+func TestEscapedStrings(t *testing.T) {
+	input := `
+	EXTERNAL say(text)
+	VAR door = "\{open\}"
+	CONST KEY = "a\|b"
+	~ door = door + " \[now\]"
+	~ say("\#1 {KEY}")
+	{door == "\{open\} \[now\]": Same.}
+	-> END
+	`
+
+	story := Default()
+	assert.Nil(t, story.Parse(input))
+	assert.Nil(t, story.PostParsing())
+
+	// the escaped characters are plain in the values
+	assert.Equal(t, "{open}", story.vars["door"])
+	assert.Equal(t, "a|b", story.consts["KEY"])
+
+	var said []interface{}
+	assert.Nil(t, story.BindExternal("say", func(text interface{}) {
+		said = append(said, text)
+	}))
+
+	var doors []interface{}
+	assert.Nil(t, story.ObserveVariable("door", func(name string, old, new interface{}) {
+		doors = append(doors, new)
+	}))
+
+	ctx := NewContext()
+	sec, err := story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "Same.", sec.Text)
+	assert.Equal(t, "{open} [now]", ctx.Vars["door"])
+	assert.Equal(t, []interface{}{"{open} [now]"}, doors)
+	assert.Equal(t, []interface{}{"#1 {KEY}"}, said)
+}
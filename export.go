@@ -0,0 +1,936 @@
+package goink
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/antonmedv/expr/ast"
+	"github.com/antonmedv/expr/parser"
+	"github.com/pkg/errors"
+)
+
+// operators of the expressions, and the natives of ink
+var binaryOps = map[string]string{
+	"+": "+", "-": "-", "*": "*", "/": "/", "%": "%", "**": "POW",
+	"==": "==", "!=": "!=", "<": "<", ">": ">", "<=": "<=", ">=": ">=",
+	"and": "&&", "&&": "&&", "or": "||", "||": "||",
+}
+
+// ExportJSON exports the parsed story as the runtime json of ink,
+// which can be loaded by inkjs, ink-unity or LoadJSON
+func (s *Story) ExportJSON() ([]byte, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.engine != nil {
+		return nil, errors.New("can not export the compiled story")
+	}
+
+	x := &exporter{story: s, paths: make(map[Node]string), containers: make(map[Node]*inkContainer)}
+	root, err := x.export()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+
+	defs := make(map[string]interface{})
+	for name, items := range s.lists {
+		def := make(map[string]interface{})
+		for _, i := range items {
+			def[i.Name] = i.Value
+		}
+		defs[name] = def
+	}
+
+	doc := map[string]interface{}{"inkVersion": maxInkVersion, "root": root.json(), "listDefs": defs}
+	if err := enc.Encode(doc); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSpace(buf.Bytes()), nil
+}
+
+// inkContainer of the exported json, the jumps to its labels
+// are resolved as the relative paths of the content
+type inkContainer struct {
+	content []interface{}
+	named   map[string]*inkContainer
+	flags   int
+
+	labels []int
+	jumps  []jump
+}
+
+// jump of the divert to the label
+type jump struct {
+	divert map[string]interface{}
+	label  int
+}
+
+// add the objects to the content
+func (c *inkContainer) add(objs ...interface{}) {
+	c.content = append(c.content, objs...)
+}
+
+// label which is marked later
+func (c *inkContainer) label() int {
+	c.labels = append(c.labels, -1)
+	return len(c.labels) - 1
+}
+
+// mark the label at the end of the content
+func (c *inkContainer) mark(label int) {
+	c.labels[label] = len(c.content)
+}
+
+// jump to the label, it is taken only if the popped value is true when cond
+func (c *inkContainer) jump(label int, cond bool) {
+	d := map[string]interface{}{}
+	if cond {
+		d["c"] = true
+	}
+
+	c.jumps = append(c.jumps, jump{divert: d, label: label})
+	c.add(d)
+}
+
+// json array of the container
+func (c *inkContainer) json() []interface{} {
+	for _, j := range c.jumps {
+		j.divert["->"] = ".^." + strconv.Itoa(c.labels[j.label])
+	}
+
+	arr := make([]interface{}, 0, len(c.content)+1)
+	for _, obj := range c.content {
+		if sub, ok := obj.(*inkContainer); ok {
+			obj = sub.json()
+		}
+		arr = append(arr, obj)
+	}
+
+	if len(c.named) == 0 && c.flags == 0 {
+		return append(arr, nil)
+	}
+
+	extra := make(map[string]interface{}, len(c.named)+1)
+	for k, sub := range c.named {
+		extra[k] = sub.json()
+	}
+	if c.flags != 0 {
+		extra["#f"] = c.flags
+	}
+
+	return append(arr, extra)
+}
+
+// inkFloat keeps the decimal point, so that it is not loaded as an integer
+type inkFloat float64
+
+// MarshalJSON of the float
+func (f inkFloat) MarshalJSON() ([]byte, error) {
+	str := strconv.FormatFloat(float64(f), 'f', -1, 64)
+	if !strings.Contains(str, ".") {
+		str += ".0"
+	}
+	return []byte(str), nil
+}
+
+// exporter of the story, every node is a named container,
+// which is in the container of its knot or stitch
+type exporter struct {
+	story      *Story
+	paths      map[Node]string // ink paths of the nodes
+	containers map[Node]*inkContainer
+}
+
+// export the root container of the story
+func (x *exporter) export() (*inkContainer, error) {
+	s := x.story
+	root := &inkContainer{named: make(map[string]*inkContainer)}
+
+	nodes := x.nodes()
+	for _, n := range nodes {
+		if err := x.place(root, n); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, n := range nodes {
+		if err := x.compile(n); err != nil {
+			return nil, errors.Wrapf(err, "can not export %s", n.Path())
+		}
+	}
+
+	main := &inkContainer{}
+	if err := x.divert(main, s.start.(*start).next); err != nil {
+		return nil, err
+	}
+	root.add(main, "done")
+
+	decl, err := x.declare()
+	if err != nil {
+		return nil, err
+	}
+	if decl != nil {
+		root.named["global decl"] = decl
+	}
+
+	return root, nil
+}
+
+// nodes of the story, the knots and stitches go first,
+// so that the containers of other nodes are placed
+func (x *exporter) nodes() (nodes []Node) {
+	set := make(map[Node]bool)
+	for _, n := range x.story.paths {
+		switch n := n.(type) {
+		case *start, *end, *done:
+			continue
+		case *knot:
+			if n.function {
+				set[n.ret] = true
+			}
+		}
+		set[n] = true
+	}
+
+	rank := func(n Node) int {
+		switch n.(type) {
+		case *knot:
+			return 0
+		case *stitch:
+			return 1
+		}
+		return 2
+	}
+
+	for n := range set {
+		nodes = append(nodes, n)
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		if ri, rj := rank(nodes[i]), rank(nodes[j]); ri != rj {
+			return ri < rj
+		}
+		return nodes[i].Path() < nodes[j].Path()
+	})
+
+	return
+}
+
+// place the container of the node, the labels keep their names,
+// so that they are found as knot.label or knot.stitch.label
+func (x *exporter) place(root *inkContainer, node Node) error {
+	c := &inkContainer{named: make(map[string]*inkContainer)}
+	parent, prefix, name := root, "", node.Path()
+
+	switch n := node.(type) {
+	case *knot:
+		c.flags = countVisits | countTurns | countStartOnly
+	case *stitch:
+		c.flags = countVisits | countTurns | countStartOnly
+		parent, prefix, name = x.containers[n.knot], x.paths[n.knot], n.name
+	default:
+		if kn, st := x.story.container(node); st != nil {
+			parent, prefix = x.containers[st], x.paths[st]
+			name = strings.TrimPrefix(name, st.Path()+PathSplit)
+		} else if kn != nil {
+			parent, prefix = x.containers[kn], x.paths[kn]
+			name = strings.TrimPrefix(name, kn.Path()+PathSplit)
+		}
+		name = strings.ReplaceAll(name, PathSplit, "-")
+
+		if l := lineOf(node); l != nil && l.labelled {
+			c.flags = countVisits | countTurns
+		} else if _, ok := node.(*opt); ok {
+			c.flags = countVisits | countTurns
+		}
+	}
+
+	if _, ok := parent.named[name]; ok {
+		return errors.Errorf("conflict name of the exported content: %s", node.Path())
+	}
+	parent.named[name] = c
+
+	if prefix != "" {
+		name = prefix + "." + name
+	}
+	x.paths[node], x.containers[node] = name, c
+
+	return nil
+}
+
+// declare the global variables with their default values
+func (x *exporter) declare() (*inkContainer, error) {
+	s := x.story
+	if len(s.defaults) == 0 {
+		return nil, nil
+	}
+
+	var names []string
+	for name := range s.defaults {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	c := &inkContainer{}
+	c.add("ev")
+	for _, name := range names {
+		obj, err := x.value(s.defaults[name], nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "can not export variable %s", name)
+		}
+		c.add(obj, map[string]interface{}{"VAR=": name})
+	}
+	c.add("/ev", "end")
+
+	return c, nil
+}
+
+// value of ink
+func (x *exporter) value(v interface{}, from Node) (interface{}, error) {
+	switch v := v.(type) {
+	case int, bool:
+		return v, nil
+	case float64:
+		return inkFloat(v), nil
+	case string:
+		return "^" + unescape(v), nil
+	case List:
+		items := make(map[string]interface{})
+		for _, i := range v.Items {
+			items[i.Origin+"."+i.Name] = i.Value
+		}
+
+		// the origins are kept by the empty list
+		if len(items) == 0 && len(v.Origins) > 0 {
+			return map[string]interface{}{"list": items, "origins": v.Origins}, nil
+		}
+		return map[string]interface{}{"list": items}, nil
+	case DivertTarget:
+		target := x.story.divert(string(v), from)
+		if _, ok := x.paths[target]; !ok {
+			return nil, errors.Errorf("can not find the divert: %s", v)
+		}
+		return map[string]interface{}{"^->": x.paths[target]}, nil
+	}
+
+	return nil, errors.Errorf("value is not supported: %v", v)
+}
+
+// divert to the node, the end and done are the commands
+func (x *exporter) divert(c *inkContainer, to Node) error {
+	switch to.(type) {
+	case *end:
+		c.add("end")
+		return nil
+	case *done:
+		c.add("done")
+		return nil
+	}
+
+	path, ok := x.paths[to]
+	if !ok {
+		return errors.New("can not find the divert")
+	}
+
+	c.add(map[string]interface{}{"->": path})
+	return nil
+}
+
+// next node of the flow, which is known when parsing
+func (x *exporter) next(node Node) (Node, error) {
+	var next Node
+	switch n := node.(type) {
+	case *line:
+		next = n.next
+	case *gather:
+		next = n.next
+	case *opt:
+		next = n.next
+	case *logic:
+		next = n.next
+	case *thread:
+		next = n.next
+	case *branch:
+		if n.next == nil {
+			return n.block.following()
+		}
+		next = n.next
+	}
+
+	if next != nil {
+		return next, nil
+	}
+
+	return following(node)
+}
+
+// compile the node into its container
+func (x *exporter) compile(node Node) error {
+	c := x.containers[node]
+
+	switch n := node.(type) {
+	case *knot:
+		x.params(c, n.params)
+		x.tags(c, n.tags)
+
+		next := n.next
+		if n.function && next == nil {
+			next = n.ret
+		}
+		return x.divert(c, next)
+	case *stitch:
+		x.params(c, n.params)
+		x.tags(c, n.tags)
+		return x.divert(c, n.next)
+	case *line:
+		return x.line(c, n, n.content, node)
+	case *gather:
+		return x.line(c, n.line, n.content, node)
+	case *opt:
+		return x.line(c, n.line, append(append(content{}, n.before...), n.after...), node)
+	case *logic:
+		return x.logic(c, n)
+	case *options:
+		return x.options(c, n)
+	case *thread:
+		target, err := n.resolve()
+		if err != nil {
+			return err
+		}
+
+		c.add("thread")
+		if err := x.divert(c, target); err != nil {
+			return err
+		}
+	case *block:
+		for _, br := range n.branches {
+			if br.condition == nil {
+				return x.divert(c, br)
+			}
+
+			tokens, err := x.expr(br.condition, n)
+			if err != nil {
+				return err
+			}
+			c.add("ev")
+			c.add(tokens...)
+			c.add("/ev", map[string]interface{}{"->": x.paths[br], "c": true})
+		}
+
+		next, err := n.following()
+		if err != nil {
+			return err
+		}
+		return x.divert(c, next)
+	case *branch:
+	default:
+		return errors.Errorf("content can not be exported: %T", node)
+	}
+
+	next, err := x.next(node)
+	if err != nil {
+		return err
+	}
+	return x.divert(c, next)
+}
+
+// params of the knot, which are popped from the evaluation stack
+func (x *exporter) params(c *inkContainer, params []param) {
+	for i := len(params) - 1; i >= 0; i-- {
+		c.add(map[string]interface{}{"temp=": params[i].name})
+	}
+}
+
+// tags of the content
+func (x *exporter) tags(c *inkContainer, tags []string) {
+	for _, t := range tags {
+		c.add("#", "^"+unescape(t), "/#")
+	}
+}
+
+// line with its leading conditions, the content and diverts
+// are skipped when any of the conditions is false
+func (x *exporter) line(c *inkContainer, l *line, text content, node Node) error {
+	skip := -1
+	for _, seg := range l.content[:l.conds] {
+		in, ok := seg.(*inline)
+		if !ok {
+			continue
+		}
+
+		tokens, err := x.expr(in.exprc, node)
+		if err != nil {
+			return err
+		}
+
+		if skip < 0 {
+			skip = c.label()
+		}
+		c.add("ev")
+		c.add(tokens...)
+		c.add("!", "/ev")
+		c.jump(skip, true)
+
+		text = l.content[l.conds:]
+	}
+
+	if err := x.glued(c, text, node); err != nil {
+		return err
+	}
+	x.tags(c, l.tags)
+	if len(text) > 0 {
+		c.add("\n")
+	}
+
+	for _, d := range l.tunnels {
+		if err := x.dest(c, l, d, "->t->"); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case l.back:
+		c.add("ev")
+		if l.divert != nil {
+			v, err := x.value(DivertTarget(l.divert.path), l)
+			if err != nil {
+				return err
+			}
+			c.add(v)
+		} else {
+			c.add("void")
+		}
+		c.add("/ev", "->->")
+	case l.divert != nil:
+		if err := x.dest(c, l, l.divert, "->"); err != nil {
+			return err
+		}
+	}
+
+	if skip < 0 && (l.back || l.divert != nil) {
+		return nil
+	}
+
+	if skip >= 0 {
+		c.mark(skip)
+	}
+
+	next, err := x.next(node)
+	if err != nil {
+		// the hidden line at the end of flow
+		if l.back || l.divert != nil {
+			c.add("done")
+			return nil
+		}
+		return err
+	}
+	return x.divert(c, next)
+}
+
+// dest of the divert or tunnel, the arguments are pushed before diverting
+func (x *exporter) dest(c *inkContainer, l *line, d *dest, kind string) error {
+	target := x.story.divert(d.path, l)
+	if target == nil {
+		// the divert target held by the variable
+		c.add(map[string]interface{}{kind: d.name, "var": true})
+		return nil
+	}
+
+	if len(d.args) > 0 {
+		params := paramsOf(target)
+		c.add("ev")
+		for i, a := range d.args {
+			if params[i].ref {
+				c.add(map[string]interface{}{"^var": strings.TrimSpace(a.raw), "ci": -1})
+				continue
+			}
+
+			tokens, err := x.expr(a, l)
+			if err != nil {
+				return err
+			}
+			c.add(tokens...)
+		}
+		c.add("/ev")
+	}
+
+	if kind == "->" {
+		return x.divert(c, target)
+	}
+
+	path, ok := x.paths[target]
+	if !ok {
+		return errors.Errorf("can not tunnel to: %s", d.path)
+	}
+	c.add(map[string]interface{}{kind: path})
+	return nil
+}
+
+// logic line, the temporary variable is declared or assigned
+func (x *exporter) logic(c *inkContainer, l *logic) error {
+	c.add("ev")
+	if l.value == nil {
+		c.add("void")
+	} else {
+		tokens, err := x.expr(l.value, l)
+		if err != nil {
+			return err
+		}
+		c.add(tokens...)
+	}
+
+	switch {
+	case l.ret:
+		c.add("/ev", "~ret")
+		return nil
+	case l.name == "":
+		c.add("pop")
+	case l.temp:
+		c.add(map[string]interface{}{"temp=": l.name})
+	case x.story.local(l.name, l):
+		c.add(map[string]interface{}{"temp=": l.name, "re": true})
+	default:
+		c.add(map[string]interface{}{"VAR=": l.name, "re": true})
+	}
+	c.add("/ev")
+
+	next, err := x.next(l)
+	if err != nil {
+		return err
+	}
+	return x.divert(c, next)
+}
+
+// options are the choice points, the fallback is the invisible one
+func (x *exporter) options(c *inkContainer, opts *options) error {
+	for _, o := range opts.opts {
+		flags := 0
+		c.add("ev")
+
+		if o.fallback {
+			flags |= choiceInvisible
+		} else {
+			flags |= choiceOnlyContent
+			c.add("str")
+			if err := x.content(c, append(append(content{}, o.before...), o.middle...), o); err != nil {
+				return err
+			}
+			c.add("/str")
+		}
+
+		for i, cond := range o.conditions {
+			tokens, err := x.expr(cond, o)
+			if err != nil {
+				return err
+			}
+			c.add(tokens...)
+			if i > 0 {
+				c.add("&&")
+			}
+			flags |= choiceCondition
+		}
+
+		if !o.sticky {
+			flags |= choiceOnceOnly
+		}
+
+		c.add("/ev", map[string]interface{}{"*": x.paths[o], "flg": flags})
+	}
+
+	// the thread is finished, or waits for the choice
+	c.add("done")
+	return nil
+}
+
+// glued content, the glue is at the start or end of it
+func (x *exporter) glued(c *inkContainer, text content, node Node) error {
+	text = append(content{}, text...)
+
+	var tail bool
+	if n := len(text); n > 0 {
+		if p, ok := text[0].(plain); ok {
+			if t := strings.TrimLeft(string(p), " \t"); strings.HasPrefix(t, "<>") {
+				c.add("<>")
+				text[0] = plain(t[2:])
+			}
+		}
+
+		if p, ok := text[n-1].(plain); ok {
+			if t := strings.TrimRight(string(p), " \t"); strings.HasSuffix(t, "<>") {
+				text[n-1] = plain(t[:len(t)-2])
+				tail = true
+			}
+		}
+	}
+
+	if err := x.content(c, text, node); err != nil {
+		return err
+	}
+
+	if tail {
+		c.add("<>")
+	}
+	return nil
+}
+
+// content of the text, the conditional text jumps in the container,
+// and the alternatives are the sub containers counting their visits
+func (x *exporter) content(c *inkContainer, text content, node Node) error {
+	for _, seg := range text {
+		switch seg := seg.(type) {
+		case plain:
+			if seg != "" {
+				c.add("^" + unescape(string(seg)))
+			}
+		case *inline:
+			tokens, err := x.expr(seg.exprc, node)
+			if err != nil {
+				return err
+			}
+			c.add("ev")
+			c.add(tokens...)
+			c.add("out", "/ev")
+		case *conditional:
+			tokens, err := x.expr(seg.condition, node)
+			if err != nil {
+				return err
+			}
+			c.add("ev")
+			c.add(tokens...)
+			c.add("/ev")
+
+			then, done := c.label(), c.label()
+			c.jump(then, true)
+			if len(seg.branches) > 1 {
+				if err := x.content(c, seg.branches[1], node); err != nil {
+					return err
+				}
+			}
+			c.jump(done, false)
+
+			c.mark(then)
+			if err := x.content(c, seg.branches[0], node); err != nil {
+				return err
+			}
+			c.mark(done)
+			c.add("nop")
+		case *alternatives:
+			sub, err := x.alternatives(seg, node)
+			if err != nil {
+				return err
+			}
+			c.add(sub)
+		}
+	}
+
+	return nil
+}
+
+// alternatives of the sequence, the index is decided by the visits of it
+func (x *exporter) alternatives(a *alternatives, node Node) (*inkContainer, error) {
+	c := &inkContainer{flags: countVisits | countStartOnly}
+	n := len(a.items)
+
+	c.add("ev", "visit")
+	switch a.kind {
+	case stopping:
+		c.add(n-1, "MIN")
+	case cycle:
+		c.add(n, "%")
+	case shuffle:
+		c.add(n, "seq")
+	case once:
+		c.add(n, "MIN")
+	}
+	c.add("/ev")
+
+	done := c.label()
+	items := make([]int, n)
+	for i := range a.items {
+		items[i] = c.label()
+		c.add("ev", "du", i, "==", "/ev")
+		c.jump(items[i], true)
+	}
+	c.add("pop")
+	c.jump(done, false)
+
+	for i, item := range a.items {
+		c.mark(items[i])
+		c.add("pop")
+		if err := x.content(c, item, node); err != nil {
+			return nil, err
+		}
+		c.jump(done, false)
+	}
+
+	c.mark(done)
+	c.add("nop")
+	return c, nil
+}
+
+// expr of ink, which is evaluated on the stack
+func (x *exporter) expr(e *exprc, from Node) ([]interface{}, error) {
+	tree, err := parser.Parse(e.code())
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := x.eval(tree.Node, from)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can not export the expression: %s", e.raw)
+	}
+
+	return tokens, nil
+}
+
+// eval tokens of the expression's node
+func (x *exporter) eval(node ast.Node, from Node) ([]interface{}, error) {
+	switch n := node.(type) {
+	case *ast.NilNode:
+		return []interface{}{"void"}, nil
+	case *ast.IntegerNode:
+		return []interface{}{n.Value}, nil
+	case *ast.FloatNode:
+		return []interface{}{inkFloat(n.Value)}, nil
+	case *ast.BoolNode:
+		return []interface{}{n.Value}, nil
+	case *ast.StringNode:
+		v, err := x.value(n.Value, from)
+		return []interface{}{v}, err
+	case *ast.IdentifierNode:
+		return x.identifier(n.Value, from)
+	case *ast.UnaryNode:
+		tokens, err := x.eval(n.Node, from)
+		if err != nil {
+			return nil, err
+		}
+
+		switch n.Operator {
+		case "not", "!":
+			return append(tokens, "!"), nil
+		case "-":
+			return append(tokens, "_"), nil
+		case "+":
+			return tokens, nil
+		}
+		return nil, errors.Errorf("operator is not supported: %s", n.Operator)
+	case *ast.BinaryNode:
+		op, ok := binaryOps[n.Operator]
+		if !ok {
+			return nil, errors.Errorf("operator is not supported: %s", n.Operator)
+		}
+
+		left, err := x.eval(n.Left, from)
+		if err != nil {
+			return nil, err
+		}
+		right, err := x.eval(n.Right, from)
+		if err != nil {
+			return nil, err
+		}
+		return append(append(left, right...), op), nil
+	case *ast.FunctionNode:
+		return x.call(n, from)
+	}
+
+	return nil, errors.Errorf("expression is not supported: %T", node)
+}
+
+// identifier of the variable, constant, list item or read count
+func (x *exporter) identifier(name string, from Node) ([]interface{}, error) {
+	s := x.story
+	if v, ok := s.consts[name]; ok {
+		obj, err := x.value(v, from)
+		return []interface{}{obj}, err
+	}
+
+	if v, ok := s.items[name]; ok && v != nil && !s.local(name, from) {
+		obj, err := x.value(v, from)
+		return []interface{}{obj}, err
+	}
+
+	if _, ok := s.defaults[name]; ok || s.local(name, from) {
+		return []interface{}{map[string]interface{}{"VAR?": name}}, nil
+	}
+
+	// read count of the knot, stitch or label
+	if n := s.divert(strings.ReplaceAll(name, PathSplit, "."), from); n != nil {
+		if path, ok := x.paths[n]; ok {
+			return []interface{}{map[string]interface{}{"CNT?": path}}, nil
+		}
+	}
+
+	return nil, errors.Errorf("variable is not declared: %s", name)
+}
+
+// call the function, the built-ins are the commands or natives of ink
+func (x *exporter) call(fn *ast.FunctionNode, from Node) ([]interface{}, error) {
+	if path, ok := targetOf(fn); ok {
+		v, err := x.value(path, from)
+		return []interface{}{v}, err
+	}
+
+	// the list literal is the union of its items
+	if fn.Name == "_list" {
+		tokens := []interface{}{map[string]interface{}{"list": map[string]interface{}{}}}
+		for _, a := range fn.Arguments {
+			t, err := x.eval(a, from)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(append(tokens, t...), "+")
+		}
+		return tokens, nil
+	}
+
+	var tokens []interface{}
+	for _, a := range fn.Arguments {
+		t, err := x.eval(a, from)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t...)
+	}
+
+	s := x.story
+	switch fn.Name {
+	case "TURNS":
+		return append(tokens, "turn"), nil
+	case "TURNS_SINCE":
+		return append(tokens, "turns"), nil
+	case "CHOICE_COUNT":
+		return append(tokens, "choiceCnt"), nil
+	case "RANDOM":
+		return append(tokens, "rnd"), nil
+	case "SEED_RANDOM":
+		return append(tokens, "srnd"), nil
+	case "INT", "FLOOR", "FLOAT", "MIN", "MAX", "POW":
+		return append(tokens, fn.Name), nil
+	case "LIST_COUNT", "LIST_MIN", "LIST_MAX", "LIST_VALUE", "LIST_ALL", "LIST_INVERT":
+		return append(tokens, fn.Name), nil
+	case "_has":
+		return append(tokens, "?"), nil
+	case "_hasnt":
+		return append(tokens, "!?"), nil
+	case "_intersect":
+		return append(tokens, "L^"), nil
+	}
+
+	if _, ok := s.externals[fn.Name]; ok {
+		return append(tokens, map[string]interface{}{"x()": fn.Name, "exArgs": len(fn.Arguments)}), nil
+	}
+
+	if k := s.knot(strings.ToLower(fn.Name)); k != nil && k.function {
+		return append(tokens, map[string]interface{}{"f()": x.paths[k]}), nil
+	}
+
+	return nil, errors.Errorf("function is not supported: %s", fn.Name)
+}
@@ -0,0 +1,201 @@
+package goink
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportJSON(t *testing.T) {
+	input := `
+	VAR coins = 3
+	VAR met = false
+	VAR next = -> farewell
+	CONST PRICE = 2
+	Hello, {met: friend|stranger}.
+	-> shop
+	== shop
+	{shop > 1: Welcome back.|Welcome.}
+	You have {coins} coins, {&tick|tock}.
+	* {coins >= PRICE} [Buy a hat]
+	  You buy a hat.
+	  ~ coins = coins - PRICE
+	  -> shop
+	+ (ask) Ask[.] about the weather.
+	  {shop.ask > 1: Still sunny.|Sunny.}
+	  -> shop
+	* Leave
+	- (left) Goodbye.
+	~ met = true
+	{met} You met me.
+	{met and coins > 0} You are rich.
+	-> farewell(coins) ->
+	Twice {double(coins)}.
+	-> END
+	== farewell(n)
+	You keep {n} coins.
+	->->
+	== function double(x)
+	~ return x * 2
+	`
+
+	story := Default()
+	assert.Nil(t, story.Parse(input))
+	assert.Nil(t, story.PostParsing())
+
+	data, err := story.ExportJSON()
+	assert.Nil(t, err)
+
+	compiled, err := LoadJSON(data)
+	assert.Nil(t, err)
+
+	// the exported story plays the same as the parsed one
+	ctx, cctx := NewContext(), NewContext()
+	sec, e := story.Resume(ctx)
+	assert.Nil(t, e)
+	csec, ce := compiled.Resume(cctx)
+	assert.Nil(t, ce)
+	assert.Equal(t, sec.Text, csec.Text)
+	assert.Equal(t, "Hello, stranger.\nWelcome.\nYou have 3 coins, tick.", csec.Text)
+	assert.Equal(t, sec.Opts, csec.Opts)
+
+	for _, idx := range []int{1, 0, 1} {
+		sec, e = story.Pick(ctx, idx)
+		assert.Nil(t, e)
+		csec, ce = compiled.Pick(cctx, idx)
+		assert.Nil(t, ce)
+
+		assert.Equal(t, sec.Text, csec.Text)
+		assert.Equal(t, sec.Opts, csec.Opts)
+		assert.Equal(t, sec.End, csec.End)
+	}
+
+	assert.Equal(t, "Leave\nGoodbye.\nYou met me.\nYou are rich.\nYou keep 1 coins.\nTwice 2.", csec.Text)
+	assert.True(t, csec.End)
+}
+
+func TestExportFlow(t *testing.T) {
+	input := `
+	VAR x = 1
+	VAR target = -> k.st
+	-> target
+	== k
+	= st
+	<- th
+	{x > 1: Big|Small}, {!first|second}.
+	-> DONE
+	== th
+	{
+	- x == 1: one
+	- else: other
+	}
+	+ [Again]
+	  -> bump(x) ->
+	  -> k.st
+	+ Leave
+	  ~ temp y = x * 10
+	  Done {y}.
+	  -> END
+	== bump(ref v)
+	~ v = v + 1
+	->->
+	`
+
+	story := Default()
+	assert.Nil(t, story.Parse(input))
+	assert.Nil(t, story.PostParsing())
+
+	data, err := story.ExportJSON()
+	assert.Nil(t, err)
+
+	compiled, err := LoadJSON(data)
+	assert.Nil(t, err)
+
+	ctx, cctx := NewContext(), NewContext()
+	sec, e := story.Resume(ctx)
+	assert.Nil(t, e)
+	csec, ce := compiled.Resume(cctx)
+	assert.Nil(t, ce)
+	assert.Equal(t, sec.Text, csec.Text)
+	assert.Equal(t, sec.Opts, csec.Opts)
+	assert.Equal(t, "one\nSmall, first.", csec.Text)
+
+	sec, e = story.Pick(ctx, 0)
+	assert.Nil(t, e)
+	csec, ce = compiled.Pick(cctx, 0)
+	assert.Nil(t, ce)
+	assert.Equal(t, sec.Text, csec.Text)
+	assert.Equal(t, "other\nBig, second.", csec.Text)
+	assert.Equal(t, 2, cctx.Vars["x"])
+
+	sec, e = story.Pick(ctx, 1)
+	assert.Nil(t, e)
+	csec, ce = compiled.Pick(cctx, 1)
+	assert.Nil(t, ce)
+	assert.Equal(t, sec.Text, csec.Text)
+	assert.Equal(t, "Leave\nDone 20.", csec.Text)
+	assert.True(t, csec.End)
+}
+
+func TestExportLists(t *testing.T) {
+	input := `
+	LIST doors = (open), closed, locked
+	LIST items = sword = 5, (shield), potion
+	LIST empty = nothing
+	Doors: {doors}, {empty}.
+	~ doors += locked
+	~ doors -= open
+	{doors ? locked: Locked.}
+	{doors !? open: Not open.}
+	Counts {LIST_COUNT(doors)}, {LIST_VALUE(LIST_MAX(doors))}, {LIST_MIN(doors)}
+	{LIST_ALL(doors)} {LIST_ALL(empty)}
+	{doors ^ (locked + closed)}
+	{LIST_INVERT(doors)}
+	{items has shield and LIST_VALUE(items.shield) == 6: Shield.}
+	Compare {doors == locked} {doors - 1} {items - 1}.
+	{doors + closed == (closed, locked): Same.} {(sword, potion) > shield: Greater.|Not greater.} {() == (): Empty.}
+	* [Unlock]
+	  ~ doors = doors - locked + open + closed
+	  Now {doors}. -> END
+	`
+
+	story := Default()
+	assert.Nil(t, story.Parse(input))
+	assert.Nil(t, story.PostParsing())
+
+	data, err := story.ExportJSON()
+	assert.Nil(t, err)
+
+	compiled, err := LoadJSON(data)
+	assert.Nil(t, err)
+	assert.Equal(t, story.lists, compiled.lists)
+	assert.Equal(t, story.defaults, compiled.defaults)
+
+	// the exported story plays the same as the parsed one
+	ctx, cctx := NewContext(), NewContext()
+	sec, e := story.Resume(ctx)
+	assert.Nil(t, e)
+	csec, ce := compiled.Resume(cctx)
+	assert.Nil(t, ce)
+	assert.Equal(t, sec.Text, csec.Text)
+	assert.Equal(t, "Doors: open, .\nLocked.\nNot open.\nCounts 1, 3, locked\nopen, closed, locked nothing\nlocked\nopen, closed\nShield.\nCompare true closed sword.\nSame. Not greater. Empty.", csec.Text)
+
+	sec, e = story.Pick(ctx, 0)
+	assert.Nil(t, e)
+	csec, ce = compiled.Pick(cctx, 0)
+	assert.Nil(t, ce)
+	assert.Equal(t, sec.Text, csec.Text)
+	assert.Equal(t, "Now open, closed.", csec.Text)
+	assert.Equal(t, ctx.Vars["doors"], cctx.Vars["doors"])
+}
+
+func TestExportErrors(t *testing.T) {
+	story := Default()
+	assert.Nil(t, story.Parse("Hello {unknown}."))
+	_, err := story.ExportJSON()
+	assert.Equal(t, "can not export start__i: can not export the expression: unknown: variable is not declared: unknown", err.Error())
+
+	compiled, _ := LoadJSON([]byte(shopJSON))
+	_, err = compiled.ExportJSON()
+	assert.Equal(t, "can not export the compiled story", err.Error())
+}
@@ -2,13 +2,19 @@ package goink
 
 import (
 	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/antonmedv/expr"
+	"github.com/antonmedv/expr/ast"
 	"github.com/antonmedv/expr/vm"
 	"github.com/pkg/errors"
 )
 
-var regReplaceDot = regexp.MustCompile(`\.(\w+)`)
+var (
+	regReplaceDot  = regexp.MustCompile(`\.(\w+)`)
+	divertValueReg = regexp.MustCompile(`^->\s*([a-zA-Z_]\w*(\.\w+)*)`)
+)
 
 // exprc in the line
 type exprc struct {
@@ -20,32 +26,300 @@ type exprc struct {
 // newExprc creates a condition with the given expr
 func newExprc(code string) (*exprc, error) {
 	cond := &exprc{raw: code}
-	c := regReplaceDot.ReplaceAllString(code, PathSplit+"$1")
+	if err := cond.compile(&patcher{}); err != nil {
+		return nil, err
+	}
 
-	program, err := expr.Compile(c, expr.Env(nil))
+	return cond, nil
+}
 
+// compile the raw code with the patcher
+func (c *exprc) compile(p *patcher) error {
+	// story's functions are unknown at compiling, only the built-ins
+	program, err := expr.Compile(c.code(), expr.Env(signatures), expr.AllowUndefinedVariables(), expr.Patch(p))
 	if err != nil {
-		return nil, err
+		return err
+	} else if p.err != nil {
+		return p.err
 	}
 
-	cond.program = program
-	return cond, nil
+	c.program = program
+	return nil
+}
+
+// code of the expression, which is rewritten for expr
+func (c *exprc) code() string {
+	return replaceDots(rewriteListOps(rewriteLists(rewriteDiverts(c.raw))))
+}
+
+// replaceDots of the variables' paths: knot.stitch => knot__stitch,
+// the strings and numbers are kept
+func replaceDots(code string) string {
+	if !strings.Contains(code, ".") {
+		return code
+	}
+
+	var out strings.Builder
+	for i := 0; i < len(code); i++ {
+		ch := code[i]
+		switch {
+		case ch == '"' || ch == '\'':
+			j := i + 1
+			for ; j < len(code) && code[j] != ch; j++ {
+				if code[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(code) {
+				j = len(code) - 1
+			}
+			out.WriteString(code[i : j+1])
+			i = j
+		case isWordStart(code, i):
+			j := i
+			for j < len(code) && isWordChar(code[j]) {
+				j++
+			}
+
+			word := code[i:j]
+			if ch < '0' || ch > '9' {
+				word = regReplaceDot.ReplaceAllString(word, PathSplit+"$1")
+			}
+			out.WriteString(word)
+			i = j - 1
+		default:
+			out.WriteByte(ch)
+		}
+	}
+
+	return out.String()
+}
+
+// rewriteDiverts rewrites the divert targets into calls: -> Knot.stitch => _target("knot.stitch"),
+// which return the values of DivertTarget
+func rewriteDiverts(code string) string {
+	if !strings.Contains(code, "->") {
+		return code
+	}
+
+	var out strings.Builder
+	for i := 0; i < len(code); i++ {
+		ch := code[i]
+		switch {
+		case ch == '"' || ch == '\'':
+			j := i + 1
+			for ; j < len(code) && code[j] != ch; j++ {
+				if code[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(code) {
+				j = len(code) - 1
+			}
+			out.WriteString(code[i : j+1])
+			i = j
+		case strings.HasPrefix(code[i:], "->"):
+			if res := divertValueReg.FindStringSubmatch(code[i:]); res != nil {
+				out.WriteString("_target(" + strconv.Quote(strings.ToLower(res[1])) + ")")
+				i += len(res[0]) - 1
+				continue
+			}
+			out.WriteByte(ch)
+		default:
+			out.WriteByte(ch)
+		}
+	}
+
+	return out.String()
+}
+
+// patcher replaces the constant identifiers with their values, unescapes the strings,
+// and the + - and comparison operators with the functions of their operands' types,
+// the names are checked when the node of the expression is known
+type patcher struct {
+	consts map[string]interface{}
+
+	story  *Story
+	node   Node
+	locals map[string]bool // temporary variables and parameters of the scope
+	err    error           // the first undefined name
+}
+
+func (p *patcher) Enter(node *ast.Node) {}
+
+func (p *patcher) Exit(node *ast.Node) {
+	switch n := (*node).(type) {
+	case *ast.FunctionNode:
+		p.call(n)
+	case *ast.IdentifierNode:
+		if !p.defined(n.Value) && p.err == nil {
+			p.err = errors.Errorf("undefined variable: %s", n.Value)
+		}
+
+		if p.ambiguous(n.Value) && p.err == nil {
+			p.err = errors.Errorf("ambiguous list item: %s", n.Value)
+		}
+
+		// the constant is shadowed by the local variable
+		if p.locals[n.Value] {
+			return
+		}
+
+		// read count of the path, which is relative to the node
+		if path := p.count(n.Value); path != "" {
+			ast.Patch(node, &ast.FunctionNode{Name: "_visits", Arguments: []ast.Node{&ast.StringNode{Value: path}}})
+			return
+		}
+
+		switch v := p.consts[n.Value].(type) {
+		case int:
+			ast.Patch(node, &ast.IntegerNode{Value: v})
+		case float64:
+			ast.Patch(node, &ast.FloatNode{Value: v})
+		case string:
+			ast.Patch(node, &ast.StringNode{Value: v})
+		case bool:
+			ast.Patch(node, &ast.BoolNode{Value: v})
+		case DivertTarget:
+			ast.Patch(node, &ast.FunctionNode{Name: "_target", Arguments: []ast.Node{&ast.StringNode{Value: string(v)}}})
+		}
+	case *ast.StringNode:
+		// the escaped characters of the raw line
+		n.Value = unescape(n.Value)
+	case *ast.BinaryNode:
+		// the operands are lists, numbers or strings, which are known at runtime
+		if p.story == nil {
+			return
+		}
+
+		switch n.Operator {
+		case "+":
+			ast.Patch(node, &ast.FunctionNode{Name: "_add", Arguments: []ast.Node{n.Left, n.Right}})
+		case "-":
+			ast.Patch(node, &ast.FunctionNode{Name: "_sub", Arguments: []ast.Node{n.Left, n.Right}})
+		case "==", "!=", "<", ">", "<=", ">=":
+			op := &ast.StringNode{Value: n.Operator}
+			ast.Patch(node, &ast.FunctionNode{Name: "_compare", Arguments: []ast.Node{op, n.Left, n.Right}})
+		}
+	}
+}
+
+// defined name of the variable, constant, list item,
+// local variable or read count of the node's scope
+func (p *patcher) defined(name string) bool {
+	s := p.story
+	if s == nil || p.locals[name] {
+		return true
+	}
+
+	if _, ok := s.vars[name]; ok {
+		return true
+	}
+	if _, ok := s.consts[name]; ok {
+		return true
+	}
+	if _, ok := s.items[name]; ok {
+		return true
+	}
+
+	return p.count(name) != ""
+}
+
+// count path of the knot, stitch or label, which is
+// resolved like the divert target, when it is not a variable
+func (p *patcher) count(name string) string {
+	s := p.story
+	if s == nil {
+		return ""
+	}
+
+	if _, ok := s.vars[name]; ok {
+		return ""
+	}
+	if _, ok := s.consts[name]; ok {
+		return ""
+	}
+	if _, ok := s.items[name]; ok {
+		return ""
+	}
+
+	if n := s.divert(strings.ToLower(strings.Replace(name, PathSplit, ".", -1)), p.node); n != nil {
+		return n.Path()
+	}
+	return ""
+}
+
+// ambiguous short name of the items in different lists
+func (p *patcher) ambiguous(name string) bool {
+	if p.story == nil || p.locals[name] {
+		return false
+	}
+
+	v, ok := p.story.items[name]
+	return ok && v == nil
+}
+
+// targetOf the rewritten divert target: _target("knot.stitch")
+func targetOf(n *ast.FunctionNode) (DivertTarget, bool) {
+	if n.Name != "_target" || len(n.Arguments) != 1 {
+		return "", false
+	}
+
+	path, ok := n.Arguments[0].(*ast.StringNode)
+	if !ok {
+		return "", false
+	}
+	return DivertTarget(path.Value), true
+}
+
+// call of the built-in, external or story's function,
+// the story's functions are called by their lower case names
+func (p *patcher) call(n *ast.FunctionNode) {
+	s := p.story
+	if s == nil {
+		return
+	}
+
+	if _, ok := signatures[n.Name]; ok {
+		return
+	}
+	if _, ok := s.externals[n.Name]; ok {
+		return
+	}
+
+	if name := strings.ToLower(n.Name); s.funcs[name] != nil {
+		n.Name = name
+	} else if p.err == nil {
+		p.err = errors.Errorf("undefined function: %s", n.Name)
+	}
+}
+
+// Eval return the exprc result
+func (c *exprc) Eval(env map[string]interface{}) (interface{}, error) {
+	return expr.Run(c.program, env)
 }
 
 // Bool return the exprc result as bool value
 func (c *exprc) Bool(count map[string]interface{}) (bool, error) {
-	output, err := expr.Run(c.program, count)
+	output, err := c.Eval(count)
 	if err != nil {
 		return false, err
 	}
 
-	// fmt.Println(c.program.Source.Content(), output, count["Knot_A-gather"])
+	return truth(output)
+}
 
+// truth of the expression's output
+func truth(output interface{}) (bool, error) {
 	b, ok := output.(bool)
 	if ok {
 		return b, nil
 	}
 
+	if l, ok := output.(List); ok {
+		return len(l.Items) > 0, nil
+	}
+
 	i, ok := output.(int)
 	if ok {
 		return (i > 0), nil
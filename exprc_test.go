@@ -1,6 +1,7 @@
 package goink
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -57,3 +58,45 @@ func TestNewExprc(t *testing.T) {
 	assert.NotNil(t, err)
 	assert.False(t, b)
 }
+
+func TestExprcUndefined(t *testing.T) {
+	input := `
+	VAR gold = 1
+	CONST PRICE = 2
+	-> shop(3)
+	== shop(n)
+	~ temp coins = n
+	{gold + coins + n + PRICE + shop} {Double(n)}
+	* (ask) Ask -> END
+	== other
+	%s
+	-> END
+	== function double(x)
+	~ return x * 2
+	`
+
+	story := Default()
+	assert.Nil(t, story.Parse(fmt.Sprintf(input, "")))
+	assert.Nil(t, story.PostParsing())
+
+	// the story's functions are called by the lower case names
+	assert.NotNil(t, story.funcs["double"])
+	assert.Nil(t, story.funcs["Double"])
+
+	sec, err := story.Resume(NewContext())
+	assert.Nil(t, err)
+	assert.Equal(t, "10 6", sec.Text)
+
+	for code, msg := range map[string]string{
+		"{golds}":        "undefined variable: golds",
+		"{coins}":        "undefined variable: coins",
+		"{triple(gold)}": "undefined function: triple",
+	} {
+		story = Default()
+		assert.Nil(t, story.Parse(fmt.Sprintf(input, code)))
+
+		errs := story.PostParsing()
+		assert.Equal(t, 1, len(errs), code)
+		assert.Contains(t, errs[0].Error(), msg)
+	}
+}
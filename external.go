@@ -0,0 +1,174 @@
+package goink
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var externalReg = regexp.MustCompile(`^EXTERNAL\s+([a-zA-Z_]\w*)\s*\((.*)\)\s*$`)
+
+// external function, which is implemented by the game
+type external struct {
+	name   string
+	params []param
+	fn     reflect.Value
+	call   func(args ...interface{}) interface{}
+}
+
+// readExternal parse the declaration of the external function
+func readExternal(s *Story, input string, ln int) error {
+	res := externalReg.FindStringSubmatch(input)
+	if res == nil {
+		return errNotMatch
+	}
+
+	name := res[1]
+	if _, ok := s.externals[name]; ok {
+		return errors.Errorf("conflict external name: %s", name)
+	}
+
+	params, err := parseParams(res[2])
+	if err != nil {
+		return err
+	}
+
+	for _, p := range params {
+		if p.ref {
+			return errors.Errorf("external can not have ref parameter: %s", p.name)
+		}
+	}
+
+	s.externals[name] = newExternal(s, name, params)
+	s.touch()
+	return nil
+}
+
+// newExternal which is called by the expressions
+func newExternal(s *Story, name string, params []param) *external {
+	e := &external{name: name, params: params}
+	e.call = s.callback(func(args ...interface{}) (interface{}, error) {
+		return s.external(e, args)
+	})
+
+	return e
+}
+
+// BindExternal binds the go function to the declared external function,
+// the function could return a value, and an error as the last result.
+// It is called while the story is locked, so it must not call the story
+func (s *Story) BindExternal(name string, fn interface{}) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	e, ok := s.externals[name]
+	if !ok {
+		return errors.Errorf("external is not declared: %s", name)
+	}
+
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func {
+		return errors.Errorf("external %s should be bound to a function, but got: %T", name, fn)
+	}
+
+	t := v.Type()
+	if !t.IsVariadic() && t.NumIn() != len(e.params) {
+		return errors.Errorf("external %s needs %d arguments, but the function takes %d", name, len(e.params), t.NumIn())
+	}
+
+	if t.NumOut() > 2 || (t.NumOut() == 2 && t.Out(1) != errorType) {
+		return errors.Errorf("external %s should return a value and an optional error", name)
+	}
+
+	e.fn = v
+	return nil
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// external calls the bound function, or the ink function
+// with the same name as the fallback
+func (s *Story) external(e *external, args []interface{}) (interface{}, error) {
+	if len(args) != len(e.params) {
+		return nil, errors.Errorf("external %s needs %d arguments, but got %d", e.name, len(e.params), len(args))
+	}
+
+	if !e.fn.IsValid() {
+		if k, ok := s.paths[strings.ToLower(e.name)].(*knot); ok && k.function {
+			return s.call(k, args)
+		}
+		return nil, errors.Errorf("external is not bound: %s", e.name)
+	}
+
+	t := e.fn.Type()
+	in := make([]reflect.Value, len(args))
+	for i, a := range args {
+		var pt reflect.Type
+		if t.IsVariadic() && i >= t.NumIn()-1 {
+			pt = t.In(t.NumIn() - 1).Elem()
+		} else {
+			pt = t.In(i)
+		}
+
+		v, ok := convert(reflect.ValueOf(a), pt)
+		if !ok {
+			return nil, errors.Errorf("external %s needs %s argument, but got: %v", e.name, pt, a)
+		}
+		in[i] = v
+	}
+
+	out := e.fn.Call(in)
+	if len(out) == 2 && !out[1].IsNil() {
+		return nil, out[1].Interface().(error)
+	}
+
+	if len(out) == 0 {
+		return nil, nil
+	}
+
+	return valueOf(out[0].Interface()), nil
+}
+
+// convert the ink value to the type of the parameter, only the
+// numbers which are not changed by the conversion are converted
+func convert(v reflect.Value, t reflect.Type) (reflect.Value, bool) {
+	switch {
+	case !v.IsValid():
+		return reflect.Zero(t), true
+	case v.Type().AssignableTo(t):
+		return v, true
+	case isNumberKind(v.Kind()) && isNumberKind(t.Kind()):
+		c := v.Convert(t)
+		if c.Convert(v.Type()).Interface() != v.Interface() {
+			return v, false
+		}
+
+		// the negative number is wrapped into the unsigned one
+		unsigned := t.Kind() >= reflect.Uint && t.Kind() <= reflect.Uintptr
+		return c, !unsigned || v.Convert(reflect.TypeOf(0.0)).Float() >= 0
+	case v.Kind() == reflect.String && t.Kind() == reflect.String:
+		return v.Convert(t), true
+	}
+
+	return v, false
+}
+
+// isNumberKind of the integers and floats
+func isNumberKind(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Float64
+}
+
+// valueOf the go value, which is converted to the types of ink
+func valueOf(v interface{}) interface{} {
+	switch r := reflect.ValueOf(v); r.Kind() {
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int(r.Convert(reflect.TypeOf(0)).Int())
+	case reflect.Float32:
+		return r.Float()
+	}
+
+	return v
+}
@@ -0,0 +1,151 @@
+package goink
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExternalFunctions(t *testing.T) {
+	input := `
+	EXTERNAL has_item(name)
+	EXTERNAL play_sound(name)
+	EXTERNAL roll(sides)
+	~ play_sound("door")
+	{has_item("key"): You open the door with the key.}
+	You rolled {roll(6)}.
+	-> END
+	== function roll(sides)
+	~ return sides
+	`
+
+	story := Default()
+	err := story.Parse(input)
+	assert.Nil(t, err)
+	assert.Nil(t, story.PostParsing())
+
+	_, err = story.Resume(NewContext())
+	assert.Contains(t, err.Error(), "external is not bound: play_sound")
+
+	var sounds []string
+	assert.Nil(t, story.BindExternal("play_sound", func(name string) {
+		sounds = append(sounds, name)
+	}))
+	assert.Nil(t, story.BindExternal("has_item", func(name string) bool {
+		return name == "key"
+	}))
+
+	// the ink function is the fallback of roll
+	sec, err := story.Resume(NewContext())
+	assert.Nil(t, err)
+	assert.Equal(t, "You open the door with the key.\nYou rolled 6.", sec.Text)
+	assert.Equal(t, []string{"door"}, sounds)
+
+	assert.Nil(t, story.BindExternal("roll", func(sides int64) (int64, error) {
+		return sides / 2, nil
+	}))
+
+	sec, err = story.Resume(NewContext())
+	assert.Nil(t, err)
+	assert.Equal(t, "You open the door with the key.\nYou rolled 3.", sec.Text)
+
+	assert.Nil(t, story.BindExternal("roll", func(sides int) (int, error) {
+		return 0, errors.New("dice is lost")
+	}))
+
+	_, err = story.Resume(NewContext())
+	assert.Contains(t, err.Error(), "dice is lost")
+
+	e := story.BindExternal("unknown", func() {})
+	assert.Equal(t, "external is not declared: unknown", e.Error())
+
+	e = story.BindExternal("roll", func(a, b int) int { return a })
+	assert.Equal(t, "external roll needs 1 arguments, but the function takes 2", e.Error())
+
+	e = story.BindExternal("roll", 1)
+	assert.Equal(t, "external roll should be bound to a function, but got: int", e.Error())
+
+	err = Default().Parse("EXTERNAL f(a)\nEXTERNAL f(b)")
+	assert.Contains(t, err.Error(), "conflict external name: f")
+}
+
+func TestExternalArguments(t *testing.T) {
+	input := `
+	EXTERNAL half(x)
+	{half(%s)}
+	-> END
+	`
+
+	for arg, fn := range map[string]interface{}{
+		"4":   func(x int8) int8 { return x / 2 },
+		"4.0": func(x int) int { return x / 2 },
+		"5":   func(x float32) float32 { return x / 2.5 },
+		"-4":  func(x interface{}) int { return x.(int) / -2 },
+	} {
+		story := Default()
+		assert.Nil(t, story.Parse(fmt.Sprintf(input, arg)))
+		assert.Nil(t, story.BindExternal("half", fn))
+
+		sec, err := story.Resume(NewContext())
+		assert.Nil(t, err, arg)
+		assert.Equal(t, "2", sec.Text, arg)
+	}
+
+	// the conversions which change the value are not allowed
+	for arg, fn := range map[string]interface{}{
+		"65":    func(x string) string { return x },
+		"2.5":   func(x int) int { return x },
+		"300":   func(x uint8) uint8 { return x },
+		"-1":    func(x uint) uint { return x },
+		`"abc"`: func(x int) int { return x },
+	} {
+		story := Default()
+		assert.Nil(t, story.Parse(fmt.Sprintf(input, arg)))
+		assert.Nil(t, story.BindExternal("half", fn))
+
+		_, err := story.Resume(NewContext())
+		assert.NotNil(t, err, arg)
+		assert.Contains(t, err.Error(), "external half needs", arg)
+	}
+}
+
+func TestExternalCallStory(t *testing.T) {
+	input := `
+	EXTERNAL notify()
+	~ notify()
+	Hello.
+	-> END
+	`
+
+	story := Default()
+	assert.Nil(t, story.Parse(input))
+
+	// the story is locked while calling the external,
+	// so the story is called after the external is returned
+	var once sync.Once
+	done := make(chan string)
+	assert.Nil(t, story.BindExternal("notify", func() {
+		once.Do(func() {
+			go func() {
+				sec, err := story.Resume(NewContext())
+				assert.Nil(t, err)
+				done <- sec.Text
+			}()
+		})
+	}))
+
+	sec, err := story.Resume(NewContext())
+	assert.Nil(t, err)
+	assert.Equal(t, "Hello.", sec.Text)
+
+	select {
+	case text := <-done:
+		assert.Equal(t, "Hello.", text)
+	case <-time.After(time.Second):
+		t.Fatal("the story is deadlocked")
+	}
+}
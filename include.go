@@ -0,0 +1,108 @@
+package goink
+
+import (
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var includeReg = regexp.MustCompile(`^INCLUDE\s+(.+)$`)
+
+// Resolver reads the files of the story, it is satisfied by
+// embed.FS, fstest.MapFS, Dir and Files
+type Resolver interface {
+	ReadFile(name string) ([]byte, error)
+}
+
+// Dir resolves the files from the directory on disk
+type Dir string
+
+// ReadFile from the directory
+func (d Dir) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(string(d), filepath.FromSlash(name)))
+}
+
+// Files resolves the files from memory by name
+type Files map[string]string
+
+// ReadFile from memory
+func (f Files) ReadFile(name string) ([]byte, error) {
+	if content, ok := f[name]; ok {
+		return []byte(content), nil
+	}
+
+	return nil, errors.Errorf("file does not exist: %s", name)
+}
+
+// SetResolver of the story's files
+func (s *Story) SetResolver(r Resolver) {
+	s.resolver = r
+}
+
+// ParseFile parses the file and its included files by the resolver
+func (s *Story) ParseFile(name string) *ErrInk {
+	if err := s.include(name); err != nil {
+		if e, ok := err.(*ErrInk); ok {
+			return e
+		}
+		return &ErrInk{LN: -1, File: name, Message: err.Error()}
+	}
+
+	return nil
+}
+
+// readInclude parse the included file into story
+func readInclude(s *Story, input string, ln int) error {
+	res := includeReg.FindStringSubmatch(input)
+	if res == nil {
+		return errNotMatch
+	}
+
+	// contents after the included file are still in the current flow
+	current := s.current
+	kn, st := s.container(current)
+
+	if err := s.include(strings.TrimSpace(res[1])); err != nil {
+		return err
+	}
+
+	if k, t := s.container(s.current); k != kn || t != st {
+		s.current = current
+	}
+
+	return nil
+}
+
+// include the file, which is parsed only once
+func (s *Story) include(name string) error {
+	if s.resolver == nil {
+		return errors.Errorf("resolver is not set for the file: %s", name)
+	}
+
+	name = path.Clean(name)
+	if s.included[name] {
+		return nil
+	}
+	s.included[name] = true
+
+	b, err := s.resolver.ReadFile(name)
+	if err != nil {
+		return err
+	}
+
+	file, ln := s.file, s.ln
+	defer func() {
+		s.file, s.ln = file, ln
+	}()
+
+	s.file, s.ln = name, 0
+	if err := s.Parse(string(b)); err != nil {
+		return err
+	}
+
+	return nil
+}
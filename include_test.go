@@ -0,0 +1,94 @@
+package goink
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInclude(t *testing.T) {
+	files := Files{
+		"main.ink": `
+		INCLUDE knots/shop.ink
+		INCLUDE vars.ink
+		Hello, you have {gold} coins. -> shop
+		`,
+		"vars.ink": `
+		VAR gold = 3
+		INCLUDE main.ink
+		`,
+		"knots/shop.ink": `
+		== shop
+		Welcome to the shop.
+		* [Buy] -> END
+		`,
+	}
+
+	story := Default()
+	story.SetResolver(files)
+	assert.Nil(t, story.ParseFile("main.ink"))
+	assert.Nil(t, story.PostParsing())
+
+	assert.Equal(t, "knots/shop.ink", story.paths["shop"].File())
+	assert.Equal(t, 2, story.paths["shop"].LN())
+	assert.Equal(t, "main.ink", story.start.(*start).next.File())
+
+	sec, err := story.Resume(NewContext())
+	assert.Nil(t, err)
+	assert.Equal(t, "Hello, you have 3 coins.\nWelcome to the shop.", sec.Text)
+	assert.Equal(t, []string{"Buy"}, sec.Opts)
+}
+
+func TestIncludeErrors(t *testing.T) {
+	files := Files{
+		"main.ink": `
+		Hello.
+		INCLUDE broken.ink
+		`,
+		"broken.ink": `
+		-> END
+		* {} broken
+		`,
+		"missing.ink": `
+		-> missing_knot
+		`,
+	}
+
+	story := Default()
+	story.SetResolver(files)
+	err := story.ParseFile("main.ink")
+	assert.Equal(t, "broken.ink", err.File)
+	assert.Equal(t, 3, err.LN)
+
+	story = Default()
+	story.SetResolver(files)
+	assert.Nil(t, story.ParseFile("missing.ink"))
+	errs := story.PostParsing()
+	assert.Equal(t, "can not find the divert: missing_knot file: missing.ink ln: 2", errs[0].Error())
+
+	story = Default()
+	story.SetResolver(files)
+	err = story.ParseFile("none.ink")
+	assert.Equal(t, "file does not exist: none.ink file: none.ink ln: -1", err.Error())
+
+	story = Default()
+	err = story.Parse("INCLUDE main.ink")
+	assert.Contains(t, err.Error(), "resolver is not set for the file: main.ink")
+}
+
+func TestIncludeFromDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goink")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "main.ink"), []byte("INCLUDE end.ink\nThe end. -> END"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "end.ink"), []byte("VAR over = true"), 0644))
+
+	story := Default()
+	story.SetResolver(Dir(dir))
+	assert.Nil(t, story.ParseFile("main.ink"))
+	assert.Equal(t, true, story.vars["over"])
+}
@@ -0,0 +1,566 @@
+package goink
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// the versions of the compiled ink which can be loaded
+const (
+	minInkVersion = 19
+	maxInkVersion = 21
+)
+
+// flags of the compiled container
+const (
+	countVisits    = 0x1
+	countTurns     = 0x2
+	countStartOnly = 0x4
+)
+
+// flags of the compiled choice point
+const (
+	choiceCondition    = 0x1
+	choiceStartContent = 0x2
+	choiceOnlyContent  = 0x4
+	choiceInvisible    = 0x8
+	choiceOnceOnly     = 0x10
+)
+
+// FrameKind is how the frame of the compiled story is pushed into the call stack
+type FrameKind int
+
+// kinds of the frames
+const (
+	pushTunnel FrameKind = iota
+	pushFunction
+)
+
+// container of the compiled ink, which holds the content and named sub containers
+type container struct {
+	name    string
+	path    string
+	parent  *container
+	content []interface{}
+	named   map[string]*container
+	flags   int
+}
+
+// command of the compiled ink, which controls the evaluation and flow
+type command string
+
+// native function of the compiled ink: + - == MIN ...
+type native string
+
+// glue of the compiled ink: <>
+type glue struct{}
+
+// void value, which is returned by the function without return value
+type void struct{}
+
+// value of the compiled ink: int, float64, string, bool,
+// divert target, or variable pointer
+type value struct {
+	v interface{}
+}
+
+// varPointer refers the variable of the context: 0 is global,
+// others are the index of the frame plus 1, -1 is unresolved
+type varPointer struct {
+	name string
+	ci   int
+}
+
+// tag of the compiled ink, the legacy one: {"#": "tag"}
+type tag struct {
+	text string
+}
+
+// divert of the compiled ink: -> f() ->t-> x()
+type jsonDivert struct {
+	target   pointer
+	path     string // the path or variable name of the target
+	variable bool
+	push     bool
+	kind     FrameKind
+	external bool
+	args     int
+	cond     bool
+}
+
+// choicePoint of the compiled ink
+type choicePoint struct {
+	path  string // absolute path of the choice's content
+	flags int
+}
+
+// varRef reads the variable, or the read count of the container
+type varRef struct {
+	name  string
+	count *container
+}
+
+// varAssign assigns the value on the evaluation stack
+type varAssign struct {
+	name   string
+	global bool
+	decl   bool
+}
+
+var commands = map[string]bool{
+	"ev": true, "out": true, "/ev": true, "du": true, "pop": true, "~ret": true, "->->": true,
+	"str": true, "/str": true, "nop": true, "choiceCnt": true, "turn": true, "turns": true,
+	"readc": true, "rnd": true, "srnd": true, "visit": true, "seq": true, "thread": true,
+	"done": true, "end": true, "listInt": true, "range": true, "lrnd": true, "#": true, "/#": true,
+}
+
+// natives with their arity
+var natives = map[string]int{
+	"+": 2, "-": 2, "/": 2, "*": 2, "%": 2, "_": 1, "==": 2, ">": 2, "<": 2, ">=": 2, "<=": 2,
+	"!=": 2, "!": 1, "&&": 2, "||": 2, "MIN": 2, "MAX": 2, "POW": 2, "FLOOR": 1, "CEILING": 1,
+	"INT": 1, "FLOAT": 1, "?": 2, "!?": 2, "L^": 2, "LIST_COUNT": 1, "LIST_MIN": 1, "LIST_MAX": 1,
+	"LIST_ALL": 1, "LIST_INVERT": 1, "LIST_VALUE": 1,
+}
+
+// LoadJSON loads the story from the runtime json compiled by inklecate,
+// which is driven by Resume and Pick as the parsed one
+func LoadJSON(data []byte) (*Story, error) {
+	var doc struct {
+		Version  int                       `json:"inkVersion"`
+		Root     json.RawMessage           `json:"root"`
+		ListDefs map[string]map[string]int `json:"listDefs"`
+	}
+
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, errors.Wrap(err, "invalid ink json")
+	}
+
+	if doc.Version < minInkVersion || doc.Version > maxInkVersion {
+		return nil, errors.Errorf("ink version %d is not supported, it should be %d to %d", doc.Version, minInkVersion, maxInkVersion)
+	}
+
+	var root interface{}
+	d := json.NewDecoder(bytes.NewReader(doc.Root))
+	d.UseNumber()
+	if err := d.Decode(&root); err != nil {
+		return nil, errors.Wrap(err, "invalid ink json")
+	}
+
+	e := &engine{containers: make(map[string]*container)}
+	l := &jsonLoader{engine: e}
+
+	arr, ok := root.([]interface{})
+	if !ok {
+		return nil, errors.New("root of the ink json should be a container")
+	}
+
+	c, err := l.container(arr, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	e.root = c
+
+	// the paths are resolved after all the containers are loaded
+	for _, fn := range l.pending {
+		if err := fn(); err != nil {
+			return nil, err
+		}
+	}
+
+	s := Default()
+	s.engine = e
+	e.story = s
+
+	// items of the lists by their values
+	for name, def := range doc.ListDefs {
+		var items []ListItem
+		for item, v := range def {
+			items = append(items, ListItem{Origin: name, Name: item, Value: v})
+		}
+		s.lists[name] = newList(items, name).Items
+	}
+
+	if err := e.declare(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// jsonLoader builds the containers from the decoded json
+type jsonLoader struct {
+	engine  *engine
+	pending []func() error
+}
+
+// container from the json array, its last element is null,
+// or the named sub containers with the flags and its name
+func (l *jsonLoader) container(arr []interface{}, parent *container, name string) (*container, error) {
+	c := &container{name: name, parent: parent, named: make(map[string]*container)}
+
+	var extra map[string]interface{}
+	if n := len(arr); n > 0 {
+		if m, ok := arr[n-1].(map[string]interface{}); ok {
+			extra = m
+			arr = arr[:n-1]
+		} else if arr[n-1] == nil {
+			arr = arr[:n-1]
+		}
+	}
+
+	for k, v := range extra {
+		switch k {
+		case "#f":
+			n, ok := v.(json.Number)
+			f, err := strconv.Atoi(string(n))
+			if !ok || err != nil {
+				return nil, errors.Errorf("invalid flags of the container: %v", v)
+			}
+			c.flags = f
+		case "#n":
+			name, ok := v.(string)
+			if !ok {
+				return nil, errors.Errorf("invalid name of the container: %v", v)
+			}
+			c.name = name
+		}
+	}
+
+	c.path = joinPath(parent, c.name)
+	if c.name == "" && parent != nil {
+		c.path = joinPath(parent, strconv.Itoa(len(parent.content)))
+	}
+	l.engine.containers[c.path] = c
+
+	for _, token := range arr {
+		obj, err := l.object(token, c)
+		if err != nil {
+			return nil, err
+		}
+
+		c.content = append(c.content, obj)
+		if sub, ok := obj.(*container); ok && sub.name != "" {
+			c.named[sub.name] = sub
+		}
+	}
+
+	for k, v := range extra {
+		if k == "#f" || k == "#n" {
+			continue
+		}
+
+		sub, ok := v.([]interface{})
+		if !ok {
+			return nil, errors.Errorf("invalid named content: %s", k)
+		}
+
+		nc, err := l.container(sub, c, k)
+		if err != nil {
+			return nil, err
+		}
+		c.named[k] = nc
+	}
+
+	return c, nil
+}
+
+// joinPath of the container and its child
+func joinPath(parent *container, name string) string {
+	if parent == nil {
+		return name
+	} else if parent.path == "" {
+		return name
+	}
+
+	return parent.path + "." + name
+}
+
+// object of the json token in the container
+func (l *jsonLoader) object(token interface{}, c *container) (interface{}, error) {
+	switch t := token.(type) {
+	case json.Number:
+		if strings.ContainsAny(string(t), ".eE") {
+			f, err := t.Float64()
+			return value{f}, err
+		}
+		i, err := t.Int64()
+		return value{int(i)}, err
+	case bool:
+		return value{t}, nil
+	case string:
+		switch {
+		case strings.HasPrefix(t, "^"):
+			return value{t[1:]}, nil
+		case t == "\n":
+			return value{t}, nil
+		case t == "<>":
+			return glue{}, nil
+		case t == "void":
+			return void{}, nil
+		case commands[t]:
+			return command(t), nil
+		}
+
+		if _, ok := natives[t]; ok {
+			return native(t), nil
+		}
+		return nil, errors.Errorf("unsupported ink json: %s", t)
+	case []interface{}:
+		return l.container(t, c, "")
+	case map[string]interface{}:
+		return l.dict(t, c)
+	}
+
+	return nil, errors.Errorf("unsupported ink json: %v", token)
+}
+
+// dict object of the json, which is a divert, choice point or variable
+func (l *jsonLoader) dict(m map[string]interface{}, c *container) (interface{}, error) {
+	str := func(key string) (string, error) {
+		s, ok := m[key].(string)
+		if !ok {
+			return "", errors.Errorf("invalid %s of the ink json: %v", key, m[key])
+		}
+		return s, nil
+	}
+
+	if _, ok := m["^->"]; ok {
+		path, err := str("^->")
+		return value{DivertTarget(path)}, err
+	}
+
+	if _, ok := m["^var"]; ok {
+		name, err := str("^var")
+		if err != nil {
+			return nil, err
+		}
+
+		n, ok := m["ci"].(json.Number)
+		ci, err := strconv.Atoi(string(n))
+		if !ok || err != nil {
+			return nil, errors.Errorf("invalid ci of the ink json: %v", m["ci"])
+		}
+		return value{varPointer{name: name, ci: ci}}, nil
+	}
+
+	for _, key := range []string{"->", "f()", "->t->", "x()"} {
+		if _, ok := m[key]; !ok {
+			continue
+		}
+
+		path, err := str(key)
+		if err != nil {
+			return nil, err
+		}
+
+		d := &jsonDivert{path: path, cond: m["c"] == true, variable: m["var"] == true}
+		switch key {
+		case "f()":
+			d.push, d.kind = true, pushFunction
+		case "->t->":
+			d.push, d.kind = true, pushTunnel
+		case "x()":
+			d.external = true
+			if n, ok := m["exArgs"].(json.Number); ok {
+				d.args, _ = strconv.Atoi(string(n))
+			}
+		}
+
+		if !d.variable && !d.external {
+			l.resolve(func() (err error) {
+				d.target, err = l.engine.pointer(c, d.path)
+				return
+			})
+		}
+		return d, nil
+	}
+
+	if _, ok := m["*"]; ok {
+		path, err := str("*")
+		if err != nil {
+			return nil, err
+		}
+
+		cp := &choicePoint{}
+		if n, ok := m["flg"].(json.Number); ok {
+			cp.flags, _ = strconv.Atoi(string(n))
+		}
+
+		l.resolve(func() error {
+			target, err := l.engine.resolve(c, path)
+			if err != nil {
+				return err
+			}
+			cp.path = target.path
+			return nil
+		})
+		return cp, nil
+	}
+
+	if _, ok := m["VAR?"]; ok {
+		name, err := str("VAR?")
+		return &varRef{name: name}, err
+	}
+
+	if _, ok := m["CNT?"]; ok {
+		path, err := str("CNT?")
+		if err != nil {
+			return nil, err
+		}
+
+		r := &varRef{}
+		l.resolve(func() (err error) {
+			r.count, err = l.engine.resolve(c, path)
+			return
+		})
+		return r, nil
+	}
+
+	if _, ok := m["VAR="]; ok {
+		name, err := str("VAR=")
+		return &varAssign{name: name, global: true, decl: m["re"] == nil}, err
+	}
+
+	if _, ok := m["temp="]; ok {
+		name, err := str("temp=")
+		return &varAssign{name: name, decl: m["re"] == nil}, err
+	}
+
+	if _, ok := m["#"]; ok {
+		text, err := str("#")
+		return tag{text: text}, err
+	}
+
+	if v, ok := m["list"]; ok {
+		l, err := listValue(v, m["origins"])
+		return value{l}, err
+	}
+
+	return nil, errors.Errorf("unsupported ink json: %v", m)
+}
+
+// listValue of the json: {"list": {"colors.red": 1}, "origins": ["colors"]},
+// the origins are only given for the empty list
+func listValue(items, origins interface{}) (List, error) {
+	m, ok := items.(map[string]interface{})
+	if !ok {
+		return List{}, errors.Errorf("invalid list of the ink json: %v", items)
+	}
+
+	var list []ListItem
+	for k, v := range m {
+		num, ok := v.(json.Number)
+		i := strings.Index(k, ".")
+		if !ok || i < 0 {
+			return List{}, errors.Errorf("invalid list item of the ink json: %s", k)
+		}
+
+		n, err := strconv.Atoi(string(num))
+		if err != nil {
+			return List{}, errors.Errorf("invalid list item of the ink json: %s", k)
+		}
+		list = append(list, ListItem{Origin: k[:i], Name: k[i+1:], Value: n})
+	}
+
+	var names []string
+	arr, _ := origins.([]interface{})
+	for _, o := range arr {
+		if name, ok := o.(string); ok {
+			names = append(names, name)
+		}
+	}
+
+	return newList(list, names...), nil
+}
+
+// resolve the paths after loading
+func (l *jsonLoader) resolve(fn func() error) {
+	l.pending = append(l.pending, fn)
+}
+
+// resolve the path of the container, the relative one starts with "."
+// and is resolved from the container of the object
+func (e *engine) resolve(from *container, path string) (*container, error) {
+	c, idx, err := e.content(from, path)
+	if err != nil {
+		return nil, err
+	}
+
+	if idx >= 0 {
+		sub, ok := c.content[idx].(*container)
+		if !ok {
+			return nil, errors.Errorf("target is not a container: %s", path)
+		}
+		return sub, nil
+	}
+
+	return c, nil
+}
+
+// pointer of the divert's target, to the indexed content
+// or the start of the container
+func (e *engine) pointer(from *container, path string) (pointer, error) {
+	c, idx, err := e.content(from, path)
+	if err != nil {
+		return pointer{}, err
+	}
+
+	if idx < 0 {
+		idx = 0
+	}
+	return pointer{c: c, i: idx}, nil
+}
+
+// content of the path, which is the container and index of its content,
+// the index is -1 when the path is the container itself
+func (e *engine) content(from *container, path string) (*container, int, error) {
+	c := e.root
+	comps := strings.Split(path, ".")
+	if strings.HasPrefix(path, ".") {
+		c, comps = from, comps[1:]
+		// the object's relative path starts from its parent, which is skipped
+		if len(comps) > 0 && comps[0] == "^" {
+			comps = comps[1:]
+		}
+	}
+
+	for i, comp := range comps {
+		switch {
+		case comp == "^":
+			c = c.parent
+		case comp == "":
+		default:
+			if idx, err := strconv.Atoi(comp); err == nil {
+				if idx < 0 || idx >= len(c.content) {
+					return nil, 0, errors.Errorf("can not find the content: %s", path)
+				}
+				sub, ok := c.content[idx].(*container)
+				if !ok {
+					// the last one could be the content of the container
+					if i == len(comps)-1 {
+						return c, idx, nil
+					}
+					return nil, 0, errors.Errorf("can not find the content: %s", path)
+				}
+				c = sub
+				continue
+			}
+
+			sub, ok := c.named[comp]
+			if !ok {
+				return nil, 0, errors.Errorf("can not find the content: %s", path)
+			}
+			c = sub
+		}
+
+		if c == nil {
+			return nil, 0, errors.Errorf("can not find the content: %s", path)
+		}
+	}
+
+	return c, -1, nil
+}
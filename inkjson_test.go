@@ -0,0 +1,121 @@
+package goink
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// compiled by inklecate from:
+//
+//	VAR gold = 2
+//	Hello, you have {gold} coins. #greet
+//	-> shop
+//	== shop
+//	Welcome<>
+//	 to the shop.
+//	* [Buy a hat]
+//	  ~ gold = gold - 1
+//	  You buy a hat.
+//	* {gold > 5} [Buy a horse] -> END
+//	* Leave[] the shop.
+//	- You have {gold} coins left. {shop}
+//	-> END
+const shopJSON = `{"inkVersion":21,"root":[["^Hello, you have ","ev",{"VAR?":"gold"},"out","/ev","^ coins. ","#","^greet","/#","\n",{"->":"shop"},["done",{"#f":5,"#n":"g-0"}],null],"done",{
+"shop":[["^Welcome","<>","\n","^ to the shop.","\n",
+"ev","str","^Buy a hat","/str","/ev",{"*":".^.c-0","flg":20},
+"ev","str","^Buy a horse","/str",{"VAR?":"gold"},5,">","/ev",{"*":".^.c-1","flg":21},
+"ev",{"^->":"shop.0.$r1"},{"temp=":"$r"},"str",{"->":".^.s"},[{"#n":"$r1"}],"/str","/ev",{"*":".^.c-2","flg":18},
+{"c-0":["\n","ev",{"VAR?":"gold"},1,"-","/ev",{"VAR=":"gold","re":true},"^You buy a hat.","\n",{"->":".^.^.g-0"},{"#f":5}],
+"c-1":["\n","end",{"#f":5}],
+"c-2":["ev",{"^->":"shop.0.c-2.$r2"},"/ev",{"temp=":"$r"},{"->":".^.^.s"},[{"#n":"$r2"}],"^ the shop.","\n",{"->":".^.^.g-0"},{"#f":5}],
+"s":["^Leave",{"->":"$r","var":true},null],
+"g-0":["^You have ","ev",{"VAR?":"gold"},"out","/ev","^ coins left. ","ev",{"CNT?":"shop"},"out","/ev","\n","end",null]}],{"#f":5}],
+"global decl":["ev",2,{"VAR=":"gold"},"/ev","end",null]}],"listDefs":{}}`
+
+func TestLoadJSON(t *testing.T) {
+	story, err := LoadJSON([]byte(shopJSON))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, story.defaults["gold"])
+
+	ctx := NewContext()
+	sec, e := story.Resume(ctx)
+	assert.Nil(t, e)
+	assert.Equal(t, "Hello, you have 2 coins.\nWelcome to the shop.", sec.Text)
+	assert.Equal(t, []string{"greet"}, sec.Tags)
+	assert.Equal(t, []string{"Buy a hat", "Leave"}, sec.Opts)
+	assert.False(t, sec.End)
+
+	// waiting for the choice
+	sec, e = story.Resume(ctx)
+	assert.Nil(t, e)
+	assert.Equal(t, []string{"Buy a hat", "Leave"}, sec.Opts)
+
+	_, e = story.Pick(ctx, 2)
+	assert.Contains(t, e.Error(), "no option available")
+
+	leave := *ctx
+	leave.Vars = copy(ctx.Vars)
+	sec, e = story.Pick(ctx, 0)
+	assert.Nil(t, e)
+	assert.Equal(t, "You buy a hat.\nYou have 1 coins left. 1", sec.Text)
+	assert.True(t, sec.End)
+	assert.Equal(t, 1, ctx.Vars["gold"])
+	assert.Equal(t, 1, ctx.Turns)
+
+	sec, e = story.Pick(&leave, 1)
+	assert.Nil(t, e)
+	assert.Equal(t, "Leave the shop.\nYou have 2 coins left. 1", sec.Text)
+	assert.Equal(t, 1, leave.Visits["shop.0.c-2"])
+
+	_, e = story.Pick(ctx, 0)
+	assert.Contains(t, e.Error(), "current line is not an option")
+
+	_, e = story.Explain(ctx)
+	assert.Contains(t, e.Error(), "can not explain the compiled story")
+}
+
+func TestLoadJSONErrors(t *testing.T) {
+	_, err := LoadJSON([]byte(`{"inkVersion":10,"root":[]}`))
+	assert.Equal(t, "ink version 10 is not supported, it should be 19 to 21", err.Error())
+
+	_, err = LoadJSON([]byte(`{"inkVersion":21,"root":[[{"list":{"red":1}},null],"done",null],"listDefs":{"colors":{"red":1}}}`))
+	assert.Equal(t, "invalid list item of the ink json: red", err.Error())
+
+	_, err = LoadJSON([]byte(`{"inkVersion":21,"root":[[{"->":"missing"},null],"done",null]}`))
+	assert.Equal(t, "can not find the content: missing", err.Error())
+
+	_, err = LoadJSON([]byte(`{"inkVersion":21,"root":[["unknown",null],"done",null]}`))
+	assert.Equal(t, "unsupported ink json: unknown", err.Error())
+
+	_, err = LoadJSON([]byte(`invalid`))
+	assert.Contains(t, err.Error(), "invalid ink json")
+}
+
+func TestLoadJSONMalformed(t *testing.T) {
+	tests := []struct {
+		content string
+		err     string
+	}{
+		{`{"^var":"x"}`, "invalid ci of the ink json: <nil>"},
+		{`{"^var":1,"ci":0}`, "invalid ^var of the ink json: 1"},
+		{`{"^->":1}`, "invalid ^-> of the ink json: 1"},
+		{`{"->":1}`, "invalid -> of the ink json: 1"},
+		{`{"f()":null}`, "invalid f() of the ink json: <nil>"},
+		{`{"*":5}`, "invalid * of the ink json: 5"},
+		{`{"VAR?":1}`, "invalid VAR? of the ink json: 1"},
+		{`{"CNT?":true}`, "invalid CNT? of the ink json: true"},
+		{`{"VAR=":1}`, "invalid VAR= of the ink json: 1"},
+		{`{"temp=":[]}`, "invalid temp= of the ink json: []"},
+		{`{"#":2}`, "invalid # of the ink json: 2"},
+		{`[{"#f":"x"}]`, "invalid flags of the container: x"},
+		{`[{"#n":3}]`, "invalid name of the container: 3"},
+	}
+
+	for _, tt := range tests {
+		_, err := LoadJSON([]byte(`{"inkVersion":21,"root":[[` + tt.content + `,null],"done",null]}`))
+		if assert.NotNil(t, err, tt.content) {
+			assert.Equal(t, tt.err, err.Error(), tt.content)
+		}
+	}
+}
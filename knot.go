@@ -8,8 +8,12 @@ import (
 )
 
 var (
-	knotReg   = regexp.MustCompile(`(^\={2,})(\s+)(\w+)`)
-	stitchReg = regexp.MustCompile(`(^\=)(\s+)(\w+)`)
+	knotReg     = regexp.MustCompile(`(^\={2,})(\s+)(\w+)\s*(\((.*)\))?`)
+	stitchReg   = regexp.MustCompile(`(^\=)(\s+)(\w+)\s*(\((.*)\))?`)
+	functionReg = regexp.MustCompile(`^\={2,}\s*function\s+(\w+)\s*(\((.*)\))?\s*\=*$`)
+
+	// max depth of the function calling
+	maxCallDepth = 128
 )
 
 // readKnot parse and insert a new knot into story
@@ -18,7 +22,12 @@ func readKnot(s *Story, input string, ln int) error {
 	if result != nil {
 		name := strings.ToLower(result[3])
 
-		k := &knot{base: &base{story: s, ln: ln}, name: name}
+		params, err := parseParams(result[5])
+		if err != nil {
+			return err
+		}
+
+		k := &knot{base: &base{story: s, ln: ln, file: s.file}, name: name, params: params}
 		s.knots = append(s.knots, k)
 		k.path = name
 
@@ -34,6 +43,115 @@ func readKnot(s *Story, input string, ln int) error {
 	return errNotMatch
 }
 
+// readFunction parse and insert a new function into story
+func readFunction(s *Story, input string, ln int) error {
+	result := functionReg.FindStringSubmatch(input)
+	if result == nil {
+		return errNotMatch
+	}
+
+	name := result[1]
+	k := &knot{base: &base{story: s, ln: ln, file: s.file}, name: strings.ToLower(name), function: true}
+	k.path = k.name
+
+	if _, ok := s.paths[k.path]; ok {
+		return errors.Errorf("conflict function name: %s", name)
+	}
+
+	params, err := parseParams(result[3])
+	if err != nil {
+		return err
+	}
+
+	// arguments of the function are passed by value
+	for _, p := range params {
+		if p.ref {
+			return errors.Errorf("function can not have ref parameter: %s", p.name)
+		}
+	}
+	k.params = params
+
+	// the implicit return at the end of function
+	k.ret = &logic{base: &base{story: s, parent: k, ln: ln, file: s.file, path: k.path + PathSplit + "r"}, ret: true}
+
+	s.knots = append(s.knots, k)
+	s.paths[k.path] = k
+	s.funcs[k.name] = s.function(k)
+
+	s.current = k
+	return nil
+}
+
+// function returns the calling func of the knot, which is used by exprc
+func (s *Story) function(k *knot) func(args ...interface{}) interface{} {
+	return s.callback(func(args ...interface{}) (interface{}, error) {
+		return s.call(k, args)
+	})
+}
+
+// call the function with arguments, and returns its value,
+// the output of the function is pushed into story's output
+func (s *Story) call(k *knot, args []interface{}) (interface{}, error) {
+	if len(args) != len(k.params) {
+		return nil, errors.Errorf("function %s needs %d arguments, but got %d", k.name, len(k.params), len(args))
+	}
+
+	if s.depth >= maxCallDepth {
+		return nil, errors.Errorf("function calling is too deep: %s", k.name)
+	}
+
+	// function has its own temporary variables
+	temps, scope := s.temps, s.scope
+	s.depth++
+	defer func() {
+		s.temps, s.scope = temps, scope
+		s.depth--
+		s.touch()
+	}()
+
+	s.temps = make(map[string]interface{})
+	s.scope = k.Path()
+	for i, p := range k.params {
+		s.temps[p.name] = args[i]
+	}
+	s.touch()
+
+	sec := &Section{}
+	mark := len(s.output)
+	node := k.next
+	if node == nil {
+		node = k.ret
+	}
+
+	for {
+		switch n := node.(type) {
+		case *logic:
+			if n.ret {
+				v, err := n.eval()
+				if err != nil {
+					return nil, err
+				}
+
+				if sec.Text != "" {
+					s.output = append(s.output, sec.Text)
+				}
+				return v, nil
+			}
+		case CanNext:
+		default:
+			return nil, errors.Errorf("function can only have contents and logic: %s", k.name)
+		}
+
+		next, err := s.step(node, sec)
+		if err != nil {
+			return nil, errorOf(err, node)
+		}
+		sec.add(s.flush(mark), nil)
+
+		node = next
+	}
+}
+
 // knot is a container of story's content
 type knot struct {
 	*base
@@ -43,6 +161,52 @@ type knot struct {
 	next     Node
 
 	tags []string
+
+	params []param
+
+	function bool
+	ret      Node // implicit return of the function
+}
+
+// param of the knot, stitch or function
+type param struct {
+	name string
+	ref  bool // passed by reference
+}
+
+// parseParams parses the parameters: a, ref b, ...
+func parseParams(input string) (params []param, err error) {
+	for _, p := range strings.Split(input, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+
+		res := paramReg.FindStringSubmatch(p)
+		if res == nil {
+			return nil, errors.Errorf("invalid parameter name: %s", p)
+		}
+
+		for _, e := range params {
+			if e.name == res[2] {
+				return nil, errors.Errorf("conflict parameter name: %s", res[2])
+			}
+		}
+		params = append(params, param{name: res[2], ref: res[1] != ""})
+	}
+
+	return
+}
+
+// paramsOf the divert target
+func paramsOf(node Node) []param {
+	switch n := node.(type) {
+	case *knot:
+		return n.params
+	case *stitch:
+		return n.params
+	}
+
+	return nil
 }
 
 // Path of the knot
@@ -76,12 +240,12 @@ func (k *knot) Next() (Node, error) {
 }
 
 // Render the content of knot... should be both empty
-func (k *knot) Render() (output string, tags []string) {
-	return "", k.tags
+func (k *knot) Render() (output string, tags []string, err error) {
+	return "", k.tags, nil
 }
 
 func (k *knot) PostParsing() error {
-	if k.next == nil {
+	if k.next == nil && !k.function {
 		return errors.New("current knot can not go next")
 	}
 	return nil
@@ -114,10 +278,20 @@ func readStitch(s *Story, input string, ln int) error {
 			return errors.Errorf("conflict stitch name: %s", name)
 		}
 
-		stitch := &stitch{base: &base{story: s, ln: ln}, name: name, knot: k}
+		params, err := parseParams(result[5])
+		if err != nil {
+			return err
+		}
+
+		stitch := &stitch{base: &base{story: s, ln: ln, file: s.file}, name: name, knot: k, params: params}
 		k.stitches = append(k.stitches, stitch)
 		s.current = stitch
 
+		// knot without content goes into its first stitch
+		if k.next == nil && len(k.stitches) == 1 {
+			k.next = stitch
+		}
+
 		stitch.path = k.Path() + PathSplit + name
 		s.paths[stitch.path] = stitch
 
@@ -133,6 +307,8 @@ type stitch struct {
 	knot *knot
 	name string
 
+	params []param
+
 	next Node
 	tags []string
 }
@@ -158,8 +334,8 @@ func (s *stitch) Next() (Node, error) {
 }
 
 // Render the content of stitch... should be both empty
-func (s *stitch) Render() (output string, tags []string) {
-	return "", s.tags
+func (s *stitch) Render() (output string, tags []string, err error) {
+	return "", s.tags, nil
 }
 
 func (s *stitch) PostParsing() error {
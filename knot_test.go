@@ -94,6 +94,35 @@ func TestStitchParsing(t *testing.T) {
 	assert.Contains(t, err.Error(), "conflict stitch")
 }
 
+func TestKnotFirstStitch(t *testing.T) {
+	input := `
+	-> shop -> hall
+	== shop
+	= counter
+	At the counter. ->->
+	= back
+	At the back. ->->
+	== hall
+	In the hall. -> END
+	= stairs
+	On the stairs. -> END
+	`
+
+	story := Default()
+	err := story.Parse(input)
+	assert.Nil(t, err)
+	assert.Nil(t, story.PostParsing())
+
+	// the knot without content flows into its first stitch
+	assert.Equal(t, story.paths["shop__counter"], story.paths["shop"].(*knot).next)
+	assert.Equal(t, story.paths["hall__i"], story.paths["hall"].(*knot).next)
+
+	sec, err := story.Resume(NewContext())
+	assert.Nil(t, err)
+	assert.Equal(t, "At the counter.\nIn the hall.", sec.Text)
+	assert.True(t, sec.End)
+}
+
 func TestKnotAndStitchTagsParsing(t *testing.T) {
 	input := `
 	-> knot_a
@@ -146,3 +175,261 @@ func TestKnotAndStitchPostParsing(t *testing.T) {
 	errs = story.PostParsing()
 	assert.Contains(t, errs[0].Error(), "can not go next")
 }
+
+func TestFunctionParsing(t *testing.T) {
+	input := `
+	VAR gold = 10
+	-> END
+	=== function can_afford(cost, discount) ===
+	~ return gold >= cost - discount
+	=== function noop ===
+	`
+
+	story := Default()
+	err := story.Parse(input)
+	assert.Nil(t, err)
+	assert.Nil(t, story.PostParsing())
+
+	fn := story.paths["can_afford"].(*knot)
+	assert.True(t, fn.function)
+	assert.Equal(t, []param{{name: "cost"}, {name: "discount"}}, fn.params)
+	assert.NotNil(t, story.funcs["can_afford"])
+	assert.True(t, story.paths["noop"].(*knot).function)
+
+	input = `
+	== function f(a, b c) ==
+	~ return 1
+	`
+	story = Default()
+	err = story.Parse(input)
+	assert.Contains(t, err.Error(), "invalid parameter name")
+
+	input = `
+	== function f ==
+	~ return 1
+	== function f ==
+	`
+	story = Default()
+	err = story.Parse(input)
+	assert.Contains(t, err.Error(), "conflict function name")
+
+	input = `
+	~ return 1
+	`
+	story = Default()
+	err = story.Parse(input)
+	assert.Nil(t, err)
+
+	errs := story.PostParsing()
+	assert.Contains(t, errs[0].Error(), "return is out of function")
+}
+
+func TestFunctionCalling(t *testing.T) {
+	input := `
+	VAR gold = 5
+	VAR calls = 0
+	-> shop
+	== shop
+	You have {gold} coins, {describe(gold)}.
+	~ pay(3)
+	* {can_afford(2)} [Buy cheap] -> shop
+	* {can_afford(10)} [Buy expensive] -> shop
+	* [Factorial] {fact(5)} -> END
+
+	=== function can_afford(cost) ===
+	~ calls++
+	~ return gold >= cost
+
+	=== function describe(x) ===
+	{ x > 3:
+	  ~ return "rich"
+	}
+	~ return "poor"
+
+	=== function pay(cost) ===
+	~ temp left = gold - cost
+	You paid {cost}, {left} left.
+	~ gold = left
+
+	=== function fact(n) ===
+	{ n <= 1:
+	  ~ return 1
+	}
+	~ return n * fact(n - 1)
+	`
+
+	story := Default()
+	err := story.Parse(input)
+	assert.Nil(t, err)
+	assert.Nil(t, story.PostParsing())
+
+	ctx := NewContext()
+	sec, err := story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "You have 5 coins, rich.\nYou paid 3, 2 left.", sec.Text)
+	assert.Equal(t, []string{"Buy cheap", "Factorial"}, sec.Opts)
+	assert.Equal(t, 2, ctx.Vars["gold"])
+	assert.Equal(t, 2, ctx.Vars["calls"])
+
+	// calling a function is not a visit
+	_, ok := ctx.Vars["can_afford"]
+	assert.False(t, ok)
+
+	sec, err = story.Pick(ctx, 1)
+	assert.Nil(t, err)
+	assert.Contains(t, sec.Text, "120")
+}
+
+func TestFunctionErrors(t *testing.T) {
+	input := `
+	{f(1, 2)}
+	-> END
+	== function f(a) ==
+	~ return a
+	`
+	story := Default()
+	err := story.Parse(input)
+	assert.Nil(t, err)
+	_, err = story.Resume(NewContext())
+	assert.Equal(t, "rendering failed: start__i: function f needs 1 arguments, but got 2 ln: 2", err.Error())
+
+	input = `
+	~ loop()
+	-> END
+	== function loop ==
+	~ return loop()
+	`
+	story = Default()
+	err = story.Parse(input)
+	assert.Nil(t, err)
+
+	_, err = story.Resume(NewContext())
+	assert.Contains(t, err.Error(), "too deep")
+
+	input = `
+	-> f
+	== function f ==
+	~ return 1
+	`
+	story = Default()
+	err = story.Parse(input)
+	assert.Nil(t, err)
+
+	_, err = story.Resume(NewContext())
+	assert.Contains(t, err.Error(), "can not divert to function")
+
+	input = `
+	~ f()
+	-> END
+	== function f ==
+	* choice
+	`
+	story = Default()
+	err = story.Parse(input)
+	assert.Nil(t, err)
+
+	_, err = story.Resume(NewContext())
+	assert.Contains(t, err.Error(), "function can only have contents and logic")
+}
+
+func TestKnotParameters(t *testing.T) {
+	input := `
+	VAR gold = 10
+	-> greet("guard", 3)
+	== greet(who, mood)
+	Hello {who}, mood {mood}.
+	* [Go] -> shop.counter(mood + 1)
+	== shop
+	= counter(x)
+	Counter {x}.
+	-> pay(gold, x)
+	== pay(ref coins, cost)
+	~ coins -= cost
+	-> spend(coins, 1)
+	== spend(ref money, n)
+	~ money = money - n
+	You have {money} coins. -> END
+	`
+
+	story := Default()
+	err := story.Parse(input)
+	assert.Nil(t, err)
+	assert.Nil(t, story.PostParsing())
+
+	greet := story.paths["greet"].(*knot)
+	assert.Equal(t, []param{{name: "who"}, {name: "mood"}}, greet.params)
+	assert.Equal(t, []param{{name: "coins", ref: true}, {name: "cost"}}, story.paths["pay"].(*knot).params)
+	assert.Equal(t, []param{{name: "x"}}, story.paths["shop__counter"].(*stitch).params)
+
+	ctx := NewContext()
+	sec, err := story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "Hello guard, mood 3.", sec.Text)
+	assert.Equal(t, "guard", ctx.Temps["who"])
+	assert.Equal(t, 3, ctx.Temps["mood"])
+
+	sec, err = story.Pick(ctx, 0)
+	assert.Nil(t, err)
+	assert.Contains(t, sec.Text, "Counter 4.\nYou have 5 coins.")
+	assert.Equal(t, 5, ctx.Vars["gold"])
+
+	// the knot's parameters are kept in its first stitch
+	input = `
+	-> meet("guard")
+	== meet(who)
+	= hello
+	Hello {who}. -> END
+	`
+
+	story = Default()
+	err = story.Parse(input)
+	assert.Nil(t, err)
+	assert.Nil(t, story.PostParsing())
+
+	sec, err = story.Resume(NewContext())
+	assert.Nil(t, err)
+	assert.Equal(t, "Hello guard.", sec.Text)
+}
+
+func TestKnotParameterErrors(t *testing.T) {
+	input := `
+	-> greet("guard")
+	== greet(who, mood)
+	Hello {who}. -> END
+	`
+
+	story := Default()
+	err := story.Parse(input)
+	assert.Nil(t, err)
+	errs := story.PostParsing()
+	assert.Contains(t, errs[0].Error(), "divert greet needs 2 arguments, but got 1")
+
+	input = `
+	== greet(who, who)
+	`
+	story = Default()
+	err = story.Parse(input)
+	assert.Contains(t, err.Error(), "conflict parameter name")
+
+	input = `
+	== function f(ref a) ==
+	~ return a
+	`
+	story = Default()
+	err = story.Parse(input)
+	assert.Contains(t, err.Error(), "function can not have ref parameter")
+
+	input = `
+	-> pay(3)
+	== pay(ref coins)
+	~ coins = 0
+	-> END
+	`
+	story = Default()
+	err = story.Parse(input)
+	assert.Nil(t, err)
+	assert.Nil(t, story.PostParsing())
+
+	_, err = story.Resume(NewContext())
+	assert.Contains(t, err.Error(), "ref argument should be a global variable: 3")
+}
@@ -11,17 +11,19 @@ import (
 var (
 	commentReg = regexp.MustCompile(`^(.*?)\/\/(.*)`)
 	tagReg     = regexp.MustCompile(`^(.*)(\#)(.+)$`)
-	divertReg  = regexp.MustCompile(`^(.*)(\-\>)(.+)$`)
 	varReg     = regexp.MustCompile(`^\s*(VAR|var)\s+([_a-z]\w*)\s*\=\s*(.+)$`)
+	constReg   = regexp.MustCompile(`^\s*CONST\s+([_a-zA-Z]\w*)\s*\=\s*(.+)$`)
 	strReg     = regexp.MustCompile(`\"(.+)\"`)
 
 	glueStartReg = regexp.MustCompile(`^\s*\<\>(.+)`)
 	glueEndReg   = regexp.MustCompile(`(.+)\<\>\s*$`)
 
-	gatherReg = regexp.MustCompile(`^((-\s*)+)([^>].+)`)
+	gatherReg = regexp.MustCompile(`^((-\s*)+)([^>].*)?$`)
 	labelReg  = regexp.MustCompile(`^\s*\((.+)\)(.*)`)
 
 	validNameReg = regexp.MustCompile(`^[a-zA-Z_]\w*$`)
+	argsReg      = regexp.MustCompile(`^([^\(]*)\((.*)\)$`)
+	paramReg     = regexp.MustCompile(`^(ref\s+)?([a-zA-Z_]\w*)$`)
 	validPathReg = regexp.MustCompile(`^[a-zA-Z_]\w*(\.\w+)*$`)
 	// illegalGatherReg = regexp.MustCompile(`\-\-\>`)
 )
@@ -36,7 +38,7 @@ func readLine(s *Story, input string, ln int) error {
 	// tags and comments only inline
 	// try to find the parent knot or divert
 	// and add tags
-	if len(l.tags) > 0 && l.divert == "" && l.text == "" {
+	if len(l.tags) > 0 && l.divert == nil && len(l.tunnels) == 0 && !l.back && l.text == "" {
 		switch p := s.current.(type) {
 		case *knot:
 			p.tags = append(p.tags, l.tags...)
@@ -48,8 +50,13 @@ func readLine(s *Story, input string, ln int) error {
 		}
 	}
 
+	if err := l.parseContent(); err != nil {
+		return err
+	}
+
 	l.story = s
 	l.ln = ln
+	l.file = s.file
 	l.parent = s.current
 
 	l.path = s.current.Path() + PathSplit + "i"
@@ -90,14 +97,12 @@ func newLine(input string) (*line, error) {
 		}
 	}
 
-	// divert | spaces trimmed
-	if res := divertReg.FindStringSubmatch(input); res != nil {
-		input = res[1]
-		d := strings.TrimSpace(res[3])
-		if valid := validPathReg.FindString(d); valid == "" {
-			return nil, errors.Errorf("invalid divert name: %s", d)
+	// divert | tunnel | spaces trimmed
+	if idx := indexTop(input, "->"); idx >= 0 {
+		if err := i.parseDivert(input[idx+2:]); err != nil {
+			return nil, err
 		}
-		i.divert = strings.ToLower(strings.TrimSpace(res[3]))
+		input = input[:idx]
 	}
 
 	// handle glue at rendering action
@@ -112,10 +117,9 @@ func newLine(input string) (*line, error) {
 	} */
 
 	// text | spaces not trimmed
+	// content parsing is done after label and condition parsing
 	i.text = input
 
-	// TODO: exprc parsing
-
 	return i, nil
 }
 
@@ -128,17 +132,42 @@ type line struct {
 
 	comment string
 	tags    []string
-	divert  string
+	divert  *dest
+
+	tunnels []*dest // -> tunnel ->
+	back    bool    // ->->
 
 	// glueStart bool
 	// glueEnd   bool
 
-	text string
+	text    string
+	content content
+	conds   int // count of the leading segments which are conditions
+
+	labelled bool // (label) of the gather or option
 }
 
 // PostParsing of line
 func (l *line) PostParsing() error {
-	if n, err := l.Next(); err != nil {
+	for _, d := range append(l.tunnels, l.divert) {
+		if d == nil {
+			continue
+		}
+		if err := l.check(d); err != nil && !l.declared(d) {
+			return err
+		}
+	}
+
+	if l.divert != nil {
+		return nil
+	}
+
+	// return to the tunnel's caller
+	if l.back {
+		return nil
+	}
+
+	if n, err := l.forward(len(l.tunnels)); err != nil {
 		return err
 	} else if n == nil {
 		return errors.New("next content is nil")
@@ -154,13 +183,39 @@ func (l *line) SetNext(obj Node) {
 
 // Next content of the inline
 func (l *line) Next() (Node, error) {
-	// divert
-	if l.divert != "" {
-		if target := l.story.divert(l.divert, l); target != nil {
-			return target, nil
+	// ->-> || ->-> divert
+	if l.back {
+		f, err := l.story.pop()
+		if err != nil {
+			return nil, err
+		}
+
+		if l.divert != nil {
+			return l.jump(l.divert)
+		}
+
+		return lineOf(l.story.paths[f.Path]).forward(f.Step)
+	}
+
+	return l.forward(0)
+}
+
+// forward from the step of the tunnels, and divert at last
+func (l *line) forward(step int) (Node, error) {
+	// tunnel
+	if step < len(l.tunnels) {
+		target, err := l.jump(l.tunnels[step])
+		if err != nil {
+			return nil, err
 		}
 
-		return nil, errors.Errorf("can not find the divert: %s", l.divert)
+		l.story.push(l, step+1)
+		return target, nil
+	}
+
+	// divert
+	if l.divert != nil {
+		return l.jump(l.divert)
 	}
 
 	// fallback to next
@@ -168,13 +223,211 @@ func (l *line) Next() (Node, error) {
 		return l.next, nil
 	}
 
-	// fallback to gather
-	p := l.parent
+	return following(l)
+}
+
+// target of the divert, or the divert target held by the variable
+func (l *line) target(d *dest) (Node, error) {
+	target := l.story.divert(d.path, l)
+	if target == nil {
+		if v, ok := l.story.variable(d.name); ok {
+			path, ok := v.(DivertTarget)
+			if !ok {
+				return nil, errors.Errorf("variable is not a divert target: %s", d.name)
+			}
+			target = l.story.divert(string(path), l)
+		}
+	}
+
+	if target != nil {
+		if k, ok := target.(*knot); ok && k.function {
+			return nil, errors.Errorf("can not divert to function: %s", d.path)
+		}
+		return target, nil
+	}
+
+	return nil, errors.Errorf("can not find the divert: %s", d.path)
+}
+
+// check the target and arguments of the divert
+func (l *line) check(d *dest) error {
+	target, err := l.target(d)
+	if err != nil {
+		return err
+	}
+
+	if ps := paramsOf(target); len(ps) != len(d.args) {
+		return errors.Errorf("divert %s needs %d arguments, but got %d", d.path, len(ps), len(d.args))
+	}
+
+	return nil
+}
+
+// jump to the target of the divert, and bind the arguments
+func (l *line) jump(d *dest) (Node, error) {
+	if err := l.check(d); err != nil {
+		return nil, err
+	}
+
+	target, _ := l.target(d)
+	if err := l.story.bind(paramsOf(target), d.args); err != nil {
+		return nil, err
+	}
+
+	return target, nil
+}
+
+// declared checks the divert is a parameter or temporary variable
+// of the scope, whose value is only known at runtime
+func (l *line) declared(d *dest) bool {
+	return l.story.local(d.name, l)
+}
+
+// local variable of the node's scope, which is a parameter
+// of the knot or stitch, or a temporary variable
+func (s *Story) local(name string, node Node) bool {
+	return s.locals(node, s.temporaries())[name]
+}
+
+// parse the diverts after the first arrow
+func (l *line) parseDivert(input string) error {
+	input = strings.TrimSpace(input)
+
+	// ->-> || ->-> divert
+	if strings.HasPrefix(input, "->") {
+		l.back = true
+		if input = strings.TrimSpace(input[2:]); input == "" {
+			return nil
+		}
+	}
+
+	parts := splitArrows(input)
+	tunnel := len(parts) > 1 && strings.TrimSpace(parts[len(parts)-1]) == ""
+	if tunnel {
+		parts = parts[:len(parts)-1]
+	}
+
+	var dests []*dest
+	for _, p := range parts {
+		d, err := newDest(p)
+		if err != nil {
+			return err
+		}
+		dests = append(dests, d)
+	}
+
+	if l.back && (tunnel || len(dests) > 1) {
+		return errors.Errorf("invalid tunnel return: ->->%s", input)
+	}
+
+	// -> a -> b -> || -> a -> b
+	if tunnel {
+		l.tunnels = dests
+	} else {
+		l.tunnels = dests[:len(dests)-1]
+		l.divert = dests[len(dests)-1]
+	}
+
+	return nil
+}
+
+// splitArrows splits the diverts by the arrows,
+// which are not in the arguments
+func splitArrows(input string) (parts []string) {
+	depth := 0
+	quoted := false
+	last := 0
+
+	for i := 0; i < len(input); i++ {
+		ch := input[i]
+		if quoted {
+			quoted = ch != '"'
+			continue
+		}
+
+		switch ch {
+		case '"':
+			quoted = true
+		case '(', '{':
+			depth++
+		case ')', '}':
+			depth--
+		case '-':
+			if depth == 0 && strings.HasPrefix(input[i:], "->") {
+				parts = append(parts, input[last:i])
+				last = i + 2
+				i++
+			}
+		}
+	}
+
+	return append(parts, input[last:])
+}
+
+// dest of the divert, with its arguments
+type dest struct {
+	path string
+	name string // as written, which could be a variable
+	args []*exprc
+}
+
+// newDest parses the divert: path || path(arg, ...)
+func newDest(input string) (*dest, error) {
+	input = strings.TrimSpace(input)
+	d := &dest{path: input}
+
+	if res := argsReg.FindStringSubmatch(input); res != nil {
+		d.path = strings.TrimSpace(res[1])
+		if strings.TrimSpace(res[2]) != "" {
+			for _, a := range splitTop(res[2], ',') {
+				c, err := newExprc(strings.TrimSpace(a))
+				if err != nil {
+					return nil, err
+				}
+				d.args = append(d.args, c)
+			}
+		}
+	}
+
+	if valid := validPathReg.FindString(d.path); valid == "" {
+		return nil, errors.Errorf("invalid divert name: %s", input)
+	}
+	d.name, d.path = d.path, strings.ToLower(d.path)
+
+	return d, nil
+}
+
+// lineOf the node, which is a line or embeds a line
+func lineOf(n Node) *line {
+	switch n := n.(type) {
+	case *line:
+		return n
+	case *gather:
+		return n.line
+	case *opt:
+		return n.line
+	}
+
+	return nil
+}
+
+// following node of the one which has no next,
+// it falls back to the gather of the parent options,
+// or the rejoining node of the parent block
+func following(n Node) (Node, error) {
+	p := n.Parent()
 	for p != nil {
-		if c, ok := p.(*options); ok {
+		switch c := p.(type) {
+		case *options:
 			if c.gather != nil {
 				return c.gather, nil
 			}
+		case *branch:
+			return c.block.following()
+		case *knot:
+			if c.function {
+				return c.ret, nil
+			}
 		}
 
 		p = p.Parent()
@@ -183,11 +436,92 @@ func (l *line) Next() (Node, error) {
 	return nil, errors.New("current line can not go next")
 }
 
-func (l *line) Render() (text string, tags []string) {
-	return l.text, l.tags
+// Render the content of the line with story's vars,
+// the leading conditions are tested before rendering
+func (l *line) Render() (text string, tags []string, err error) {
+	if text, err = l.render(l.content[l.conds:]); err != nil {
+		return "", nil, err
+	}
+
+	if l.conds > 0 {
+		text = strings.TrimLeft(text, " \t")
+	}
+	return text, l.tags, nil
+}
+
+// test the leading conditions of the line: {a} {b > 1} text,
+// which are evaluated once when the line is visited
+func (l *line) test() (bool, error) {
+	for _, seg := range l.content[:l.conds] {
+		in, ok := seg.(*inline)
+		if !ok {
+			continue
+		}
+
+		// output of the called functions is dropped
+		mark := len(l.story.output)
+		b, err := l.story.test(in.exprc)
+		l.story.flush(mark)
+		if err != nil {
+			return false, errors.Wrapf(err, "rendering failed: %s", l.Path())
+		} else if !b {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// skip the hidden line, its diverts are not taken
+func (l *line) skip() (Node, error) {
+	if l.next != nil {
+		return l.next, nil
+	}
+	return following(l)
+}
+
+// render the content of the line
+func (l *line) render(c content) (string, error) {
+	text, err := c.render(l)
+	if err != nil {
+		return "", errors.Wrapf(err, "rendering failed: %s", l.Path())
+	}
+
+	return text, nil
 }
 
-func (l *line) parseLabel() error {
+// parse the text into content
+func (l *line) parseContent() (err error) {
+	if l.content, err = parseContent(l.text); err == nil {
+		l.content.index(0)
+		l.conds = l.conditions()
+	}
+	return
+}
+
+// conditions at the beginning of the line, which are the expressions
+// followed by more content: {a} {not b} text, as the ones of the options
+func (l *line) conditions() (n int) {
+	for i, seg := range l.content {
+		if p, ok := seg.(plain); ok && strings.TrimSpace(string(p)) == "" {
+			continue
+		}
+
+		if _, ok := seg.(*inline); !ok {
+			break
+		}
+		n = i + 1
+	}
+
+	// the conditions without content are rendered
+	if n > 0 && l.content[n:].blank() && l.divert == nil && len(l.tunnels) == 0 && !l.back {
+		return 0
+	}
+	return n
+}
+
+// parseLabel of the gather or option, which is the node of the label path
+func (l *line) parseLabel(node Node) error {
 	if res := labelReg.FindStringSubmatch(l.text); res != nil {
 		label := strings.TrimSpace(res[1])
 		if len(label) > 0 {
@@ -205,68 +539,86 @@ func (l *line) parseLabel() error {
 				return errors.Errorf("conflict label name: %s", label)
 			}
 
-			l.story.paths[label] = l
+			l.story.paths[label] = node
 			l.path = label
+			l.labelled = true
 		}
-		l.text = res[2]
+		l.text = strings.TrimLeft(res[2], " \t")
 	}
 
 	return nil
 }
 
-// readGather create and insert a new gather into story
+// readGather create and insert a new gather into story,
+// it gathers the outermost options which are not shallower than it,
+// or continues the flow when there is no such options
 func readGather(s *Story, input string, ln int) error {
 	res := gatherReg.FindStringSubmatch(input)
-	if res != nil {
-		nesting := len(strings.Join(strings.Fields(res[1]), ""))
-		i, err := newLine(res[3])
-		if err != nil {
-			return err
-		}
+	if res == nil {
+		return errNotMatch
+	}
 
-		i.ln = ln
+	nesting := len(strings.Join(strings.Fields(res[1]), ""))
+	i, err := newLine(res[3])
+	if err != nil {
+		return err
+	}
 
-		g := &gather{line: i, nesting: nesting}
-		g.story = s
+	i.ln = ln
+	i.file = s.file
 
-		node := s.current
-		var choices *options
-		for node != nil {
-			if c, ok := node.(*options); ok {
-				if t := nesting - c.nesting; t == 0 {
-					choices = c
-					break
-				}
-			}
+	g := &gather{line: i, nesting: nesting}
+	g.story = s
 
-			node = node.Parent()
+	var choices *options
+	for node := s.current; node != nil; node = node.Parent() {
+		if c, ok := node.(*options); ok {
+			if c.nesting < nesting {
+				break
+			}
+			choices = c
 		}
 
-		if choices != nil && choices.gather == nil {
-			// if gather didn't have label
-			// set the default path
-			if g.path == "" {
-				g.path = choices.Path() + PathSplit + "g"
-				s.paths[g.path] = g
-			}
+		// options out of the branch
+		if _, ok := node.(*branch); ok {
+			break
+		}
+	}
 
-			choices.gather = g
-			s.current = g
-			g.parent = choices
+	if choices != nil && choices.gather == nil {
+		g.path = choices.Path() + PathSplit + "g"
+		s.paths[g.path] = g
 
-			// parsing label
-			if err := i.parseLabel(); err != nil {
-				return err
-			}
-			g.parent = nil // forbid gather from parenting after label parsing
+		choices.gather = g
+		g.parent = choices
 
-			return nil
+		// parsing label
+		if err := i.parseLabel(g); err != nil {
+			return err
+		}
+		// forbid gather from parenting its own options after label parsing,
+		// so it is the sibling of the options
+		g.parent = choices.Parent()
+	} else {
+		// the gather without options is the next of current one
+		n := s.next()
+		if n == nil {
+			return errors.New("current line can not set next")
 		}
 
-		return errors.New("cannot find the options of the gather")
+		g.path = s.current.Path() + PathSplit + "g"
+		s.paths[g.path] = g
+
+		n.SetNext(g)
+		g.parent = s.current
+
+		if err := i.parseLabel(g); err != nil {
+			return err
+		}
 	}
 
-	return errNotMatch
+	s.current = g
+	return i.parseContent()
 }
 
 // gather node of the choices
@@ -283,33 +635,84 @@ func readVariable(s *Story, input string, ln int) error {
 		name := res[2]
 		value := res[3]
 
-		// string
-		if re := strReg.FindStringSubmatch(value); re != nil {
-			value = re[1]
-			s.vars[name] = value
-			return nil
+		if _, ok := s.consts[name]; ok {
+			return errors.Errorf("conflict variable name with constant: %s", name)
 		}
 
-		// bool
-		if b, err := strconv.ParseBool(value); err == nil {
-			s.vars[name] = b
-			return nil
+		v, err := parseValue(value)
+		if err != nil {
+			return err
 		}
 
-		// int
-		if i, err := strconv.Atoi(value); err == nil {
-			s.vars[name] = i
-			return nil
-		}
+		s.vars[name] = v
+		s.defaults[name] = v
+		return nil
+	}
 
-		// float
-		if f, err := strconv.ParseFloat(value, 64); err == nil {
-			s.vars[name] = f
-			return nil
-		}
+	return errNotMatch
+}
 
-		return errors.Errorf("value is not recgonized: %s", value)
+// readConst from input, which can not be reassigned,
+// and is folded into the expressions after parsing
+func readConst(s *Story, input string, ln int) error {
+	res := constReg.FindStringSubmatch(input)
+	if res == nil {
+		return errNotMatch
 	}
 
-	return errNotMatch
+	name := res[1]
+	if _, ok := s.consts[name]; ok {
+		return errors.Errorf("conflict constant name: %s", name)
+	}
+
+	if _, ok := s.vars[name]; ok {
+		return errors.Errorf("conflict constant name with variable: %s", name)
+	}
+
+	v, err := parseValue(strings.TrimSpace(res[2]))
+	if err != nil {
+		return err
+	}
+
+	s.consts[name] = v
+	return nil
+}
+
+// DivertTarget is the value of a variable which can be diverted to: VAR next = -> knot.stitch,
+// its path is resolved relative to the divert
+type DivertTarget string
+
+// String of the divert target, as it is written in ink
+func (t DivertTarget) String() string {
+	return "-> " + string(t)
+}
+
+// parse the literal value of a variable
+func parseValue(value string) (interface{}, error) {
+	// divert target
+	if re := divertValueReg.FindStringSubmatch(value); re != nil && re[0] == value {
+		return DivertTarget(strings.ToLower(re[1])), nil
+	}
+
+	// string
+	if re := strReg.FindStringSubmatch(value); re != nil {
+		return unescape(re[1]), nil
+	}
+
+	// int
+	if i, err := strconv.Atoi(value); err == nil {
+		return i, nil
+	}
+
+	// float
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		return f, nil
+	}
+
+	// bool, after numbers, or "1" will be parsed as true
+	if b, err := strconv.ParseBool(value); err == nil {
+		return b, nil
+	}
+
+	return nil, errors.Errorf("value is not recgonized: %s", value)
 }
@@ -1,6 +1,7 @@
 package goink
 
 import (
+	"fmt"
 	"strings"
 	"testing"
 
@@ -224,6 +225,7 @@ func TestVariableParsing(t *testing.T) {
 	VAR b = false
 	var  c="hello world"
 	var  d = 3.134
+	VAR f = 1
 	`
 
 	story := Default()
@@ -235,6 +237,7 @@ func TestVariableParsing(t *testing.T) {
 	assert.Equal(t, story.vars["c"], "hello world")
 	assert.Equal(t, story.vars["d"], 3.134)
 	assert.Equal(t, story.vars["e"], nil)
+	assert.Equal(t, story.vars["f"], 1)
 
 	input = `
 	var  e = 3.-134
@@ -244,3 +247,350 @@ func TestVariableParsing(t *testing.T) {
 	err = story.Parse(input)
 	assert.Contains(t, err.Error(), "not recgonized")
 }
+
+func TestParseValue(t *testing.T) {
+	// numbers are parsed before bool, so 0 and 1 are not bool
+	for input, value := range map[string]interface{}{
+		"0":       0,
+		"1":       1,
+		"-2":      -2,
+		"1.0":     1.0,
+		"true":    true,
+		"false":   false,
+		"\"1\"":   "1",
+		"-> Knot": DivertTarget("knot"),
+	} {
+		v, err := parseValue(input)
+		assert.Nil(t, err)
+		assert.Equal(t, value, v, input)
+	}
+
+	_, err := parseValue("yes")
+	assert.Contains(t, err.Error(), "value is not recgonized: yes")
+}
+
+func TestTunnelParsing(t *testing.T) {
+	l, err := newLine("go shopping -> shop ->")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"shop"}, destPaths(l.tunnels))
+	assert.Nil(t, l.divert)
+	assert.Equal(t, "go shopping ", l.text)
+
+	l, err = newLine("-> a -> b.c -> Knot")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "b.c"}, destPaths(l.tunnels))
+	assert.Equal(t, "knot", l.divert.path)
+
+	l, err = newLine("->->")
+	assert.Nil(t, err)
+	assert.True(t, l.back)
+
+	l, err = newLine("done ->-> elsewhere")
+	assert.Nil(t, err)
+	assert.True(t, l.back)
+	assert.Equal(t, "elsewhere", l.divert.path)
+
+	_, err = newLine("->-> a ->")
+	assert.Contains(t, err.Error(), "invalid tunnel return")
+
+	_, err = newLine("-> a -> -> b")
+	assert.Contains(t, err.Error(), "invalid divert name")
+
+	l, err = newLine(`he said "go -> there" -> knot`)
+	assert.Nil(t, err)
+	assert.Equal(t, `he said "go -> there" `, l.text)
+	assert.Equal(t, "knot", l.divert.path)
+
+	l, err = newLine(`a "quote -> knot`)
+	assert.Nil(t, err)
+	assert.Equal(t, "knot", l.divert.path)
+}
+
+func destPaths(dests []*dest) (paths []string) {
+	for _, d := range dests {
+		paths = append(paths, d.path)
+	}
+	return
+}
+
+func TestTunnelCalling(t *testing.T) {
+	input := `
+	Morning. -> shop -> walk ->
+	Evening. -> shop -> END
+	== shop
+	~ temp price = 3
+	Welcome to the shop.
+	* [Buy] You pay {price} coins.
+	* [Leave]
+	- See you! ->->
+	== walk
+	A nice walk. -> park
+	= park
+	In the park. ->->
+	`
+
+	story := Default()
+	err := story.Parse(input)
+	assert.Nil(t, err)
+	assert.Nil(t, story.PostParsing())
+
+	ctx := NewContext()
+	sec, err := story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "Morning.\nWelcome to the shop.", sec.Text)
+	assert.Equal(t, 1, len(ctx.Stack))
+	assert.Equal(t, "start__i", ctx.Stack[0].Path)
+
+	sec, err = story.Pick(ctx, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, " You pay 3 coins.\nSee you!\nA nice walk.\nIn the park.\nEvening.\nWelcome to the shop.", sec.Text)
+	assert.Equal(t, 1, len(ctx.Stack))
+	assert.Equal(t, "start__i__i", ctx.Stack[0].Path)
+
+	sec, err = story.Pick(ctx, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "See you!", sec.Text)
+	assert.True(t, sec.End)
+	assert.Empty(t, ctx.Stack)
+
+	input = `
+	Nowhere to return. ->->
+	`
+	story = Default()
+	err = story.Parse(input)
+	assert.Nil(t, err)
+
+	_, err = story.Resume(NewContext())
+	assert.Contains(t, err.Error(), "tunnel return without calling")
+
+	ctx = NewContext()
+	ctx.Stack = []Frame{{Path: "invalid"}}
+	_, err = story.Resume(ctx)
+	assert.Contains(t, err.Error(), "return path [invalid] is not existed")
+
+	// the temporary variables of the caller are kept apart from the tunnel
+	input = `
+	-> knot
+	== knot
+	~ temp x = 1
+	-> sub ->
+	x is {x}. -> END
+	- (sub)
+	~ x = 2
+	->->
+	`
+	story = Default()
+	err = story.Parse(input)
+	assert.Nil(t, err)
+	assert.Nil(t, story.PostParsing())
+
+	sec, err = story.Resume(NewContext())
+	assert.Nil(t, err)
+	assert.Equal(t, "x is 1.", sec.Text)
+}
+
+func TestConstDeclaration(t *testing.T) {
+	input := `
+	CONST MAX_GOLD = 5
+	VAR gold = 3
+	You can carry {MAX_GOLD * 2} coins.
+	{gold < MAX_GOLD: Not full.}
+	-> END
+	CONST NAME = "shop"
+	`
+
+	story := Default()
+	err := story.Parse(input)
+	assert.Nil(t, err)
+	assert.Nil(t, story.PostParsing())
+	assert.Equal(t, 5, story.consts["MAX_GOLD"])
+	assert.Equal(t, "shop", story.consts["NAME"])
+
+	// folded into the program, without the constant in env
+	l := story.start.(*start).next.(*line)
+	v, e := l.content[1].(*inline).Eval(map[string]interface{}{})
+	assert.Nil(t, e)
+	assert.Equal(t, 10, v)
+
+	ctx := NewContext()
+	sec, err := story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "You can carry 10 coins.\nNot full.", sec.Text)
+	assert.NotContains(t, ctx.Vars, "MAX_GOLD")
+
+	input = `
+	CONST MAX_GOLD = 5
+	~ MAX_GOLD = 10
+	-> END
+	`
+
+	story = Default()
+	err = story.Parse(input)
+	assert.Nil(t, err)
+
+	errs := story.PostParsing()
+	assert.Equal(t, "can not assign to constant: MAX_GOLD ln: 3", errs[0].Error())
+
+	// the constant is not folded, when it is shadowed
+	input = `
+	CONST MAX_GOLD = 5
+	Max {MAX_GOLD} -> shop(7)
+	== shop(MAX_GOLD)
+	{MAX_GOLD}
+	~ temp gold = MAX_GOLD + 1
+	~ MAX_GOLD = gold
+	Max {MAX_GOLD} -> stall
+	== stall
+	~ temp MAX_GOLD = 9
+	Max {MAX_GOLD} -> END
+	`
+
+	story = Default()
+	assert.Nil(t, story.Parse(input))
+	assert.Nil(t, story.PostParsing())
+
+	sec, err = story.Resume(NewContext())
+	assert.Nil(t, err)
+	assert.Equal(t, "Max 5\n7\nMax 8\nMax 9", sec.Text)
+
+	input = `
+	CONST MAX_GOLD = 5
+	CONST MAX_GOLD = 6
+	`
+	story = Default()
+	err = story.Parse(input)
+	assert.Contains(t, err.Error(), "conflict constant name: MAX_GOLD")
+
+	input = `
+	VAR gold = 5
+	CONST gold = 6
+	`
+	story = Default()
+	err = story.Parse(input)
+	assert.Contains(t, err.Error(), "conflict constant name with variable: gold")
+}
+
+func TestDivertTargetValues(t *testing.T) {
+	input := `
+	VAR next_scene = -> tavern
+	You leave the town.-> next_scene
+	== tavern
+	The tavern is noisy.
+	~ next_scene = -> Shop.counter
+	-> quest(-> next_scene_back)
+	== next_scene_back
+	Back again.-> next_scene
+	== quest(return_to)
+	You finish the quest.-> return_to
+	== shop
+	= counter
+	The shop is closed.-> END
+	`
+
+	story := Default()
+	err := story.Parse(input)
+	assert.Nil(t, err)
+	assert.Nil(t, story.PostParsing())
+	assert.Equal(t, DivertTarget("tavern"), story.vars["next_scene"])
+
+	ctx := NewContext()
+	sec, err := story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "You leave the town.\nThe tavern is noisy.\nYou finish the quest.\nBack again.\nThe shop is closed.", sec.Text)
+	assert.Equal(t, DivertTarget("shop.counter"), ctx.Vars["next_scene"])
+
+	// divert targets are compared with each other, but not with strings
+	input = `
+	VAR next_scene = -> tavern
+	VAR name = "tavern"
+	Same: {next_scene == -> tavern} {next_scene == name} {next_scene}
+	-> next_scene
+	== tavern
+	-> END
+	`
+
+	story = Default()
+	assert.Nil(t, story.Parse(input))
+	assert.Nil(t, story.PostParsing())
+
+	// the target decoded from json is still a target
+	ctx = NewContext()
+	ctx.Vars["next_scene"] = "tavern"
+	sec, err = story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "Same: true false -> tavern", sec.Text)
+
+	for _, value := range []string{"1", `"tavern"`} {
+		input = `
+		VAR next_scene = %s
+		-> next_scene
+		== tavern
+		-> END
+		`
+
+		story = Default()
+		err = story.Parse(fmt.Sprintf(input, value))
+		assert.Nil(t, err)
+
+		errs := story.PostParsing()
+		assert.Contains(t, errs[0].Error(), "variable is not a divert target: next_scene", value)
+	}
+}
+
+func TestLineConditions(t *testing.T) {
+	input := `
+	VAR x = 0
+	{bump() > 0} Bumped {x} time.
+	{bump() > 5} Never. -> END
+	{x > 1} {RANDOM(1, 6) > 0} Rolled once.
+	{x > 1}
+	-> END
+	== function bump()
+	~ x = x + 1
+	~ return x
+	`
+
+	story := Default()
+	assert.Nil(t, story.Parse(input))
+	assert.Nil(t, story.PostParsing())
+
+	// the conditions are tested once, when the line is visited,
+	// and the expression without content is rendered
+	ctx := NewContext()
+	ctx.Seed = 1
+	sec, err := story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "Bumped 1 time.\nRolled once.\ntrue", sec.Text)
+	assert.Equal(t, 2, ctx.Vars["x"])
+	assert.Equal(t, 1, ctx.Rolls)
+}
+
+func TestLocalScopes(t *testing.T) {
+	input := `
+	-> shop(1)
+	== shop(price)
+	~ temp coins = 2
+	-> counter
+	= counter
+	~ temp hat = 3
+	-> END
+	`
+
+	story := Default()
+	assert.Nil(t, story.Parse(input))
+	assert.Nil(t, story.PostParsing())
+
+	// the temporary variables are collected once by their scopes
+	assert.Equal(t, map[string]map[string]bool{"shop": {"coins": true}, "shop__counter": {"hat": true}}, story.scopes)
+
+	counter := story.paths["shop__counter"]
+	assert.True(t, story.local("hat", counter))
+	assert.True(t, story.local("coins", counter))
+	assert.True(t, story.local("price", counter))
+	assert.False(t, story.local("hat", story.paths["shop"]))
+	assert.False(t, story.local("coins", story.start))
+
+	// and collected again, when more is parsed
+	assert.Nil(t, story.Parse("~ temp gold = 1"))
+	assert.Nil(t, story.scopes)
+}
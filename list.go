@@ -0,0 +1,723 @@
+package goink
+
+import (
+	"encoding/json"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	listReg     = regexp.MustCompile(`^\s*LIST\s+([_a-zA-Z]\w*)\s*\=\s*(.+)$`)
+	listItemReg = regexp.MustCompile(`^([_a-zA-Z]\w*)\s*(\=\s*(-?\d+))?$`)
+)
+
+// readList parse the LIST declaration: LIST doors = (open), closed, locked = 5
+// the items in parentheses are the initial value of the list variable
+func readList(s *Story, input string, ln int) error {
+	res := listReg.FindStringSubmatch(input)
+	if res == nil {
+		return errNotMatch
+	}
+
+	name := res[1]
+	if _, ok := s.lists[name]; ok {
+		return errors.Errorf("conflict list name: %s", name)
+	}
+
+	if _, ok := s.vars[name]; ok {
+		return errors.Errorf("conflict list name with variable: %s", name)
+	}
+
+	if _, ok := s.consts[name]; ok {
+		return errors.Errorf("conflict list name with constant: %s", name)
+	}
+
+	var all, selected []ListItem
+	value := 0
+	for _, i := range splitTop(res[2], ',') {
+		i = strings.TrimSpace(i)
+
+		sel := strings.HasPrefix(i, "(") && strings.HasSuffix(i, ")")
+		if sel {
+			i = strings.TrimSpace(i[1 : len(i)-1])
+		}
+
+		m := listItemReg.FindStringSubmatch(i)
+		if m == nil {
+			return errors.Errorf("invalid list item: %s", i)
+		}
+
+		value++
+		if m[3] != "" {
+			value, _ = strconv.Atoi(m[3])
+		}
+
+		item := ListItem{Origin: name, Name: m[1], Value: value}
+		for _, e := range all {
+			if e.Name == item.Name {
+				return errors.Errorf("conflict list item name: %s", item.Name)
+			}
+		}
+
+		all = append(all, item)
+		if sel {
+			selected = append(selected, item)
+		}
+	}
+
+	s.lists[name] = all
+	for _, i := range all {
+		v := newList([]ListItem{i}, name)
+		s.items[name+PathSplit+i.Name] = v
+
+		// the short name of the item is ambiguous in different lists
+		if _, ok := s.items[i.Name]; ok {
+			s.items[i.Name] = nil
+		} else {
+			s.items[i.Name] = v
+		}
+	}
+
+	l := newList(selected, name)
+	s.vars[name] = l
+	s.defaults[name] = l
+
+	return nil
+}
+
+// List value of the ink LIST, which is a set of items
+type List struct {
+	Items   []ListItem `json:"items"`
+	Origins []string   `json:"origins"`
+}
+
+// ListItem of the list
+type ListItem struct {
+	Origin string `json:"origin"`
+	Name   string `json:"name"`
+	Value  int    `json:"value"`
+}
+
+// newList with sorted unique items and origins
+func newList(items []ListItem, origins ...string) List {
+	l := List{}
+	seen := make(map[string]bool)
+	for _, i := range items {
+		if key := i.Origin + PathSplit + i.Name; !seen[key] {
+			seen[key] = true
+			l.Items = append(l.Items, i)
+		}
+		origins = append(origins, i.Origin)
+	}
+
+	sort.Slice(l.Items, func(a, b int) bool {
+		if l.Items[a].Value == l.Items[b].Value {
+			return l.Items[a].Origin < l.Items[b].Origin
+		}
+		return l.Items[a].Value < l.Items[b].Value
+	})
+
+	for _, o := range origins {
+		if idx := sort.SearchStrings(l.Origins, o); idx == len(l.Origins) || l.Origins[idx] != o {
+			l.Origins = append(l.Origins, o)
+			sort.Strings(l.Origins)
+		}
+	}
+
+	return l
+}
+
+// String of the list, which is the items' names
+func (l List) String() string {
+	names := make([]string, len(l.Items))
+	for i, item := range l.Items {
+		names[i] = item.Name
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// has the item in the list
+func (l List) has(item ListItem) bool {
+	for _, i := range l.Items {
+		if i.Origin == item.Origin && i.Name == item.Name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// union of the lists
+func (l List) union(o List) List {
+	return newList(append(append([]ListItem{}, l.Items...), o.Items...), append(l.Origins, o.Origins...)...)
+}
+
+// without the items of the other list
+func (l List) without(o List) List {
+	var items []ListItem
+	for _, i := range l.Items {
+		if !o.has(i) {
+			items = append(items, i)
+		}
+	}
+
+	return newList(items, l.Origins...)
+}
+
+// intersect of the lists
+func (l List) intersect(o List) List {
+	var items []ListItem
+	for _, i := range l.Items {
+		if o.has(i) {
+			items = append(items, i)
+		}
+	}
+
+	return newList(items, append(l.Origins, o.Origins...)...)
+}
+
+// contains all items of the other list
+func (l List) contains(o List) bool {
+	if len(o.Items) == 0 || len(l.Items) == 0 {
+		return false
+	}
+
+	for _, i := range o.Items {
+		if !l.has(i) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// value of the list, which is the value of its max item
+func (l List) value() int {
+	if len(l.Items) == 0 {
+		return 0
+	}
+	return l.Items[len(l.Items)-1].Value
+}
+
+// equal items of the lists, the origins are ignored
+func (l List) equal(o List) bool {
+	return len(l.Items) == len(o.Items) && (len(l.Items) == 0 || l.contains(o))
+}
+
+// compare the lists by their min and max items' values
+func (l List) compare(op string, o List) bool {
+	a, b := len(l.Items) > 0, len(o.Items) > 0
+	switch op {
+	case ">":
+		return a && (!b || l.Items[0].Value > o.value())
+	case ">=":
+		return a && (!b || (l.Items[0].Value >= o.Items[0].Value && l.value() >= o.value()))
+	case "<":
+		return b && (!a || l.value() < o.Items[0].Value)
+	case "<=":
+		return b && (!a || (l.value() <= o.value() && l.Items[0].Value <= o.Items[0].Value))
+	}
+
+	return false
+}
+
+// between the min and max values, which are included
+func (l List) between(min, max int) List {
+	var items []ListItem
+	for _, i := range l.Items {
+		if i.Value >= min && i.Value <= max {
+			items = append(items, i)
+		}
+	}
+
+	return newList(items, l.Origins...)
+}
+
+// listOf the value, which may be decoded from json
+func listOf(v interface{}) (List, bool) {
+	switch v := v.(type) {
+	case List:
+		return v, true
+	case map[string]interface{}:
+		l := List{}
+		if b, err := json.Marshal(v); err == nil && json.Unmarshal(b, &l) == nil {
+			return newList(l.Items, l.Origins...), true
+		}
+	}
+
+	return List{}, false
+}
+
+// lists returns the list operands
+func lists(name string, args ...interface{}) ([]List, error) {
+	res := make([]List, len(args))
+	for i, a := range args {
+		l, ok := listOf(a)
+		if !ok {
+			return nil, errors.Errorf("%s needs list argument, but got: %v", name, a)
+		}
+		res[i] = l
+	}
+
+	return res, nil
+}
+
+// operands of the list function, the error is raised
+func (s *Story) operands(name string, args ...interface{}) []List {
+	res, err := lists(name, args...)
+	if err != nil {
+		s.raise(err)
+	}
+
+	return res
+}
+
+// listFuncs of the story, which are used by the expressions
+func (s *Story) listFuncs() map[string]interface{} {
+	funcs := map[string]interface{}{
+		"_add": func(a, b interface{}) interface{} {
+			v, err := s.add(a, b)
+			if err != nil {
+				s.raise(err)
+			}
+			return v
+		},
+		"_sub": func(a, b interface{}) interface{} {
+			v, err := s.sub(a, b)
+			if err != nil {
+				s.raise(err)
+			}
+			return v
+		},
+		"_has": func(a, b interface{}) interface{} {
+			if str, ok := a.(string); ok {
+				return strings.Contains(str, stringify(b))
+			}
+			l := s.operands("?", a, b)
+			return l[0].contains(l[1])
+		},
+		"_hasnt": func(a, b interface{}) interface{} {
+			if str, ok := a.(string); ok {
+				return !strings.Contains(str, stringify(b))
+			}
+			l := s.operands("!?", a, b)
+			return !l[0].contains(l[1])
+		},
+		"_intersect": func(a, b interface{}) interface{} {
+			l := s.operands("^", a, b)
+			return l[0].intersect(l[1])
+		},
+		"_list": func(items ...interface{}) interface{} {
+			l := newList(nil)
+			for _, o := range s.operands("()", items...) {
+				l = l.union(o)
+			}
+			return l
+		},
+		"_compare": func(op string, a, b interface{}) bool {
+			v, err := compare(op, a, b)
+			if err != nil {
+				s.raise(err)
+			}
+			return v
+		},
+	}
+
+	for _, name := range []string{"LIST_COUNT", "LIST_MIN", "LIST_MAX", "LIST_VALUE", "LIST_ALL", "LIST_INVERT"} {
+		name := name
+		funcs[name] = func(a interface{}) interface{} {
+			return s.listFunc(name, s.operands(name, a)[0])
+		}
+	}
+
+	return funcs
+}
+
+// listFunc of ink, which takes a list, it is shared by the compiled story
+func (s *Story) listFunc(name string, l List) interface{} {
+	switch name {
+	case "LIST_COUNT":
+		return len(l.Items)
+	case "LIST_MIN":
+		if len(l.Items) == 0 {
+			return l
+		}
+		return newList(l.Items[:1], l.Origins...)
+	case "LIST_MAX":
+		if len(l.Items) == 0 {
+			return l
+		}
+		return newList(l.Items[len(l.Items)-1:], l.Origins...)
+	case "LIST_VALUE":
+		return l.value()
+	case "LIST_ALL":
+		return s.listAll(l)
+	case "LIST_INVERT":
+		return s.listAll(l).without(l)
+	}
+
+	return nil
+}
+
+// listAll items of the list's origins
+func (s *Story) listAll(l List) List {
+	var items []ListItem
+	for _, o := range l.Origins {
+		items = append(items, s.lists[o]...)
+	}
+
+	return newList(items, l.Origins...)
+}
+
+// add the operands by their types: the lists are united, the list's items
+// are shifted by the integer, the strings are joined, and the numbers are summed
+func (s *Story) add(a, b interface{}) (interface{}, error) {
+	if l, ok := listOf(a); ok {
+		if n, ok := b.(int); ok {
+			return s.shift(l, n), nil
+		}
+
+		o, err := lists("+", b)
+		if err != nil {
+			return nil, err
+		}
+		return l.union(o[0]), nil
+	}
+
+	_, sa := a.(string)
+	_, sb := b.(string)
+	if sa || sb {
+		return stringify(a) + stringify(b), nil
+	}
+
+	return arith("+", a, b)
+}
+
+// sub the operands by their types: the items of the list are removed,
+// or shifted back by the integer, and the numbers are subtracted
+func (s *Story) sub(a, b interface{}) (interface{}, error) {
+	if l, ok := listOf(a); ok {
+		if n, ok := b.(int); ok {
+			return s.shift(l, -n), nil
+		}
+
+		o, err := lists("-", b)
+		if err != nil {
+			return nil, err
+		}
+		return l.without(o[0]), nil
+	}
+
+	return arith("-", a, b)
+}
+
+// shift the items of the list by the value, in their own lists
+func (s *Story) shift(l List, n int) List {
+	var items []ListItem
+	for _, i := range l.Items {
+		for _, o := range s.lists[i.Origin] {
+			if o.Value == i.Value+n {
+				items = append(items, o)
+			}
+		}
+	}
+
+	return newList(items, l.Origins...)
+}
+
+// arith of the numbers, the integers' result is still an integer
+func arith(op string, a, b interface{}) (interface{}, error) {
+	x, xi := a.(int)
+	y, yi := b.(int)
+	if xi && yi {
+		if op == "-" {
+			return x - y, nil
+		}
+		return x + y, nil
+	}
+
+	f, err := floatArg(op, a)
+	if err != nil {
+		return nil, err
+	}
+
+	g, err := floatArg(op, b)
+	if err != nil {
+		return nil, err
+	}
+
+	if op == "-" {
+		return f - g, nil
+	}
+	return f + g, nil
+}
+
+// functions of the list operators
+var listOps = map[string]string{"?": "_has", "has": "_has", "!?": "_hasnt", "hasnt": "_hasnt", "^": "_intersect"}
+
+// rewriteListOps rewrites the list operators into function calls:
+// a ? b => _has(a, b), a !? b => _hasnt(a, b), a ^ b => _intersect(a, b),
+// which are prior to the comparison operators, but after the others
+func rewriteListOps(code string) string {
+	if !strings.ContainsAny(code, "?^") && !strings.Contains(code, "has") {
+		return code
+	}
+
+	var out, cur strings.Builder
+	var operands, ops []string
+
+	// flush the operands of current list operators
+	flush := func() {
+		operands = append(operands, cur.String())
+		cur.Reset()
+
+		if len(ops) == 0 {
+			out.WriteString(operands[0])
+		} else {
+			acc := strings.TrimSpace(operands[0])
+			for i, op := range ops {
+				acc = listOps[op] + "(" + acc + ", " + strings.TrimSpace(operands[i+1]) + ")"
+			}
+			out.WriteString(" " + acc + " ")
+		}
+
+		operands, ops = nil, nil
+	}
+
+	// push the operand before the list operator
+	push := func(op string) {
+		operands = append(operands, cur.String())
+		ops = append(ops, op)
+		cur.Reset()
+	}
+
+	for i := 0; i < len(code); i++ {
+		ch := code[i]
+		switch {
+		case ch == '"' || ch == '\'':
+			j := i + 1
+			for ; j < len(code) && code[j] != ch; j++ {
+				if code[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(code) {
+				j = len(code) - 1
+			}
+			cur.WriteString(code[i : j+1])
+			i = j
+		case ch == '(' || ch == '[':
+			j := closing(code, i)
+			if j < 0 {
+				cur.WriteString(code[i:])
+				i = len(code)
+				continue
+			}
+			cur.WriteByte(ch)
+			cur.WriteString(rewriteListOps(code[i+1 : j]))
+			cur.WriteByte(code[j])
+			i = j
+		case strings.HasPrefix(code[i:], "!?"):
+			push("!?")
+			i++
+		case ch == '?' && ternary(code[i+1:]):
+			// the condition of the ternary operator: a ? b : c
+			flush()
+			out.WriteByte(ch)
+		case ch == '?' || ch == '^':
+			push(string(ch))
+		case ch == ',' || ch == ':' || ch == '<' || ch == '>' || strings.HasPrefix(code[i:], "==") || strings.HasPrefix(code[i:], "!=") ||
+			strings.HasPrefix(code[i:], "&&") || strings.HasPrefix(code[i:], "||"):
+			// the operators which are prior to the list operators
+			flush()
+			op := code[i : i+1]
+			if i+1 < len(code) && strings.ContainsRune("=&|", rune(code[i+1])) {
+				op = code[i : i+2]
+			}
+			out.WriteString(op)
+			i += len(op) - 1
+		case isWordStart(code, i):
+			j := i
+			for j < len(code) && isWordChar(code[j]) {
+				j++
+			}
+
+			switch word := code[i:j]; word {
+			case "has", "hasnt":
+				push(word)
+			case "and", "or":
+				flush()
+				out.WriteString(word)
+			default:
+				cur.WriteString(word)
+			}
+			i = j - 1
+		default:
+			cur.WriteByte(ch)
+		}
+	}
+
+	flush()
+	return out.String()
+}
+
+// rewriteLists rewrites the list literals into calls: (a, b) => _list(a, b),
+// the parentheses of the function calls and the single expressions are kept
+func rewriteLists(code string) string {
+	if !strings.Contains(code, "(") {
+		return code
+	}
+
+	var out strings.Builder
+	for i := 0; i < len(code); i++ {
+		ch := code[i]
+		switch {
+		case ch == '"' || ch == '\'':
+			j := i + 1
+			for ; j < len(code) && code[j] != ch; j++ {
+				if code[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(code) {
+				j = len(code) - 1
+			}
+			out.WriteString(code[i : j+1])
+			i = j
+		case ch == '(':
+			j := closing(code, i)
+			if j < 0 {
+				out.WriteString(code[i:])
+				return out.String()
+			}
+
+			inner := rewriteLists(code[i+1 : j])
+			if !called(code[:i]) && (strings.TrimSpace(inner) == "" || len(splitTop(inner, ',')) > 1) {
+				out.WriteString("_list")
+			}
+			out.WriteString("(" + inner + ")")
+			i = j
+		default:
+			out.WriteByte(ch)
+		}
+	}
+
+	return out.String()
+}
+
+// called tells if the parentheses after the code are the arguments of a function
+func called(code string) bool {
+	code = strings.TrimRight(code, " \t")
+	if code == "" {
+		return false
+	}
+
+	if ch := code[len(code)-1]; ch == ')' || ch == ']' {
+		return true
+	}
+
+	i := len(code)
+	for i > 0 && isWordChar(code[i-1]) {
+		i--
+	}
+
+	switch word := code[i:]; word {
+	case "", "and", "or", "not", "has", "hasnt", "in":
+		return false
+	}
+	return true
+}
+
+// compare the operands by their types: the lists are compared by their items,
+// and a list is its value with the others, as the compiled story does
+func compare(op string, a, b interface{}) (bool, error) {
+	la, oka := listOf(a)
+	lb, okb := listOf(b)
+	switch {
+	case oka && okb:
+		if op == "==" || op == "!=" {
+			return la.equal(lb) == (op == "=="), nil
+		}
+		return la.compare(op, lb), nil
+	case oka:
+		a = la.value()
+	case okb:
+		b = lb.value()
+	}
+
+	v, err := operate(op, []interface{}{a, b})
+	if err != nil {
+		return false, err
+	}
+
+	res, _ := v.(bool)
+	return res, nil
+}
+
+// ternary tells if the question mark before the code is a ternary operator,
+// which has its colon at the same level
+func ternary(code string) bool {
+	for i := 0; i < len(code); i++ {
+		switch ch := code[i]; ch {
+		case '"', '\'':
+			j := i + 1
+			for ; j < len(code) && code[j] != ch; j++ {
+				if code[j] == '\\' {
+					j++
+				}
+			}
+			i = j
+		case '(', '[', '{':
+			if i = closing(code, i); i < 0 {
+				return false
+			}
+		case ':':
+			return true
+		}
+	}
+
+	return false
+}
+
+// closing bracket's index of the opening one
+func closing(code string, start int) int {
+	depth := 0
+	var quote byte
+	for i := start; i < len(code); i++ {
+		ch := code[i]
+		if quote != 0 {
+			if ch == '\\' {
+				i++
+			} else if ch == quote {
+				quote = 0
+			}
+			continue
+		}
+
+		switch ch {
+		case '"', '\'':
+			quote = ch
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			if depth--; depth == 0 {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+func isWordChar(ch byte) bool {
+	return ch == '_' || ch == '.' || (ch >= '0' && ch <= '9') || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+}
+
+func isWordStart(code string, i int) bool {
+	return isWordChar(code[i]) && (i == 0 || !isWordChar(code[i-1]))
+}
@@ -0,0 +1,176 @@
+package goink
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListParsing(t *testing.T) {
+	input := `
+	LIST doors = (open), closed, locked
+	LIST items = sword = 5, (shield), potion
+	-> END
+	`
+
+	story := Default()
+	err := story.Parse(input)
+	assert.Nil(t, err)
+	assert.Nil(t, story.PostParsing())
+
+	assert.Equal(t, []ListItem{{"doors", "open", 1}, {"doors", "closed", 2}, {"doors", "locked", 3}}, story.lists["doors"])
+	assert.Equal(t, 6, story.lists["items"][1].Value)
+	assert.Equal(t, newList([]ListItem{{"doors", "open", 1}}, "doors"), story.vars["doors"])
+	assert.Equal(t, "shield", story.vars["items"].(List).String())
+	assert.NotNil(t, story.items["doors__locked"])
+	assert.NotNil(t, story.items["potion"])
+
+	input = `
+	LIST doors = open, (closed
+	`
+	story = Default()
+	err = story.Parse(input)
+	assert.Contains(t, err.Error(), "invalid list item")
+
+	input = `
+	VAR doors = 1
+	LIST doors = open
+	`
+	story = Default()
+	err = story.Parse(input)
+	assert.Contains(t, err.Error(), "conflict list name with variable: doors")
+}
+
+func TestListOperators(t *testing.T) {
+	assert.Equal(t, "a + b", rewriteListOps("a + b"))
+	assert.Equal(t, " _has(a, b) ", rewriteListOps("a ? b"))
+	assert.Equal(t, " _hasnt(a, b + c) ", rewriteListOps("a !? b + c"))
+	assert.Equal(t, " _has(_intersect(a, b), c) == true", rewriteListOps("a ^ b ? c == true"))
+	assert.Equal(t, "not ( _has(a, b) ) and _hasnt(c, \"x?\") ", rewriteListOps("not (a has b) and c hasnt \"x?\""))
+	assert.Equal(t, "f( _has(a, b) , c)", rewriteListOps("f(a ? b, c)"))
+
+	input := `
+	LIST doors = (open), closed, locked
+	LIST items = sword = 5, (shield), potion
+	Doors: {doors}.
+	~ doors += locked
+	~ doors -= open
+	{doors ? locked: Locked.}
+	{doors !? open: Not open.}
+	Counts {LIST_COUNT(doors)}, {LIST_VALUE(LIST_MAX(doors))}, {LIST_MIN(doors)}
+	{LIST_ALL(doors)}
+	{doors ^ (locked + closed)}
+	{LIST_INVERT(doors)}
+	{items has shield and LIST_VALUE(items.shield) == 6: Shield.}
+	* [Unlock]
+	  ~ doors = doors - locked + open + closed
+	  Now {doors}. -> END
+	`
+
+	story := Default()
+	err := story.Parse(input)
+	assert.Nil(t, err)
+	assert.Nil(t, story.PostParsing())
+
+	ctx := NewContext()
+	sec, err := story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "Doors: open.\nLocked.\nNot open.\nCounts 1, 3, locked\nopen, closed, locked\nlocked\nopen, closed\nShield.", sec.Text)
+
+	// lists are decoded from the json context
+	b, e := json.Marshal(ctx)
+	assert.Nil(t, e)
+	ctx = NewContext()
+	assert.Nil(t, json.Unmarshal(b, ctx))
+
+	sec, err = story.Pick(ctx, 0)
+	assert.Nil(t, err)
+	assert.Contains(t, sec.Text, "Now open, closed.")
+	assert.Equal(t, newList([]ListItem{{"doors", "open", 1}, {"doors", "closed", 2}}, "doors"), ctx.Vars["doors"])
+
+	input = `
+	VAR gold = 1
+	{LIST_COUNT(gold)}
+	-> END
+	`
+
+	story = Default()
+	err = story.Parse(input)
+	assert.Nil(t, err)
+
+	_, err = story.Resume(NewContext())
+	// the error of the function is returned as it is, instead of a panic
+	assert.Equal(t, "rendering failed: start__i: LIST_COUNT needs list argument, but got: 1 ln: 3", err.Error())
+}
+
+func TestListArithmetic(t *testing.T) {
+	input := `
+	LIST doors = (open), closed, locked
+	LIST moods = (sad), open
+	VAR greeting = "Hi"
+	-> room(doors)
+	== room(d)
+	~ temp all = LIST_ALL(d)
+	{d + closed} {all - d} {d + 1} {locked - 2} {greeting + " " + d} {1 + 2.5 - 1}
+	-> END
+	`
+
+	story := Default()
+	assert.Nil(t, story.Parse(input))
+	assert.Nil(t, story.PostParsing())
+
+	// the lists in parameters and temporary variables are known at runtime
+	sec, err := story.Resume(NewContext())
+	assert.Nil(t, err)
+	assert.Equal(t, "open, closed closed, locked closed open Hi open 2.5", sec.Text)
+
+	// the short name is ambiguous
+	story = Default()
+	assert.Nil(t, story.Parse("LIST doors = open\nLIST moods = open\n{moods.open} {open}\n-> END\n"))
+	errs := story.PostParsing()
+	assert.Equal(t, 1, len(errs))
+	assert.Contains(t, errs[0].Error(), "ambiguous list item: open")
+
+	story = Default()
+	assert.Nil(t, story.Parse("VAR gold = 1\nVAR name = \"a\"\n{gold - name}\n-> END\n"))
+	assert.Nil(t, story.PostParsing())
+	_, err = story.Resume(NewContext())
+	assert.Contains(t, err.Error(), "- needs number argument, but got: a")
+}
+
+func TestRewriteLists(t *testing.T) {
+	assert.Equal(t, "a == _list(b, c)", rewriteLists("a == (b, c)"))
+	assert.Equal(t, "_list() + f(a, b)", rewriteLists("() + f(a, b)"))
+	assert.Equal(t, "LIST_COUNT(_list(a, (b)))", rewriteLists("LIST_COUNT((a, (b)))"))
+	assert.Equal(t, "not _list(a, b) and (1 + 2) * 3", rewriteLists("not (a, b) and (1 + 2) * 3"))
+	assert.Equal(t, `"(a, b)"`, rewriteLists(`"(a, b)"`))
+}
+
+func TestListComparisons(t *testing.T) {
+	input := `
+	LIST doors = (open), closed, locked
+	LIST volume = quiet, (medium), loud
+	~ doors += closed
+	{doors == (open, closed): Equal.}
+	{doors != (open): Not only open.}
+	{doors == open + closed: Same.}
+	{() == (): Empty.}
+	{volume > quiet: Louder.}
+	{volume < loud: Quieter.}
+	{volume >= (quiet, medium): Not less.}
+	{volume <= medium: At most medium.}
+	{(quiet, loud) > medium: Greater.|Overlapping.}
+	{volume == 2: Valued.}
+	Count {LIST_COUNT((open, closed, locked))}.
+	-> END
+	`
+
+	story := Default()
+	assert.Nil(t, story.Parse(input))
+	assert.Nil(t, story.PostParsing())
+
+	sec, err := story.Resume(NewContext())
+	assert.Nil(t, err)
+	assert.Equal(t, "Equal.\nNot only open.\nSame.\nEmpty.\nLouder.\nQuieter.\nNot less.\nAt most medium.\nOverlapping.\nValued.\nCount 3.", sec.Text)
+}
@@ -0,0 +1,206 @@
+package goink
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	logicReg  = regexp.MustCompile(`^~\s*(.*)$`)
+	tempReg   = regexp.MustCompile(`^temp\s+([a-zA-Z_]\w*)\s*=\s*(.+)$`)
+	assignReg = regexp.MustCompile(`^([a-zA-Z_]\w*)\s*([\+\-]?=)\s*([^=].*)$`)
+	incReg    = regexp.MustCompile(`^([a-zA-Z_]\w*)\s*(\+\+|\-\-)$`)
+	returnReg = regexp.MustCompile(`^return(\s+(.+))?$`)
+)
+
+// readLogic parse and insert a new logic line into story
+func readLogic(s *Story, input string, ln int) error {
+	res := logicReg.FindStringSubmatch(input)
+	if res == nil {
+		return errNotMatch
+	}
+
+	l, err := newLogic(res[1])
+	if err != nil {
+		return err
+	}
+
+	l.story = s
+	l.ln = ln
+	l.file = s.file
+	l.parent = s.current
+
+	l.path = s.current.Path() + PathSplit + "l"
+	s.paths[l.path] = l
+
+	if n := s.next(); n != nil {
+		n.SetNext(l)
+		s.current = l
+
+		return nil
+	}
+
+	return errors.New("current line can not set next")
+}
+
+// newLogic parses the statement of the logic line
+func newLogic(input string) (*logic, error) {
+	l := &logic{base: &base{}, raw: input}
+
+	// comment
+	if res := commentReg.FindStringSubmatch(input); res != nil {
+		input = res[1]
+	}
+
+	code := strings.TrimSpace(input)
+	if len(code) == 0 {
+		return nil, errors.New("empty logic line")
+	}
+
+	if res := returnReg.FindStringSubmatch(code); res != nil {
+		// ~ return || ~ return value
+		l.ret = true
+		if code = strings.TrimSpace(res[2]); code == "" {
+			return l, nil
+		}
+	} else if res := tempReg.FindStringSubmatch(code); res != nil {
+		// ~ temp x = value
+		l.name, l.temp = res[1], true
+		code = res[2]
+	} else if res := incReg.FindStringSubmatch(code); res != nil {
+		// ~ x++ || ~ x--
+		l.name = res[1]
+		code = res[1] + " " + res[2][:1] + " 1"
+	} else if res := assignReg.FindStringSubmatch(code); res != nil {
+		// ~ x = value || ~ x += value || ~ x -= value
+		l.name = res[1]
+		code = res[3]
+		if op := res[2]; op != "=" {
+			code = res[1] + " " + op[:1] + " (" + code + ")"
+		}
+	}
+
+	v, err := newExprc(code)
+	if err != nil {
+		return nil, err
+	}
+	l.value = v
+
+	return l, nil
+}
+
+// logic line of the story, which runs the statement when passing through
+type logic struct {
+	*base
+
+	next Node
+	raw  string
+
+	temp  bool
+	ret   bool   // return of the function
+	name  string // name of the assigned variable
+	value *exprc
+}
+
+// SetNext content of the logic line
+func (l *logic) SetNext(obj Node) {
+	l.next = obj
+}
+
+// Next content of the logic line, after running the statement
+func (l *logic) Next() (Node, error) {
+	if err := l.exec(); err != nil {
+		return nil, err
+	}
+
+	if l.next != nil {
+		return l.next, nil
+	}
+
+	return following(l)
+}
+
+// Render nothing of the logic line
+func (l *logic) Render() (text string, tags []string, err error) {
+	return "", nil, nil
+}
+
+// PostParsing of logic line
+func (l *logic) PostParsing() error {
+	if _, ok := l.story.consts[l.name]; ok && l.name != "" && !l.temp && !l.story.local(l.name, l) {
+		return errors.Errorf("can not assign to constant: %s", l.name)
+	}
+
+	if l.ret {
+		if k, _ := l.story.container(l); k == nil || !k.function {
+			return errors.New("return is out of function")
+		}
+		return nil
+	}
+
+	if l.next != nil {
+		return nil
+	}
+
+	_, err := following(l)
+	return err
+}
+
+// eval the value of the logic line
+func (l *logic) eval() (interface{}, error) {
+	if l.value == nil {
+		return nil, nil
+	}
+
+	return l.story.eval(l.value)
+}
+
+// exec the statement of the logic line,
+// the output of called functions is kept in story's output
+func (l *logic) exec() error {
+	if l.ret {
+		return errors.New("return is out of function")
+	}
+
+	s := l.story
+	v, err := l.eval()
+	if err != nil {
+		return err
+	}
+
+	// expression only
+	if l.name == "" {
+		return nil
+	}
+
+	if l.temp {
+		s.temps[l.name] = v
+		s.touch()
+		return nil
+	}
+
+	return s.assign(l.name, v)
+}
+
+// assign the value to a declared variable
+func (s *Story) assign(name string, value interface{}) error {
+	if ref, ok := s.temps[refKey(name)].(string); ok {
+		s.set(ref, value)
+		return nil
+	}
+
+	if _, ok := s.temps[name]; ok {
+		s.temps[name] = value
+		s.touch()
+		return nil
+	}
+
+	if _, ok := s.vars[name]; ok {
+		s.set(name, value)
+		return nil
+	}
+
+	return errors.Errorf("variable is not declared: %s", name)
+}
@@ -0,0 +1,134 @@
+package goink
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogicParsing(t *testing.T) {
+	l, err := newLogic("temp y = 3 // comment")
+	assert.Nil(t, err)
+	assert.True(t, l.temp)
+	assert.Equal(t, "y", l.name)
+
+	l, err = newLogic("gold = gold + 10")
+	assert.Nil(t, err)
+	assert.False(t, l.temp)
+	assert.Equal(t, "gold", l.name)
+	assert.Equal(t, "gold + 10", l.value.raw)
+
+	l, err = newLogic("x++")
+	assert.Nil(t, err)
+	assert.Equal(t, "x + 1", l.value.raw)
+
+	l, err = newLogic("x -= y * 2")
+	assert.Nil(t, err)
+	assert.Equal(t, "x - (y * 2)", l.value.raw)
+
+	l, err = newLogic("x == 2")
+	assert.Nil(t, err)
+	assert.Equal(t, "", l.name)
+
+	_, err = newLogic("  ")
+	assert.Contains(t, err.Error(), "empty logic")
+
+	_, err = newLogic("x = ")
+	assert.NotNil(t, err)
+}
+
+func TestLogicAssignment(t *testing.T) {
+	input := `
+	VAR gold = 0
+	VAR visited = false
+	You have {gold} coins.
+	~ gold = gold + 10
+	~ visited = true
+	Now you have {gold} coins.
+	-> knot
+	== knot
+	~ temp bonus = 5
+	~ gold += bonus
+	~ gold++
+	Gold: {gold}, bonus: {bonus}.
+	* [spend]
+	  ~ gold -= bonus * 2
+	  Left {gold}, bonus {bonus}. -> stitch
+	= stitch
+	{bonus == nil: no bonus|bonus {bonus}} -> END
+	`
+
+	story := Default()
+	err := story.Parse(input)
+	assert.Nil(t, err)
+	assert.Nil(t, story.PostParsing())
+
+	ctx := NewContext()
+	sec, err := story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Contains(t, sec.Text, "You have 0 coins.\nNow you have 10 coins.\nGold: 16, bonus: 5.")
+	assert.Equal(t, true, ctx.Vars["visited"])
+	assert.Equal(t, 5, ctx.Temps["bonus"])
+
+	// temp variables survive the context round trip
+	sec, err = story.Pick(ctx, 0)
+	assert.Nil(t, err)
+	assert.Contains(t, sec.Text, "Left 6, bonus 5.")
+	assert.Contains(t, sec.Text, "no bonus")
+	assert.Equal(t, 6, ctx.Vars["gold"])
+	assert.Empty(t, ctx.Temps)
+}
+
+func TestLogicErrors(t *testing.T) {
+	input := `
+	~ undeclared = 1
+	-> END
+	`
+
+	story := Default()
+	err := story.Parse(input)
+	assert.Nil(t, err)
+
+	_, err = story.Resume(NewContext())
+	assert.Contains(t, err.Error(), "variable is not declared: undeclared ln: 2")
+
+	input = `
+	~ temp x = 1
+	`
+
+	story = Default()
+	err = story.Parse(input)
+	assert.Nil(t, err)
+
+	errs := story.PostParsing()
+	assert.Contains(t, errs[0].Error(), "can not go next")
+}
+
+func TestLogicEnv(t *testing.T) {
+	input := `
+	VAR x = 1
+	~ temp y = x + 1
+	{x} {y}
+	~ x = y * 2
+	~ y = 3
+	Now {x} {y} -> END
+	`
+
+	story := Default()
+	assert.Nil(t, story.Parse(input))
+	assert.Nil(t, story.PostParsing())
+
+	ctx := NewContext()
+	sec, err := story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "1 2\nNow 4 3", sec.Text)
+
+	// the env is kept until the state is changed
+	env := story.env()
+	assert.Equal(t, reflect.ValueOf(env).Pointer(), reflect.ValueOf(story.env()).Pointer())
+
+	story.set("x", 5)
+	assert.Equal(t, 5, story.env()["x"])
+	assert.Equal(t, 4, env["x"])
+}
@@ -0,0 +1,60 @@
+package goink
+
+import (
+	"reflect"
+
+	"github.com/pkg/errors"
+)
+
+// Observer of the variable, which is called when the variable is changed,
+// the changes are notified after the story is resumed or picked,
+// so the observer could call the story
+type Observer func(name string, old, new interface{})
+
+// change of the variable, with its observers
+type change struct {
+	name     string
+	old, new interface{}
+	fns      []Observer
+}
+
+// ObserveVariable registers the observer of the variable,
+// the name "*" observes all the variables
+func (s *Story) ObserveVariable(name string, fn Observer) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if _, ok := s.defaults[name]; !ok && name != "*" {
+		return errors.Errorf("variable is not declared: %s", name)
+	}
+
+	s.observers[name] = append(s.observers[name], fn)
+	return nil
+}
+
+// set the variable, and queue the change for the observers if it is changed
+func (s *Story) set(name string, value interface{}) {
+	old := s.vars[name]
+	s.vars[name] = value
+	s.touch()
+
+	if s.muted || reflect.DeepEqual(old, value) {
+		return
+	}
+
+	var fns []Observer
+	fns = append(fns, s.observers[name]...)
+	fns = append(fns, s.observers["*"]...)
+	if len(fns) > 0 {
+		s.changes = append(s.changes, change{name: name, old: old, new: value, fns: fns})
+	}
+}
+
+// notify the observers of the changes
+func notify(changes []change) {
+	for _, c := range changes {
+		for _, fn := range c.fns {
+			fn(c.name, c.old, c.new)
+		}
+	}
+}
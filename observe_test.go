@@ -0,0 +1,97 @@
+package goink
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObserveVariable(t *testing.T) {
+	input := `
+	VAR health = 10
+	VAR quest = "none"
+	~ health = health - 3
+	~ health = 7
+	~ quest = "dragon"
+	* [Rest]
+	  ~ health = 10
+	  -> END
+	`
+
+	story := Default()
+	err := story.Parse(input)
+	assert.Nil(t, err)
+	assert.Nil(t, story.PostParsing())
+
+	var health [][]interface{}
+	assert.Nil(t, story.ObserveVariable("health", func(name string, old, new interface{}) {
+		health = append(health, []interface{}{old, new})
+	}))
+
+	var all []string
+	assert.Nil(t, story.ObserveVariable("*", func(name string, old, new interface{}) {
+		all = append(all, name)
+	}))
+
+	ctx := NewContext()
+	_, err = story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]interface{}{{10, 7}}, health)
+	assert.Equal(t, []string{"health", "quest"}, all)
+
+	// loading the context is not a change
+	_, err = story.Resume(ctx)
+	assert.Nil(t, err)
+	_, err = story.Explain(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(health))
+
+	_, err = story.Pick(ctx, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]interface{}{{10, 7}, {7, 10}}, health)
+	assert.Equal(t, []string{"health", "quest", "health"}, all)
+
+	e := story.ObserveVariable("mana", func(name string, old, new interface{}) {})
+	assert.Equal(t, "variable is not declared: mana", e.Error())
+}
+
+func TestObserveOnce(t *testing.T) {
+	input := `
+	VAR x = 0
+	{bump() > 0} Bumped {x}.
+	{&{bump()}|{bump()}} in the loop.
+	Hello.
+	* [Again] -> fail
+	== fail
+	~ bump()
+	{x / 0}
+	-> END
+	== function bump()
+	~ x = x + 1
+	~ return x
+	`
+
+	story := Default()
+	assert.Nil(t, story.Parse(input))
+	assert.Nil(t, story.PostParsing())
+
+	// the observer is called after the story is unlocked,
+	// so it could call the story
+	var changes [][]interface{}
+	assert.Nil(t, story.ObserveVariable("x", func(name string, old, new interface{}) {
+		_, err := story.Explain(NewContext())
+		assert.NotNil(t, err)
+		changes = append(changes, []interface{}{old, new})
+	}))
+
+	ctx := NewContext()
+	sec, err := story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "Bumped 1.\n2 in the loop.\nHello.", sec.Text)
+	assert.Equal(t, [][]interface{}{{0, 1}, {1, 2}}, changes)
+
+	// the changes of the failed step are not notified
+	_, err = story.Pick(ctx, 0)
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, len(changes))
+}
@@ -10,8 +10,12 @@ import (
 
 var (
 	optsReg       = regexp.MustCompile(`(^(\+\s*)+|^(\*\s*)+)(.+)`)
-	exprReg       = regexp.MustCompile(`\{(.+)\}(.*)`)
 	supressingReg = regexp.MustCompile(`(^.*)\[(.*)\](.*$)`)
+
+	blockReg      = regexp.MustCompile(`^\{(.*)$`)
+	branchReg     = regexp.MustCompile(`^-\s*([^-\s].*)$`)
+	blockCloseReg = regexp.MustCompile(`^\}$`)
+	elseReg       = regexp.MustCompile(`^else$`)
 )
 
 // readOption parse and insert a new option into story
@@ -22,13 +26,22 @@ func readOption(s *Story, input string, ln int) error {
 		// findout nesting num
 		nesting := len(strings.Join(strings.Fields(res[1]), ""))
 
-		// create new option
-		i, err := newLine(res[4])
-		i.ln = ln
+		// fallback option without divert target: * ->
+		text, bare := res[4], false
+		if t := strings.TrimSpace(text); strings.HasSuffix(t, "->") && !strings.HasSuffix(t, "->->") {
+			if t = strings.TrimSpace(t[:len(t)-2]); t == "" || t == "[]" || strings.HasSuffix(t, "}") || strings.HasSuffix(t, ")") {
+				text, bare = t, true
+			}
+		}
 
+		// create new option
+		i, err := newLine(text)
 		if err != nil {
 			return err
 		}
+
+		i.ln = ln
+		i.file = s.file
 		o := &opt{line: i}
 		o.story = s
 
@@ -46,7 +59,7 @@ func readOption(s *Story, input string, ln int) error {
 		}
 
 		if opts == nil {
-			opts = &options{base: &base{story: s, parent: s.current, ln: ln}, nesting: nesting}
+			opts = &options{base: &base{story: s, parent: s.current, ln: ln, file: s.file}, nesting: nesting}
 
 			opts.path = s.current.Path() + PathSplit + "c"
 			s.paths[opts.path] = opts
@@ -65,17 +78,25 @@ func readOption(s *Story, input string, ln int) error {
 		o.parent = opts
 		s.current = o
 
+		// parsing label
+		if err := i.parseLabel(o); err != nil {
+			return err
+		}
+
 		// condition exprc parsing
 		if err := o.parseExprc(); err != nil {
 			return err
 		}
 
-		// parsing label
-		if err := i.parseLabel(); err != nil {
-			return err
+		// spaces before the divert are not in the text
+		o.text = strings.TrimRight(o.text, " \t")
+
+		// fallback option has no text
+		if t := strings.TrimSpace(o.text); (t == "" || t == "[]") && (bare || o.divert != nil) {
+			o.fallback = true
 		}
 
-		return nil
+		return o.parseContent()
 	}
 
 	return errNotMatch
@@ -96,6 +117,11 @@ func (s *Story) findParentOptions(nesting int) (opts *options, err error) {
 			}
 		}
 
+		// options out of the branch
+		if _, ok := node.(*branch); ok {
+			break
+		}
+
 		node = node.Parent()
 	}
 
@@ -111,64 +137,162 @@ type options struct {
 	nesting int
 }
 
-// options of the choices
-func (c *options) list() (os []*opt) {
+// options of the choices, without the fallback ones
+func (c *options) list() (os []*opt, err error) {
+	// options generated before the condition test
+	offset := c.story.choices
+	defer func() { c.story.choices = offset }()
+
 	for _, opt := range c.opts {
-		// condition test
-		if opt.condition != nil {
-			b, err := opt.condition.Bool(c.story.vars)
-			if err != nil {
-				panic(err)
-			}
+		c.story.choices = offset + len(os)
+		if opt.fallback {
+			continue
+		}
+
+		ok, err := c.available(opt)
+		if err != nil {
+			return nil, err
+		} else if ok {
+			os = append(os, opt)
+		}
+	}
+	return os, nil
+}
+
+// fallback option, which is taken when no other option is available
+func (c *options) fallback() (*opt, error) {
+	for _, opt := range c.opts {
+		if !opt.fallback {
+			continue
+		}
+
+		if ok, err := c.available(opt); err != nil || ok {
+			return opt, err
+		}
+	}
+	return nil, nil
+}
+
+// available option passes the condition test, and is not used up
+func (c *options) available(opt *opt) (bool, error) {
+	reasons, err := c.explain(opt, true)
+	return len(reasons) == 0, err
+}
+
+// explain why the option is hidden, it stops at the first reason if quick
+func (c *options) explain(opt *opt, quick bool) (reasons []string, err error) {
+	// will not display, when condition test is false
+	// no matter sticky or not
+	for _, cond := range opt.conditions {
+		b, err := c.story.test(cond)
+		if err != nil {
+			return nil, err
+		}
 
-			// will not display, when condition test is false
-			// no matter sticky or not
-			if !b {
-				continue
+		if !b {
+			if reasons = append(reasons, "condition is false: "+cond.raw); quick {
+				return reasons, nil
 			}
 		}
+	}
 
-		// sticky or once-only
-		if opt.sticky {
-			os = append(os, opt)
-		} else if count, ok := c.story.vars[opt.Path()]; !ok || count == 0 {
-			os = append(os, opt)
+	// sticky or once-only
+	if !opt.sticky && c.story.visits[opt.Path()] > 0 {
+		reasons = append(reasons, "once-only option is used")
+	}
+
+	return reasons, nil
+}
+
+// Hidden option of the choices, and the reasons why it is hidden
+type Hidden struct {
+	Path    string   `json:"path"`
+	Text    string   `json:"text"`
+	Reasons []string `json:"reasons"`
+}
+
+// Explain why the options of the current choices are hidden,
+// the context is not changed
+func (s *Story) Explain(ctx *Context) (hidden []Hidden, err *ErrInk) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.engine != nil {
+		return nil, wrapError(errors.New("can not explain the compiled story"), -1)
+	}
+
+	s.muted = true
+	defer func() { s.muted = false }()
+
+	// the context is copied by loading
+	if err := s.load(ctx); err != nil {
+		return nil, wrapError(err, -1)
+	}
+
+	points := s.points()
+	if len(points) == 0 {
+		return nil, errorOf(errors.New("current line is not an option"), s.current)
+	}
+
+	for _, p := range points {
+		for _, o := range p.opts {
+			reasons, e := p.explain(o, false)
+			if e != nil {
+				return nil, errorOf(e, o)
+			}
+
+			if len(reasons) > 0 {
+				text, _, e := o.list()
+				if e != nil {
+					return nil, errorOf(e, o)
+				}
+				hidden = append(hidden, Hidden{Path: o.Path(), Text: unescape(text), Reasons: reasons})
+			}
 		}
 	}
-	return os
+
+	return
 }
 
 // List all available options' content
-func (c *options) List() (text []string, tags [][]string) {
-	if opts := c.list(); len(opts) > 0 {
-		for _, opt := range opts {
-			str, tag := opt.list()
-			text = append(text, str)
-			tags = append(tags, tag)
-		}
+func (c *options) List() (text []string, tags [][]string, err error) {
+	opts, err := c.list()
+	if err != nil {
+		return nil, nil, err
+	}
 
-		return
+	for _, opt := range opts {
+		str, tag, err := opt.list()
+		if err != nil {
+			return nil, nil, err
+		}
+		text = append(text, str)
+		tags = append(tags, tag)
 	}
 
-	panic(errors.Errorf("no option available: %s", c.Path()))
+	return
 }
 
-func (c *options) pick(idx int) *opt {
+func (c *options) pick(idx int) (*opt, error) {
 	// filtered options
-	opts := c.list()
+	opts, err := c.list()
+	if err != nil {
+		return nil, err
+	}
 
 	if idx >= len(opts) || idx < 0 {
-		return nil
+		return nil, nil
 	}
 
-	opt := opts[idx]
-	return opt
+	return opts[idx], nil
 }
 
 // Pick the option of the choices by index
 func (c *options) Pick(idx int) (Node, error) {
-	res := c.pick(idx)
-	if res == nil {
+	res, err := c.pick(idx)
+	if err != nil {
+		return nil, err
+	} else if res == nil {
 		return nil, errors.Errorf("no option available [%s] at idx: %d", c.Path(), idx)
 	}
 
@@ -179,47 +303,312 @@ func (c *options) Pick(idx int) (Node, error) {
 type opt struct {
 	*line
 
-	sticky    bool
-	condition *exprc
-}
+	sticky     bool
+	fallback   bool     // taken automatically, when no other option is available
+	conditions []*exprc // all of them should be passed
 
-var ()
+	// content splitted by supressing
+	before content
+	middle content
+	after  content
+}
 
 // render option text with supressing
-func (o *opt) render(supressing bool) string {
-	res := supressingReg.FindStringSubmatch(o.text)
-	if res != nil {
-		before := res[1]
-		middle := res[2]
-		after := res[3]
+func (o *opt) render(supressing bool) (string, error) {
+	rest := o.after
+	if supressing {
+		rest = o.middle
+	}
 
-		if supressing {
-			return before + middle
-		}
-		return before + after
+	before, err := o.line.render(o.before)
+	if err != nil {
+		return "", err
 	}
-	return o.text
+
+	after, err := o.line.render(rest)
+	return before + after, err
 }
 
 // Render option text without supressing
-func (o *opt) Render() (str string, tags []string) {
-	return o.render(false), o.tags
+func (o *opt) Render() (str string, tags []string, err error) {
+	str, err = o.render(false)
+	return str, o.tags, err
 }
 
 // List option text with supressing = true
-func (o *opt) list() (str string, tags []string) {
-	return o.render(true), o.tags
+func (o *opt) list() (str string, tags []string, err error) {
+	str, err = o.render(true)
+	return str, o.tags, err
 }
 
+// parse the stacked conditions at the beginning of the option: {a} {b}
 func (o *opt) parseExprc() error {
-	if res := exprReg.FindStringSubmatch(o.text); res != nil {
-		if c, err := newExprc(strings.TrimSpace(res[1])); err == nil {
-			o.condition = c
-			o.text = res[2]
-		} else {
+	for {
+		text := strings.TrimLeft(o.text, " \t")
+		if !strings.HasPrefix(text, "{") {
+			return nil
+		}
+
+		end := matchBrace(text, 0)
+		if end < 0 {
+			return errors.Errorf("unclosed brace: %s", o.text)
+		}
+
+		seg, err := parseInline(text[1:end])
+		if err != nil {
 			return err
 		}
+
+		// inline conditional text, not the condition of option
+		c, ok := seg.(*inline)
+		if !ok {
+			return nil
+		}
+
+		o.conditions = append(o.conditions, c.exprc)
+		o.text = strings.TrimLeft(text[end+1:], " \t")
+	}
+}
+
+// parse the option text into supressed contents
+func (o *opt) parseContent() (err error) {
+	before, middle, after := o.text, "", ""
+	if res := supressingReg.FindStringSubmatch(o.text); res != nil {
+		before, middle, after = res[1], res[2], res[3]
+	}
+
+	if o.before, err = parseContent(before); err != nil {
+		return
+	}
+	if o.middle, err = parseContent(middle); err != nil {
+		return
+	}
+	if o.after, err = parseContent(after); err != nil {
+		return
+	}
+
+	o.after.index(o.middle.index(o.before.index(0)))
+	return
+}
+
+// readBlock parse the multi-line conditional block, and its branches
+func readBlock(s *Story, input string, ln int) error {
+	// { cond: || { value: || {
+	if res := blockReg.FindStringSubmatch(input); res != nil && matchBrace(input, 0) < 0 {
+		header := strings.TrimSpace(res[1])
+		if header != "" && !strings.HasSuffix(header, ":") {
+			return errors.Errorf("conditional block should be ended with colon: %s", input)
+		}
+
+		n := s.next()
+		if n == nil {
+			return errors.Errorf("node: [%s] can not go next", s.current.Path())
+		}
+
+		b := &block{base: &base{story: s, parent: s.current, ln: ln, file: s.file}}
+		b.path = s.current.Path() + PathSplit + "b"
+		s.paths[b.path] = b
+
+		n.SetNext(b)
+		s.current = b
+
+		if header = strings.TrimSuffix(header, ":"); header != "" {
+			c, err := newExprc(strings.TrimSpace(header))
+			if err != nil {
+				return err
+			}
+
+			// could be the value of switch block,
+			// if the next line is a branch
+			br := b.branch(c, ln)
+			br.implicit = true
+		}
+
+		return nil
+	}
+
+	b := s.openBlock()
+	if b == nil {
+		return errNotMatch
+	}
+
+	// }
+	if blockCloseReg.MatchString(input) {
+		b.closed = true
+		s.current = b
+		return nil
+	}
+
+	// - cond: || - value: || - else:
+	res := branchReg.FindStringSubmatch(input)
+	if res == nil {
+		return errNotMatch
+	}
+
+	parts := splitTop(res[1], ':')
+	if len(parts) < 2 {
+		return errNotMatch
+	}
+	cond := strings.TrimSpace(parts[0])
+	rest := strings.TrimSpace(strings.Join(parts[1:], ":"))
+
+	// the block of the header condition only has the else branch,
+	// other lines are the gathers of its content: - you say: hello
+	if h := b.branches; !elseReg.MatchString(cond) && len(h) > 0 && h[0].implicit && h[0].next != nil {
+		return errNotMatch
+	}
+
+	// the header is the value of switch block
+	value := b.value
+	header := len(b.branches) == 1 && b.branches[0].implicit && b.branches[0].next == nil
+	if header {
+		value = b.branches[0].condition
+	}
+
+	var c *exprc
+	if !elseReg.MatchString(cond) {
+		code := cond
+		if value != nil {
+			code = "(" + value.raw + ") == (" + cond + ")"
+		}
+
+		// not a condition, but the text of a gather
+		var err error
+		if c, err = newExprc(code); err != nil {
+			return errNotMatch
+		}
+	}
+
+	if header {
+		b.value = value
+		delete(s.paths, b.branches[0].path)
+		b.branches = nil
+	}
+	b.branch(c, ln)
+
+	// content of the branch in the same line
+	if rest != "" {
+		return s.parse(rest, ln)
 	}
 
 	return nil
 }
+
+// find the open block of the current node
+func (s *Story) openBlock() *block {
+	node := s.current
+	for node != nil {
+		switch n := node.(type) {
+		case *block:
+			if !n.closed {
+				return n
+			}
+		case *branch:
+			return n.block
+		}
+
+		node = node.Parent()
+	}
+
+	return nil
+}
+
+// block of the conditional content, which has one or more branches
+type block struct {
+	*base
+
+	next     Node
+	value    *exprc // value of the switch block
+	branches []*branch
+	closed   bool
+}
+
+// add a new branch to the block
+func (b *block) branch(c *exprc, ln int) *branch {
+	br := &branch{base: &base{story: b.story, parent: b, ln: ln, file: b.story.file}, block: b, condition: c}
+	br.path = b.path + PathSplit + strconv.Itoa(len(b.branches))
+	b.story.paths[br.path] = br
+
+	b.branches = append(b.branches, br)
+	b.story.current = br
+
+	return br
+}
+
+// SetNext content of the block, which rejoins the flow
+func (b *block) SetNext(obj Node) {
+	b.next = obj
+}
+
+// Next content of the block, which is the first matched branch
+func (b *block) Next() (Node, error) {
+	for _, br := range b.branches {
+		if br.condition == nil {
+			return br, nil
+		}
+
+		ok, err := b.story.test(br.condition)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			return br, nil
+		}
+	}
+
+	return b.following()
+}
+
+// node after the block
+func (b *block) following() (Node, error) {
+	if b.next != nil {
+		return b.next, nil
+	}
+
+	return following(b)
+}
+
+// Render nothing of the block
+func (b *block) Render() (text string, tags []string, err error) {
+	return "", nil, nil
+}
+
+// PostParsing of the block
+func (b *block) PostParsing() error {
+	if !b.closed {
+		return errors.New("conditional block is not closed")
+	}
+
+	_, err := b.following()
+	return err
+}
+
+// branch of the block
+type branch struct {
+	*base
+
+	block     *block
+	condition *exprc // nil for else branch
+	next      Node
+	implicit  bool // branch of the header condition
+}
+
+// SetNext content of the branch, which is the first one
+func (b *branch) SetNext(obj Node) {
+	b.next = obj
+}
+
+// Next content of the branch, or rejoin the flow if it is empty
+func (b *branch) Next() (Node, error) {
+	if b.next != nil {
+		return b.next, nil
+	}
+
+	return b.block.following()
+}
+
+// Render nothing of the branch
+func (b *branch) Render() (text string, tags []string, err error) {
+	return "", nil, nil
+}
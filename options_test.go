@@ -43,6 +43,30 @@ func TestOptionsParse(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestOptionDivertText(t *testing.T) {
+	input := `
+	* Go north -> north
+	* Go {"east"}   -> north
+	* Go west[.] now  -> north
+	== north
+	North.
+	-> END
+	`
+	story := Default()
+	assert.Nil(t, story.Parse(input))
+	assert.Nil(t, story.PostParsing())
+
+	// the spaces before the divert are trimmed
+	ctx := NewContext()
+	sec, err := story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Go north", "Go east", "Go west."}, sec.Opts)
+
+	sec, err = story.Pick(ctx, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, "Go west now\nNorth.", sec.Text)
+}
+
 func TestGatherOfOptions(t *testing.T) {
 	input := `
 	* Opt [ABC]DEF
@@ -72,6 +96,34 @@ func TestGatherOfOptions(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestGatherScope(t *testing.T) {
+	input := `
+	-> knot
+	== knot
+	~ temp x = 1
+	* a
+	* b
+	- gather {x}. -> END
+	`
+
+	story := Default()
+	err := story.Parse(input)
+	assert.Nil(t, err)
+	assert.Nil(t, story.PostParsing())
+
+	// the gather is the sibling of its options, which is in the knot
+	k, _ := story.container(story.paths["knot__l__c__g"])
+	assert.Equal(t, story.paths["knot"], k)
+
+	ctx := NewContext()
+	_, err = story.Resume(ctx)
+	assert.Nil(t, err)
+
+	sec, err := story.Pick(ctx, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "a\ngather 1.", sec.Text)
+}
+
 func TestOnceOnlyOption(t *testing.T) {
 	input := `
     Hello
@@ -135,13 +187,19 @@ func TestGatherParsing(t *testing.T) {
 	assert.Contains(t, sec.Text, "opt a.1 content")
 	assert.Contains(t, sec.Text, "gather")
 
+	// gather without options continues the flow, as inklecate accepts a
+	// weave which starts with a gather, so it is no longer a parsing error
 	input = `
 	- gather -> END
 	`
 
 	story = Default()
 	err = story.Parse(input)
-	assert.NotNil(t, err)
+	assert.Nil(t, err)
+
+	sec, err = story.Resume(NewContext())
+	assert.Nil(t, err)
+	assert.Equal(t, "gather", sec.Text)
 
 	input = `
 	* a
@@ -266,3 +324,408 @@ func TestOptionPostParsing(t *testing.T) {
 	errs := story.PostParsing()
 	assert.Contains(t, errs[0].Error(), "can not find the divert")
 }
+
+func TestLabeledConditionalOption(t *testing.T) {
+	input := `
+	VAR gold = 3
+	* (buy) {gold > 2} Buy it for {gold} coins -> END
+	* (leave) {gold > 5} Leave -> END
+	`
+
+	story := Default()
+	err := story.Parse(input)
+	assert.Nil(t, err)
+
+	opts := story.paths["start__c"].(*options)
+	assert.Equal(t, "buy", opts.opts[0].path)
+	assert.Equal(t, 1, len(opts.opts[0].conditions))
+
+	ctx := NewContext()
+	sec, err := story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Buy it for 3 coins"}, sec.Opts)
+}
+
+func TestConditionalBlock(t *testing.T) {
+	input := `
+	VAR gold = 5
+	{ gold > 3:
+	  You are rich.
+	  ~ gold = gold - 3
+	- else:
+	  You are poor.
+	}
+	{
+	- gold == 0: Nothing left.
+	- gold < 3:
+	  * [Beg]
+	    You beg for money. -> END
+	  * [Leave] -> END
+	- else: Still {gold} coins.
+	}
+	{ gold:
+	- 0: zero
+	- 1:
+	  one
+	- 2: two
+	- else: lots
+	}
+	The end. -> END
+	`
+
+	story := Default()
+	err := story.Parse(input)
+	assert.Nil(t, err)
+	assert.Nil(t, story.PostParsing())
+
+	ctx := NewContext()
+	sec, err := story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "You are rich.", sec.Text)
+	assert.Equal(t, 2, len(sec.Opts))
+
+	sec, err = story.Pick(ctx, 0)
+	assert.Nil(t, err)
+	assert.Contains(t, sec.Text, "You beg for money.")
+	assert.True(t, sec.End)
+
+	ctx = NewContext()
+	ctx.Vars["gold"] = 10
+	sec, err = story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Contains(t, sec.Text, "You are rich.\nStill 7 coins.\nlots\nThe end.")
+
+	ctx = NewContext()
+	ctx.Vars["gold"] = 0
+	sec, err = story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Contains(t, sec.Text, "You are poor.\nNothing left.\nzero\nThe end.")
+
+	ctx = NewContext()
+	ctx.Vars["gold"] = 3
+	sec, err = story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Contains(t, sec.Text, "You are poor.\nStill 3 coins.\nlots")
+
+	// the gathers in the block are not branches
+	input = `
+	VAR gold = 5
+	{ gold > 3:
+	  - You say: hello
+	- else:
+	  poor
+	}
+	{
+	- gold > 3: rich
+	- Nobody says: bye
+	}
+	-> END
+	`
+
+	story = Default()
+	err = story.Parse(input)
+	assert.Nil(t, err)
+	assert.Nil(t, story.PostParsing())
+
+	sec, err = story.Resume(NewContext())
+	assert.Nil(t, err)
+	assert.Equal(t, "You say: hello\nrich\nNobody says: bye", sec.Text)
+}
+
+func TestNestedConditionalBlock(t *testing.T) {
+	input := `
+	VAR a = true
+	VAR b = false
+	* Opt A
+	  { a:
+	    { b:
+	      a and b
+	    - else:
+	      a not b
+	    }
+	    * * Opt A.1
+	    * * Opt A.2
+	    - - gather a
+	  }
+	* Opt B
+	- gather -> END
+	`
+
+	story := Default()
+	err := story.Parse(input)
+	assert.Nil(t, err)
+	assert.Nil(t, story.PostParsing())
+
+	ctx := NewContext()
+	sec, err := story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(sec.Opts))
+
+	sec, err = story.Pick(ctx, 0)
+	assert.Nil(t, err)
+	assert.Contains(t, sec.Text, "a not b")
+	assert.Equal(t, []string{"Opt A.1", "Opt A.2"}, sec.Opts)
+
+	sec, err = story.Pick(ctx, 1)
+	assert.Nil(t, err)
+	assert.Contains(t, sec.Text, "gather a\ngather")
+	assert.True(t, sec.End)
+}
+
+func TestConditionalBlockErrors(t *testing.T) {
+	input := `
+	{ a > 0
+	  text
+	}
+	`
+	story := Default()
+	err := story.Parse(input)
+	assert.Contains(t, err.Error(), "ended with colon")
+
+	input = `
+	{
+	  text
+	}
+	`
+	story = Default()
+	err = story.Parse(input)
+	assert.Contains(t, err.Error(), "can not set next")
+
+	input = `
+	{ a:
+	  text
+	`
+	story = Default()
+	err = story.Parse(input)
+	assert.Nil(t, err)
+
+	errs := story.PostParsing()
+	assert.NotNil(t, errs)
+
+	input = `
+	{
+	- a >: text
+	}
+	`
+	story = Default()
+	err = story.Parse(input)
+	assert.NotNil(t, err)
+}
+
+func TestFallbackOptions(t *testing.T) {
+	input := `
+	-> menu
+	== menu
+	What do you want?
+	* [Tea] Tea. -> menu
+	* [Coffee] Coffee. -> menu
+	* -> out
+	== out
+	Nothing left. -> END
+	`
+
+	story := Default()
+	err := story.Parse(input)
+	assert.Nil(t, err)
+	assert.Nil(t, story.PostParsing())
+
+	assert.True(t, story.paths["menu__i__c__2"].(*opt).fallback)
+
+	ctx := NewContext()
+	sec, err := story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Tea", "Coffee"}, sec.Opts)
+
+	sec, err = story.Pick(ctx, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Coffee"}, sec.Opts)
+
+	// drain into the fallback
+	sec, err = story.Pick(ctx, 0)
+	assert.Nil(t, err)
+	assert.Contains(t, sec.Text, "Nothing left.")
+	assert.True(t, sec.End)
+
+	input = `
+	VAR gold = 0
+	* {gold > 0} [Buy] -> END
+	* [] ->
+	  You are broke.
+	  -> END
+	`
+
+	story = Default()
+	err = story.Parse(input)
+	assert.Nil(t, err)
+	assert.Nil(t, story.PostParsing())
+
+	sec, err = story.Resume(NewContext())
+	assert.Nil(t, err)
+	assert.Equal(t, "You are broke.", sec.Text)
+	assert.True(t, sec.End)
+
+	// once-only menu without fallback
+	input = `
+	-> top
+	== top
+	* [A] -> top
+	`
+
+	story = Default()
+	err = story.Parse(input)
+	assert.Nil(t, err)
+	assert.Nil(t, story.PostParsing())
+
+	ctx = NewContext()
+	_, err = story.Resume(ctx)
+	assert.Nil(t, err)
+
+	_, err = story.Pick(ctx, 0)
+	assert.Contains(t, err.Error(), "no option available")
+}
+
+func TestStackedConditions(t *testing.T) {
+	input := `
+	VAR a = true
+	VAR b = false
+	VAR gold = 3
+	VAR name = "Joe"
+	{a and gold > 1} {not b} Hello, {name}.
+	{b == true} You never see this. -> END
+	{a} {not b} Both are bools.
+	{not b} {a} In any order.
+	{b} You never see this either.
+	{gold} Some gold.
+	{name}
+	* {a} {not b} {gold > 5} [Buy] -> END
+	* {a} {gold > 1} [Sell] Sold.
+	* [Leave] -> END
+	- {gold > 1} {not b} Bye.
+	{not a} Never.
+	-> END
+	`
+
+	story := Default()
+	err := story.Parse(input)
+	assert.Nil(t, err)
+	assert.Nil(t, story.PostParsing())
+
+	ctx := NewContext()
+	sec, err := story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "Hello, Joe.\nBoth are bools.\nIn any order.\nSome gold.\nJoe", sec.Text)
+	assert.Equal(t, []string{"Sell", "Leave"}, sec.Opts)
+
+	hidden, err := story.Explain(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(hidden))
+	assert.Equal(t, "Buy", hidden[0].Text)
+	assert.Equal(t, []string{"condition is false: gold > 5"}, hidden[0].Reasons)
+
+	buy := story.paths[hidden[0].Path].(*opt)
+	assert.Equal(t, 3, len(buy.conditions))
+	assert.Equal(t, "gold > 5", buy.conditions[2].raw)
+
+	sec, err = story.Pick(ctx, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, " Sold.\nBye.", sec.Text)
+	assert.True(t, sec.End)
+}
+
+func TestExplainContext(t *testing.T) {
+	input := `
+	VAR x = 0
+	* {bump()} [Bump]
+	* [Stay] -> END
+	- -> END
+	== function bump()
+	~ x = x + 1
+	~ return x > 5
+	`
+
+	story := Default()
+	assert.Nil(t, story.Parse(input))
+	assert.Nil(t, story.PostParsing())
+
+	ctx := NewContext()
+	sec, err := story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Stay"}, sec.Opts)
+	assert.Equal(t, 1, ctx.Vars["x"])
+
+	// the conditions are tested again, but the context is not changed
+	hidden, err := story.Explain(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "Bump", hidden[0].Text)
+	assert.Equal(t, 1, ctx.Vars["x"])
+}
+
+func TestNestedWeave(t *testing.T) {
+	input := `
+	-> tavern
+	== tavern
+	- (top)
+	* [Drink]
+	  You drink.
+	  ** [Again]
+	     Another one.
+	  ** [Stop]
+	  -- (drunk) You feel dizzy.
+	  ** [Sing]
+	     You sing loudly.
+	  ** [Sleep]
+	  -- You wake up.
+	* [Leave]-> outside
+	- g1
+	- (g2) g2
+	* [Back] -> top
+	* [Out] -> outside.door
+	- -> END
+
+	== outside
+	Cold.
+	- (door) The door is shut.-> END
+	`
+
+	story := Default()
+	err := story.Parse(input)
+	assert.Nil(t, err)
+	assert.Nil(t, story.PostParsing())
+
+	ctx := NewContext()
+	sec, err := story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Drink", "Leave"}, sec.Opts)
+
+	sec, err = story.Pick(ctx, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "You drink.", sec.Text)
+	assert.Equal(t, []string{"Again", "Stop"}, sec.Opts)
+
+	sec, err = story.Pick(ctx, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "You feel dizzy.", sec.Text)
+	assert.Equal(t, []string{"Sing", "Sleep"}, sec.Opts)
+
+	sec, err = story.Pick(ctx, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "You sing loudly.\nYou wake up.\ng1\ng2", sec.Text)
+	assert.Equal(t, []string{"Back", "Out"}, sec.Opts)
+
+	// back to the labelled gather at the top
+	sec, err = story.Pick(ctx, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Leave"}, sec.Opts)
+	assert.Equal(t, 2, ctx.Visits["tavern__top"])
+	assert.Equal(t, 1, ctx.Visits["tavern__drunk"])
+
+	sec, err = story.Pick(ctx, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "Cold.\nThe door is shut.", sec.Text)
+	assert.True(t, sec.End)
+
+	// labelled gathers from anywhere
+	assert.IsType(t, &gather{}, story.divert("outside.door", story.paths["tavern"]))
+	assert.IsType(t, &gather{}, story.divert("tavern.g2", story.paths["outside"]))
+	assert.Nil(t, story.divert("g2", story.paths["outside"]))
+}
@@ -4,6 +4,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -22,6 +23,7 @@ type Node interface {
 
 	Path() string
 	LN() int
+	File() string
 }
 
 // End of story
@@ -32,19 +34,20 @@ type End interface {
 // Choices content - which has one/more option(s)
 type Choices interface {
 	Pick(idx int) (Node, error)
-	List() (text []string, tags [][]string)
+	List() (text []string, tags [][]string, err error)
 }
 
 // CanNext content - which can go next
 type CanNext interface {
 	Next() (Node, error)
 	SetNext(node Node)
-	Render() (text string, tags []string)
+	Render() (text string, tags []string, err error)
 }
 
 // ErrInk for transporting the error info
 type ErrInk struct {
 	LN      int    `json:"ln" binding:"required"`
+	File    string `json:"file,omitempty"`
 	Message string `json:"msg" binding:"required"`
 }
 
@@ -58,7 +61,15 @@ func wrapError(err error, ln int) *ErrInk {
 	return &ErrInk{LN: ln, Message: err.Error()}
 }
 
+// errorOf the node, with its line number and file
+func errorOf(err error, n Node) *ErrInk {
+	return &ErrInk{LN: n.LN(), File: n.File(), Message: err.Error()}
+}
+
 func (e *ErrInk) Error() string {
+	if e.File != "" {
+		return e.Message + " file: " + e.File + " ln: " + strconv.Itoa(e.LN)
+	}
 	return e.Message + " ln: " + strconv.Itoa(e.LN)
 }
 
@@ -68,6 +79,7 @@ type base struct {
 	parent Node
 	path   string
 	ln     int
+	file   string
 }
 
 // Story of the node
@@ -90,6 +102,11 @@ func (b *base) LN() int {
 	return b.ln
 }
 
+// File of the node, where it is included from
+func (b *base) File() string {
+	return b.file
+}
+
 // do some post parsing check
 func (b *base) PostParsing() error {
 	return nil
@@ -100,25 +117,112 @@ type Story struct {
 	current Node
 	vars    map[string]interface{}
 
+	// temporary variables of the current scope
+	temps map[string]interface{}
+	scope string
+
+	// arguments bound to the divert target
+	bound map[string]interface{}
+
+	// return points of the tunnels
+	stack []Frame
+
+	// choices gathered by threads
+	threads []*options
+
+	// functions of the story, and the output of the called ones
+	funcs  map[string]interface{}
+	output []string
+	depth  int
+
+	// error of the function called by the expression,
+	// which is raised through the expression's vm
+	fault error
+
+	// functions implemented by the game
+	externals map[string]*external
+
+	// default values of the declared variables
+	defaults map[string]interface{}
+
+	// observers of the variables' changes, which are muted when explaining,
+	// and the changes of the step, which are notified after the step
+	observers map[string][]Observer
+	muted     bool
+	changes   []change
+
+	// constants, which are folded into the expressions
+	consts map[string]interface{}
+
+	// items of the declared lists, and their values by name
+	lists map[string][]ListItem
+	items map[string]interface{}
+
 	start Node
 	end   Node
+	done  Node
 
 	paths   map[string]Node
 	parsers []ParseFunc
 
 	knots []*knot
 
+	// temporary variables by their scopes, which are collected after parsing
+	scopes map[string]map[string]bool
+
 	id  string // story's unique name
 	mux sync.Mutex
 
-	// current parsing line
-	ln int
+	// current parsing line and file
+	ln   int
+	file string
+
+	// read counts of the visited paths, which are apart from the vars
+	visits map[string]int
+
+	// turns of the story, and the last turn of the visited paths
+	turns int
+	seen  map[string]int
+
+	// random source of the context
+	rng *randSource
+
+	// alternatives shown by the rendering of the current step
+	shown map[string]bool
+
+	// env of the expressions, which is rebuilt when the state is changed
+	cached map[string]interface{}
+
+	// options which are generated, when listing the choices
+	choices int
+
+	// notes of the writer
+	todos []Todo
+
+	// resolver of the included files
+	resolver Resolver
+	included map[string]bool
+
+	// engine of the story compiled by inklecate
+	engine *engine
 }
 
 // Resume the story
 func (s *Story) Resume(ctx *Context) (sec *Section, err *ErrInk) {
+	// the observers are notified after unlocking
+	var changes []change
+	defer func() { notify(changes) }()
+
 	s.mux.Lock()
 	defer s.mux.Unlock()
+	s.changes = nil
+
+	if s.engine != nil {
+		if sec, err = s.compiled(s.engine.resume(ctx)); err == nil {
+			changes = s.changes
+		}
+		return
+	}
 
 	if err := s.load(ctx); err != nil {
 		return nil, wrapError(err, -1)
@@ -127,16 +231,30 @@ func (s *Story) Resume(ctx *Context) (sec *Section, err *ErrInk) {
 	if sec, err = s.resume(); err != nil {
 		return nil, err
 	}
+	sec.unescape()
 
 	// update ctx
 	*ctx = s.save()
+	changes = s.changes
 	return
 }
 
 // Pick the option
 func (s *Story) Pick(ctx *Context, idx int) (sec *Section, err *ErrInk) {
+	// the observers are notified after unlocking
+	var changes []change
+	defer func() { notify(changes) }()
+
 	s.mux.Lock()
 	defer s.mux.Unlock()
+	s.changes = nil
+
+	if s.engine != nil {
+		if sec, err = s.compiled(s.engine.pick(ctx, idx)); err == nil {
+			changes = s.changes
+		}
+		return
+	}
 
 	if err := s.load(ctx); err != nil {
 		return nil, wrapError(err, -1)
@@ -145,11 +263,22 @@ func (s *Story) Pick(ctx *Context, idx int) (sec *Section, err *ErrInk) {
 	if sec, err = s.pick(idx); err != nil {
 		return nil, err
 	}
+	sec.unescape()
+
 	// update ctx
 	*ctx = s.save()
+	changes = s.changes
 	return
 }
 
+// compiled section of the engine
+func (s *Story) compiled(sec *Section, err error) (*Section, *ErrInk) {
+	if err != nil {
+		return nil, wrapError(err, -1)
+	}
+	return sec, nil
+}
+
 // SetID of the story
 func (s *Story) SetID(id string) {
 	s.id = id
@@ -157,80 +286,171 @@ func (s *Story) SetID(id string) {
 
 // resume the story
 func (s *Story) resume() (sec *Section, err *ErrInk) {
-	var ns nodes
-loop:
+	sec = &Section{}
 	for {
-		if s.current == nil {
-			return nil, wrapError(errors.New("current node is nil"), -1)
+		if err = s.walk(sec); err != nil {
+			return nil, err
+		}
+
+		points := s.points()
+		if len(points) == 0 {
+			break
+		}
+
+		// choices of current flow and its threads
+		var e error
+		if sec.Opts, sec.OptsTags, e = s.list(points); e != nil {
+			return nil, errorOf(e, s.current)
+		} else if len(sec.Opts) > 0 {
+			sec.Text = strings.TrimRight(sec.Text, " \t\n")
+			return sec, nil
 		}
 
-		ns = append(ns, s.current)
-		if err := s.visit(s.current.Path()); err != nil {
-			return nil, wrapError(err, s.current.LN())
+		// take the fallback, when no option is available
+		c, ok := s.current.(*options)
+		if !ok {
+			return nil, errorOf(errors.Errorf("no option available: %s", s.current.Path()), s.current)
 		}
 
-		switch node := s.current.(type) {
-		case End:
-			break loop
-		case Choices:
-			break loop
+		f, e := c.fallback()
+		if e != nil {
+			return nil, errorOf(e, c)
+		} else if f == nil {
+			return nil, errorOf(errors.Errorf("no option available: %s", c.Path()), c)
+		}
+
+		s.threads = nil
+		s.current = f
+	}
+
+	sec.End = true
+	sec.add(s.current.(End).End())
+	sec.Text = strings.TrimRight(sec.Text, " \t\n")
+	return sec, nil
+}
+
+// walk through the nodes from current one, until the end or choices
+func (s *Story) walk(sec *Section) *ErrInk {
+	mark := len(s.output)
+	for {
+		if s.current == nil {
+			return wrapError(errors.New("current node is nil"), -1)
+		}
+
+		s.enter(s.current)
+		s.visit(s.current)
+
+		// rendering the content when passing through,
+		// so that it reflects the current state of the story
+		switch s.current.(type) {
+		case End, Choices:
+			return nil
 		case CanNext:
-			n, err := node.Next()
+			n, err := s.step(s.current, sec)
 			if err != nil {
-				return nil, wrapError(err, s.current.LN())
+				return errorOf(err, s.current)
 			}
+			sec.add(s.flush(mark), nil)
+
 			s.current = n
 		default:
-			return nil, wrapError(errors.New("current line is not recgonized"), -1)
+			return wrapError(errors.New("current line is not recgonized"), -1)
 		}
 	}
+}
 
-	return ns.section(), nil
+// step through the node, its content is rendered before going next,
+// the conditions of the line are tested once, and the hidden line
+// is skipped without its content and diverts
+func (s *Story) step(node Node, sec *Section) (Node, error) {
+	// the alternatives shown by the step are advanced after rendering
+	shown := s.shown
+	s.shown = make(map[string]bool)
+	defer func() { s.shown = shown }()
+
+	if l := lineOf(node); l != nil && l.conds > 0 {
+		pass, err := l.test()
+		if err != nil {
+			return nil, err
+		} else if !pass {
+			return l.skip()
+		}
+	}
+
+	c := node.(CanNext)
+	text, tags, err := c.Render()
+	if err != nil {
+		return nil, err
+	}
+	sec.add(text, tags)
+
+	for key := range s.shown {
+		s.visits[key]++
+		s.touch()
+	}
+
+	return c.Next()
 }
 
 // pick one of the current choices' option,
 // and resume
 func (s *Story) pick(idx int) (sec *Section, erri *ErrInk) {
-	if c := s.choices(); c != nil {
-		if opt, err := c.Pick(idx); err != nil {
-			return nil, wrapError(err, c.(Node).LN())
-		} else {
-			s.current = opt
-			return s.resume()
+	points := s.points()
+	for i, c := range points {
+		// the option is in current choices or its thread
+		opts, err := c.list()
+		if err != nil {
+			return nil, errorOf(err, c)
+		}
+
+		if n := len(opts); idx >= n && i < len(points)-1 {
+			idx -= n
+			continue
+		}
+
+		opt, err := c.Pick(idx)
+		if err != nil {
+			return nil, errorOf(err, c)
 		}
+
+		s.threads = nil
+		s.current = opt
+		s.turns++
+		return s.resume()
 	}
-	return nil, wrapError(errors.New("current line is not an option"), s.current.LN())
+
+	return nil, errorOf(errors.New("current line is not an option"), s.current)
 }
 
 func (s *Story) next() CanNext {
-	if current, ok := s.current.(CanNext); ok {
-		return current
+	// contents of the block should be in its branches
+	if b, ok := s.current.(*block); ok && !b.closed {
+		return nil
 	}
 
-	return nil
-}
-
-func (s *Story) choices() Choices {
-	if current, ok := s.current.(Choices); ok {
+	if current, ok := s.current.(CanNext); ok {
 		return current
 	}
 
 	return nil
 }
 
-// add visit count to the given path
-func (s *Story) visit(path string) error {
-	if v, ok := s.vars[path]; ok {
-		if n, ok := v.(int); ok {
-			n++
-			s.vars[path] = n
-		} else {
-			return errors.Errorf("variable: <%s> is not type of int", path)
+// visit the node, the read count is increased once per entry
+// of the knot, stitch, option or labelled gather
+func (s *Story) visit(node Node) {
+	switch n := node.(type) {
+	case *knot, *stitch, *opt:
+	case *gather:
+		if !n.labelled {
+			return
 		}
+	default:
+		return
 	}
 
-	s.vars[path] = 1
-	return nil
+	s.visits[node.Path()]++
+	s.seen[node.Path()] = s.turns
+	s.touch()
 }
 
 // load from context
@@ -240,13 +460,308 @@ func (s *Story) load(ctx *Context) error {
 		return errors.Errorf("current path [%s] is not existed", ctx.Current)
 	}
 
+	// the context is copied, it is only updated when the story is resumed
+	vars, visits := copy(ctx.Vars), counts(ctx.Visits)
+
+	// read counts of the older context, which were kept in the vars
+	for k, v := range vars {
+		if _, ok := s.defaults[k]; ok {
+			continue
+		} else if _, ok := s.paths[k]; !ok {
+			continue
+		}
+
+		n, ok := intOf(v)
+		if !ok {
+			return errors.Errorf("variable: <%s> is not type of int", k)
+		}
+		if _, ok := visits[k]; !ok {
+			visits[k] = n
+		}
+		delete(vars, k)
+	}
+
+	s.declare(vars)
 	s.current = n
-	s.vars = ctx.Vars
+	s.vars = vars
+	s.bound = nil
+	s.output, s.depth, s.fault = nil, 0, nil
+
+	s.turns, s.rng = ctx.Turns, newSource(ctx.Seed, ctx.Rolls)
+	s.seen = counts(ctx.Seen)
+	s.visits = visits
+	s.temps = copy(ctx.Temps)
+	s.touch()
+	s.scope = s.scopeOf(n)
+
+	s.stack = nil
+	for _, f := range ctx.Stack {
+		if lineOf(s.paths[f.Path]) == nil {
+			return errors.Errorf("return path [%s] is not existed", f.Path)
+		}
+		s.stack = append(s.stack, Frame{Path: f.Path, Step: f.Step, Temps: copy(f.Temps)})
+	}
+
+	s.threads = nil
+	for _, path := range ctx.Threads {
+		c, ok := s.paths[path].(*options)
+		if !ok {
+			return errors.Errorf("thread path [%s] is not existed", path)
+		}
+		s.threads = append(s.threads, c)
+	}
+
 	return nil
 }
 
+// declare the variables which are not in context yet,
+// and restore the lists and divert targets decoded from json
+func (s *Story) declare(vars map[string]interface{}) {
+	for k, v := range s.defaults {
+		c, ok := vars[k]
+		if !ok {
+			vars[k] = v
+			continue
+		}
+
+		switch v.(type) {
+		case List:
+			if l, ok := listOf(c); ok {
+				vars[k] = l
+			}
+		case DivertTarget:
+			if path, ok := c.(string); ok {
+				vars[k] = DivertTarget(path)
+			}
+		}
+	}
+}
+
 func (s *Story) save() Context {
-	return Context{Current: s.current.Path(), Vars: copy(s.vars), LN: s.current.LN()}
+	ctx := Context{Current: s.current.Path(), Vars: copy(s.vars), Temps: copy(s.temps), LN: s.current.LN()}
+	ctx.Turns, ctx.Seed, ctx.Rolls = s.turns, s.rng.seed, s.rng.rolls
+	ctx.Seen, ctx.Visits = counts(s.seen), counts(s.visits)
+	_, ctx.End = s.current.(End)
+
+	for _, f := range s.stack {
+		ctx.Stack = append(ctx.Stack, Frame{Path: f.Path, Step: f.Step, Temps: copy(f.Temps)})
+	}
+	for _, c := range s.threads {
+		ctx.Threads = append(ctx.Threads, c.Path())
+	}
+
+	return ctx
+}
+
+// push the return point of the tunnel, with a copy of the temporary variables,
+// so that they are not changed by the tunnel
+func (s *Story) push(l *line, step int) {
+	s.stack = append(s.stack, Frame{Path: l.Path(), Step: step, Temps: copy(s.temps)})
+}
+
+// pop the return point of the tunnel, and restore its temporary variables
+func (s *Story) pop() (f Frame, err error) {
+	if len(s.stack) == 0 {
+		return f, errors.New("tunnel return without calling")
+	}
+
+	f = s.stack[len(s.stack)-1]
+	s.stack = s.stack[:len(s.stack)-1]
+
+	s.temps = f.Temps
+	if s.temps == nil {
+		s.temps = make(map[string]interface{})
+	}
+	s.touch()
+	s.scope = s.scopeOf(s.paths[f.Path])
+
+	return f, nil
+}
+
+// scope path of the node, which is its knot or stitch
+func (s *Story) scopeOf(node Node) string {
+	kn, st := s.container(node)
+	if st != nil {
+		return st.Path()
+	} else if kn != nil {
+		return kn.Path()
+	}
+
+	return ""
+}
+
+// enter the node, and clear the temporary variables
+// if the node is out of current scope, the bound arguments
+// of the divert are set as the new temporary variables,
+// the knot's ones are kept when it flows into its first stitch
+func (s *Story) enter(node Node) {
+	if scope := s.scopeOf(node); scope != s.scope || s.bound != nil {
+		if st, ok := node.(*stitch); !ok || st.knot.next != st || st.knot.Path() != s.scope || s.bound != nil {
+			s.temps = make(map[string]interface{})
+			s.touch()
+		}
+		s.scope = scope
+	}
+
+	for k, v := range s.bound {
+		s.temps[k] = v
+		s.touch()
+	}
+	s.bound = nil
+}
+
+// bind the arguments to the parameters, the ref parameter
+// is stored as "&name" with the referenced variable's name
+func (s *Story) bind(params []param, args []*exprc) error {
+	if len(params) == 0 {
+		return nil
+	}
+
+	bound := make(map[string]interface{}, len(params))
+	for i, p := range params {
+		if p.ref {
+			name := strings.TrimSpace(args[i].raw)
+			if ref, ok := s.temps[refKey(name)]; ok {
+				bound[refKey(p.name)] = ref
+			} else if _, ok := s.vars[name]; ok {
+				bound[refKey(p.name)] = name
+			} else {
+				return errors.Errorf("ref argument should be a global variable: %s", name)
+			}
+			continue
+		}
+
+		v, err := s.eval(args[i])
+		if err != nil {
+			return err
+		}
+		bound[p.name] = v
+	}
+
+	s.bound = bound
+	return nil
+}
+
+// refKey of the ref parameter in temporary variables
+func refKey(name string) string {
+	return "&" + name
+}
+
+// variable of the name, the temporary one goes first
+func (s *Story) variable(name string) (interface{}, bool) {
+	if ref, ok := s.temps[refKey(name)].(string); ok {
+		v, ok := s.vars[ref]
+		return v, ok
+	}
+
+	if v, ok := s.temps[name]; ok {
+		return v, true
+	}
+
+	v, ok := s.vars[name]
+	return v, ok
+}
+
+// env of the expression, which contains story's vars,
+// temporary variables and functions
+func (s *Story) env() map[string]interface{} {
+	if s.cached != nil {
+		return s.cached
+	}
+
+	env := make(map[string]interface{}, len(s.vars)+len(s.temps)+len(s.funcs)+len(s.consts)+len(s.items)+len(s.visits))
+	for k, v := range s.funcs {
+		env[k] = v
+	}
+	// the external goes first, it falls back to the function itself
+	for k, e := range s.externals {
+		env[k] = e.call
+	}
+	for k, v := range s.items {
+		env[k] = v
+	}
+	// read counts, the paths are joined as knot__stitch
+	for k, v := range s.visits {
+		env[k] = v
+	}
+	// constants are folded after post parsing, this is for the unfolded ones
+	for k, v := range s.consts {
+		env[k] = v
+	}
+	for k, v := range s.vars {
+		env[k] = v
+	}
+	for k, v := range s.temps {
+		if strings.HasPrefix(k, "&") {
+			// the ref parameter gets the referenced value
+			if ref, ok := v.(string); ok {
+				env[k[1:]] = s.vars[ref]
+			}
+			continue
+		}
+		env[k] = v
+	}
+
+	s.cached = env
+	return env
+}
+
+// touch the state of the story, so that the env is rebuilt
+func (s *Story) touch() {
+	s.cached = nil
+}
+
+// eval the expression with story's env, the error
+// raised by the called function is returned as it is
+func (s *Story) eval(c *exprc) (interface{}, error) {
+	v, err := c.Eval(s.env())
+	if s.fault != nil {
+		err, s.fault = s.fault, nil
+	}
+
+	return v, err
+}
+
+// raise the error of the function called by the expression,
+// the vm recovers the panic, and eval returns the error
+func (s *Story) raise(err error) {
+	s.fault = err
+	panic(err)
+}
+
+// callback of the expressions, which raises its error
+func (s *Story) callback(fn func(args ...interface{}) (interface{}, error)) func(args ...interface{}) interface{} {
+	return func(args ...interface{}) interface{} {
+		v, err := fn(args...)
+		if err != nil {
+			s.raise(err)
+		}
+		return v
+	}
+}
+
+// test the condition, and drop the output of the called functions
+func (s *Story) test(c *exprc) (bool, error) {
+	mark := len(s.output)
+	defer s.flush(mark)
+
+	v, err := s.eval(c)
+	if err != nil {
+		return false, err
+	}
+
+	return truth(v)
+}
+
+// flush the output of the called functions since mark
+func (s *Story) flush(mark int) string {
+	if len(s.output) <= mark {
+		return ""
+	}
+
+	out := strings.Join(s.output[mark:], "\n")
+	s.output = s.output[:mark]
+	return out
 }
 
 func copy(m map[string]interface{}) map[string]interface{} {
@@ -263,6 +778,15 @@ func copy(m map[string]interface{}) map[string]interface{} {
 	return cp
 }
 
+// counts copied from the map
+func counts(m map[string]int) map[string]int {
+	cp := make(map[string]int, len(m))
+	for k, v := range m {
+		cp[k] = v
+	}
+	return cp
+}
+
 // container of the current node
 func (s *Story) container(node Node) (*knot, *stitch) {
 	for node != nil {
@@ -293,15 +817,22 @@ func (s *Story) divert(path string, from Node) Node {
 	kn, st := s.container(from)
 
 	switch len(sp) {
-	case 1: // local label || local stitch || story's knot
+	case 1: // local label || local stitch || story's knot || story's label
 		if strings.ToLower(path) == "end" {
 			return s.end
 		}
+		if strings.ToLower(path) == "done" {
+			return s.done
+		}
 		// local label
-		if kn != nil && st != nil {
-			p := kn.name + PathSplit + st.name + PathSplit + path
-			if s.paths[p] != nil {
-				return s.paths[p]
+		if st != nil {
+			if n := s.label(st.Path() + PathSplit + path); n != nil {
+				return n
+			}
+		}
+		if kn != nil {
+			if n := s.label(kn.Path() + PathSplit + path); n != nil {
+				return n
 			}
 		}
 		// find local stitch
@@ -312,30 +843,71 @@ func (s *Story) divert(path string, from Node) Node {
 		if s.knot(path) != nil {
 			return s.knot(path)
 		}
-	case 2: // local stitch.label || knot.stitch
+		// label out of knots
+		return s.label(path)
+	case 2: // local stitch.label || knot.stitch || knot.label
 		if kn != nil {
-			p := regReplaceDot.ReplaceAllString(path, PathSplit+"$1")
-			p = kn.name + PathSplit + p
-			if s.paths[p] != nil {
-				return s.paths[p]
+			if n := s.label(kn.Path() + PathSplit + sp[0] + PathSplit + sp[1]); n != nil {
+				return n
 			}
 		}
 		if k := s.knot(sp[0]); k != nil {
-			return k.stitch(sp[1])
+			if st := k.stitch(sp[1]); st != nil {
+				return st
+			}
+			return s.label(k.Path() + PathSplit + sp[1])
 		}
 	default: // could be - knot.stitch.label
 		p := regReplaceDot.ReplaceAllString(path, PathSplit+"$1")
-		// fmt.Println(path)
-		return s.paths[p]
+		return s.label(p)
 	}
 	return nil
 }
 
+// label of the path, which is a labelled gather or option
+func (s *Story) label(path string) Node {
+	if l := lineOf(s.paths[path]); l != nil && l.labelled {
+		return s.paths[path]
+	}
+
+	return nil
+}
+
 // Context of the story
 type Context struct {
 	Current string                 `json:"current" binding:"required"`
 	LN      int                    `json:"ln" binding:"required"`
 	Vars    map[string]interface{} `json:"vars"`
+	Temps   map[string]interface{} `json:"temps"`
+	Stack   []Frame                `json:"stack"`
+	Threads []string               `json:"threads"`
+
+	// read counts of the visited paths
+	Visits map[string]int `json:"visits"`
+
+	// choices of the story compiled by inklecate
+	Choices []Choice `json:"choices,omitempty"`
+
+	// turns of the story, and the last turn of the visited paths
+	Turns int            `json:"turns"`
+	Seen  map[string]int `json:"seen"`
+
+	// seed of the random, and its rolled times
+	Seed  int64 `json:"seed"`
+	Rolls int   `json:"rolls"`
+
+	// the story is ended
+	End bool `json:"end,omitempty"`
+}
+
+// Frame of the tunnel, which is the return point of the caller
+type Frame struct {
+	Path  string                 `json:"path"`
+	Step  int                    `json:"step"`
+	Temps map[string]interface{} `json:"temps"`
+
+	// kind of the frame of the story compiled by inklecate
+	Kind FrameKind `json:"kind,omitempty"`
 }
 
 // NewContext which starts from beginning with empty vars
@@ -343,7 +915,9 @@ func NewContext() *Context {
 	return &Context{
 		Current: "start",
 		Vars:    make(map[string]interface{}),
+		Temps:   make(map[string]interface{}),
 		LN:      0,
+		Seed:    time.Now().UnixNano(),
 	}
 }
 
@@ -374,10 +948,14 @@ func (s *Section) add(text string, tags []string) {
 				tail = true
 			}
 
+			// the trailing spaces are kept for the glue only,
+			// and the blank lines are dropped
 			if tail || header {
 				s.Text = s.Text + text
+			} else if prev := strings.TrimRight(s.Text, " \t\n"); prev != "" {
+				s.Text = prev + "\n" + text
 			} else {
-				s.Text = s.Text + "\n" + text
+				s.Text = text
 			}
 		} else {
 			s.Text = text
@@ -389,29 +967,6 @@ func (s *Section) add(text string, tags []string) {
 	}
 }
 
-// Nodes list
-type nodes []Node
-
-// NewSection creates the rendered result of the nodes
-func (n nodes) section() *Section {
-	sec := &Section{}
-	for _, node := range n {
-		switch node := node.(type) {
-		case End:
-			sec.End = true
-			sec.add(node.End())
-		case Choices:
-			opts, optsTags := node.List()
-
-			sec.Opts = opts
-			sec.OptsTags = optsTags
-		case CanNext:
-			sec.add(node.Render())
-		}
-	}
-	return sec
-}
-
 type start struct {
 	*base
 	next Node
@@ -429,7 +984,7 @@ func (s *start) Next() (Node, error) {
 	return s.next, nil
 }
 
-func (s *start) Render() (text string, tags []string) {
+func (s *start) Render() (text string, tags []string, err error) {
 	text = ""
 	tags = append(tags, "START")
 	return
@@ -445,25 +1000,58 @@ func (e *end) End() (text string, tags []string) {
 	return
 }
 
+// done of the current flow, the story ends
+// if there is no choice gathered by threads
+type done struct {
+	*base
+}
+
+func (d *done) End() (text string, tags []string) {
+	text = ""
+	tags = append(tags, "DONE")
+	return
+}
+
 // Default story
 func Default() *Story {
-	parsers := []ParseFunc{readVariable, readKnot, readStitch, readOption, readGather, readLine}
+	parsers := []ParseFunc{readInclude, readTodo, readVariable, readConst, readList, readExternal, readFunction, readKnot, readStitch, readLogic, readThread, readBlock, readOption, readGather, readLine}
 
 	s := &start{base: &base{path: "start"}}
 	e := &end{base: &base{path: "end"}}
+	d := &done{base: &base{path: "done"}}
 	s.SetNext(e)
 
-	story := &Story{start: s, end: e, parsers: parsers}
+	story := &Story{start: s, end: e, done: d, parsers: parsers}
 
 	s.story = story
 	e.story = story
+	d.story = story
 
 	story.paths = make(map[string]Node)
 	story.vars = make(map[string]interface{})
+	story.temps = make(map[string]interface{})
+	story.funcs = make(map[string]interface{})
+	story.externals = make(map[string]*external)
+	story.defaults = make(map[string]interface{})
+	story.observers = make(map[string][]Observer)
+	story.consts = make(map[string]interface{})
+	story.included = make(map[string]bool)
+	story.lists = make(map[string][]ListItem)
+	story.items = make(map[string]interface{})
+	for k, f := range story.listFuncs() {
+		story.funcs[k] = f
+	}
+	for k, f := range story.builtins() {
+		story.funcs[k] = f
+	}
+	story.seen = make(map[string]int)
+	story.rng = newSource(0, 0)
+	story.visits = make(map[string]int)
 	story.ln = 0
 
 	story.paths["start"] = s
 	story.paths["end"] = e
+	story.paths["done"] = d
 
 	story.current = s
 	return story
@@ -475,24 +1063,51 @@ type ParseFunc func(s *Story, input string, ln int) error
 // Parse the input text
 func (s *Story) Parse(input string) *ErrInk {
 	contents := strings.Split(input, "\n")
+	s.scopes = nil
+
+	// line number of the unclosed block comment
+	commenting := 0
 	for _, line := range contents {
 		s.ln++
 
+		var open bool
+		if line, open = stripBlockComments(escape(line), commenting > 0); !open {
+			commenting = 0
+		} else if commenting == 0 {
+			commenting = s.ln
+		}
+
 		// trim spaces and skip empty lines
 		l := strings.TrimRight(strings.TrimSpace(line), "\r\n")
 		if len(l) == 0 {
 			continue
 		}
 
-		// passing raw input into parsers
-		for _, parser := range s.parsers {
-			if err := parser(s, l, s.ln); err != nil {
-				if err != errNotMatch {
-					return wrapError(err, s.ln)
-				}
-			} else {
-				break
+		if err := s.parse(l, s.ln); err != nil {
+			// error of the included file
+			if e, ok := err.(*ErrInk); ok {
+				return e
 			}
+			return &ErrInk{LN: s.ln, File: s.file, Message: err.Error()}
+		}
+	}
+
+	if commenting > 0 {
+		return &ErrInk{LN: commenting, File: s.file, Message: "block comment is not closed"}
+	}
+
+	return nil
+}
+
+// passing raw input into parsers
+func (s *Story) parse(input string, ln int) error {
+	for _, parser := range s.parsers {
+		if err := parser(s, input, ln); err != nil {
+			if err != errNotMatch {
+				return err
+			}
+		} else {
+			break
 		}
 	}
 
@@ -501,10 +1116,120 @@ func (s *Story) Parse(input string) *ErrInk {
 
 // PostParsing when all input parsing has done
 func (s *Story) PostParsing() (errs []*ErrInk) {
+	errs = s.patch()
 	for _, node := range s.paths {
 		if e := node.PostParsing(); e != nil {
-			errs = append(errs, wrapError(e, node.LN()))
+			errs = append(errs, errorOf(e, node))
+		}
+	}
+	return
+}
+
+// patch the expressions of the nodes, the constants are folded,
+// the list operators are patched, and the undefined names are reported
+func (s *Story) patch() (errs []*ErrInk) {
+	temps := s.temporaries()
+	for _, node := range s.paths {
+		list := exprcsOf(node)
+		if len(list) == 0 {
+			continue
+		}
+
+		p := s.patcher()
+		p.story, p.node = s, node
+		p.locals = s.locals(node, temps)
+		for _, c := range list {
+			if e := c.compile(p); e != nil {
+				errs = append(errs, errorOf(e, node))
+				break
+			}
+		}
+	}
+
+	return
+}
+
+// temporaries of the scopes, which are collected once from the parsed nodes
+func (s *Story) temporaries() map[string]map[string]bool {
+	if s.scopes != nil {
+		return s.scopes
+	}
+
+	s.scopes = make(map[string]map[string]bool)
+	for _, n := range s.paths {
+		if lg, ok := n.(*logic); ok && lg.temp {
+			scope := s.scopeOf(lg)
+			if s.scopes[scope] == nil {
+				s.scopes[scope] = make(map[string]bool)
+			}
+			s.scopes[scope][lg.name] = true
 		}
 	}
+
+	return s.scopes
+}
+
+// locals of the node's scope, which are the parameters and temporary
+// variables of its knot and stitch, the knot's ones are kept in its stitch
+func (s *Story) locals(node Node, temps map[string]map[string]bool) map[string]bool {
+	locals := make(map[string]bool)
+	kn, st := s.container(node)
+	if kn == nil {
+		return temps[""]
+	}
+
+	for _, p := range kn.params {
+		locals[p.name] = true
+	}
+	for name := range temps[kn.Path()] {
+		locals[name] = true
+	}
+	if st != nil {
+		for _, p := range st.params {
+			locals[p.name] = true
+		}
+		for name := range temps[st.Path()] {
+			locals[name] = true
+		}
+	}
+	return locals
+}
+
+// patcher of the story's constants
+func (s *Story) patcher() *patcher {
+	return &patcher{consts: s.consts}
+}
+
+// exprcsOf the node, which are compiled when parsing
+func exprcsOf(node Node) (list []*exprc) {
+	switch n := node.(type) {
+	case *line:
+		list = n.content.exprcs()
+		for _, d := range append(n.tunnels, n.divert) {
+			if d != nil {
+				list = append(list, d.args...)
+			}
+		}
+	case *gather:
+		list = exprcsOf(n.line)
+	case *opt:
+		list = append(exprcsOf(n.line), n.conditions...)
+		list = append(list, n.before.exprcs()...)
+		list = append(list, n.middle.exprcs()...)
+		list = append(list, n.after.exprcs()...)
+	case *logic:
+		if n.value != nil {
+			list = append(list, n.value)
+		}
+	case *block:
+		if n.value != nil {
+			list = append(list, n.value)
+		}
+	case *branch:
+		if n.condition != nil {
+			list = append(list, n.condition)
+		}
+	}
+
 	return
 }
@@ -158,3 +158,81 @@ func BenchmarkComplexStoryParsing(b *testing.B) {
 		}
 	}
 }
+
+func TestReadCounts(t *testing.T) {
+	input := `
+	-> tavern
+	== tavern
+	You enter the tavern.
+	{tavern > 2: The barkeep knows you well.}
+	* [Drink] -> tavern
+	+ [Talk]
+	  The barkeep shrugs.
+	- (chat) You chat for a while. {chat} {cellar}
+	  -> tavern.cellar
+	= cellar
+	The cellar is dark. {tavern.cellar} {tavern.chat}
+	+ [Up]-> tavern
+	`
+
+	story := Default()
+	err := story.Parse(input)
+	assert.Nil(t, err)
+	assert.Nil(t, story.PostParsing())
+
+	ctx := NewContext()
+	_, err = story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, ctx.Visits["tavern"])
+
+	// knot counts once per entry, not per line
+	sec, err := story.Pick(ctx, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, ctx.Visits["tavern"])
+	assert.Equal(t, 1, ctx.Visits["tavern__i__i__c__0"])
+	assert.Equal(t, []string{"Talk"}, sec.Opts)
+
+	// read counts are relative to the knot, and the unvisited is zero
+	sec, err = story.Pick(ctx, 0)
+	assert.Nil(t, err)
+	assert.Contains(t, sec.Text, "You chat for a while. 1 0")
+	assert.Contains(t, sec.Text, "The cellar is dark. 1 1")
+	assert.Equal(t, 1, ctx.Visits["tavern__chat"])
+
+	sec, err = story.Pick(ctx, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "You enter the tavern.\nThe barkeep knows you well.", sec.Text)
+	assert.Equal(t, 3, ctx.Visits["tavern"])
+	assert.Empty(t, ctx.Vars)
+
+	// read counts of the older context are kept in the vars
+	ctx = NewContext()
+	ctx.Vars["tavern"] = float64(2)
+	_, err = story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, ctx.Visits["tavern"])
+	assert.Empty(t, ctx.Vars)
+}
+
+func TestStoryLoadCopy(t *testing.T) {
+	input := `
+	VAR x = 1
+	~ temp y = 2
+	~ x = y
+	Oops {LIST_COUNT(x)}.
+	-> END
+	`
+	story := Default()
+	assert.Nil(t, story.Parse(input))
+	assert.Nil(t, story.PostParsing())
+
+	// the context is untouched when the story is failed
+	ctx := NewContext()
+	_, err := story.Resume(ctx)
+	assert.NotNil(t, err)
+	assert.Equal(t, "start", ctx.Current)
+	assert.Empty(t, ctx.Vars)
+	assert.Empty(t, ctx.Temps)
+	assert.Empty(t, ctx.Visits)
+	assert.Empty(t, ctx.Seen)
+}
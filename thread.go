@@ -0,0 +1,169 @@
+package goink
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var threadReg = regexp.MustCompile(`^<-\s*(.*)$`)
+
+// readThread parse and insert a new thread into story
+func readThread(s *Story, input string, ln int) error {
+	res := threadReg.FindStringSubmatch(input)
+	if res == nil {
+		return errNotMatch
+	}
+
+	target := strings.TrimSpace(res[1])
+	if valid := validPathReg.FindString(target); valid == "" {
+		return errors.Errorf("invalid thread name: %s", target)
+	}
+
+	t := &thread{base: &base{story: s, ln: ln, file: s.file, parent: s.current}, target: strings.ToLower(target)}
+	t.path = s.current.Path() + PathSplit + "t"
+	s.paths[t.path] = t
+
+	if n := s.next(); n != nil {
+		n.SetNext(t)
+		s.current = t
+
+		return nil
+	}
+
+	return errors.New("current line can not set next")
+}
+
+// thread of the story, which gathers the content and choices
+// from the target into current flow
+type thread struct {
+	*base
+
+	next   Node
+	target string
+}
+
+// SetNext content of the thread
+func (t *thread) SetNext(obj Node) {
+	t.next = obj
+}
+
+// Next content of the thread, after gathering the target's choices
+func (t *thread) Next() (Node, error) {
+	target, err := t.resolve()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.story.fork(target); err != nil {
+		return nil, err
+	}
+
+	if t.next != nil {
+		return t.next, nil
+	}
+
+	return following(t)
+}
+
+// Render nothing of the thread
+func (t *thread) Render() (text string, tags []string, err error) {
+	return "", nil, nil
+}
+
+// PostParsing of the thread
+func (t *thread) PostParsing() error {
+	if _, err := t.resolve(); err != nil {
+		return err
+	}
+
+	if t.next != nil {
+		return nil
+	}
+
+	_, err := following(t)
+	return err
+}
+
+// resolve the target of the thread
+func (t *thread) resolve() (Node, error) {
+	target := t.story.divert(t.target, t)
+	if target == nil {
+		return nil, errors.Errorf("can not find the thread: %s", t.target)
+	}
+
+	if k, ok := target.(*knot); ok && k.function {
+		return nil, errors.Errorf("can not thread to function: %s", t.target)
+	}
+
+	return target, nil
+}
+
+// fork the flow into the target, and gather its choices,
+// the rendered content of the thread is pushed into story's output
+func (s *Story) fork(target Node) error {
+	current, temps, scope, stack := s.current, s.temps, s.scope, s.stack
+	defer func() {
+		s.current, s.temps, s.scope, s.stack = current, temps, scope, stack
+	}()
+
+	s.current = target
+	s.stack = nil
+
+	sec := &Section{}
+	if err := s.walk(sec); err != nil {
+		return err
+	}
+
+	// the thread which is passed again gathers its choices once
+	if c, ok := s.current.(*options); ok && !s.threaded(c) {
+		s.threads = append(s.threads, c)
+	}
+
+	if sec.Text != "" {
+		s.output = append(s.output, sec.Text)
+	}
+
+	return nil
+}
+
+// threaded tells if the choices are gathered by threads already
+func (s *Story) threaded(c *options) bool {
+	for _, t := range s.threads {
+		if t.Path() == c.Path() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// choice points of current flow and its threads
+func (s *Story) points() (points []*options) {
+	switch c := s.current.(type) {
+	case *options:
+		points = append(points, c)
+	case *done:
+	default:
+		return nil
+	}
+
+	return append(points, s.threads...)
+}
+
+// list all available options' content of the choice points
+func (s *Story) list(points []*options) (text []string, tags [][]string, err error) {
+	defer func() { s.choices = 0 }()
+	for _, c := range points {
+		s.choices = len(text)
+		t, tg, err := c.List()
+		if err != nil {
+			return nil, nil, err
+		}
+		text = append(text, t...)
+		tags = append(tags, tg...)
+	}
+
+	return
+}
@@ -0,0 +1,173 @@
+package goink
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThreadParsing(t *testing.T) {
+	input := `
+	<- invalid thread
+	`
+
+	story := Default()
+	err := story.Parse(input)
+	assert.Contains(t, err.Error(), "invalid thread name")
+
+	input = `
+	<- knot_a
+	-> END
+	== function f
+	~ return 1
+	`
+
+	story = Default()
+	err = story.Parse(input)
+	assert.Nil(t, err)
+
+	errs := story.PostParsing()
+	assert.Contains(t, errs[0].Error(), "can not find the thread: knot_a")
+
+	input = `
+	<- f
+	-> END
+	== function f
+	~ return 1
+	`
+
+	story = Default()
+	err = story.Parse(input)
+	assert.Nil(t, err)
+
+	errs = story.PostParsing()
+	assert.Contains(t, errs[0].Error(), "can not thread to function: f")
+}
+
+func TestThreadChoices(t *testing.T) {
+	input := `
+	-> hub
+	== hub
+	You are in the hub.
+	<- weather
+	<- shop.counter
+	* [Leave] -> END
+
+	== weather
+	It is raining.
+	* [Talk about the weather]
+	  Terrible weather. -> hub
+
+	== shop
+	= counter
+	The shop is open.
+	* [Buy] You buy a hat. -> DONE
+	* [Sell] You sell a hat. -> DONE
+	`
+
+	story := Default()
+	err := story.Parse(input)
+	assert.Nil(t, err)
+	assert.Nil(t, story.PostParsing())
+
+	ctx := NewContext()
+	sec, err := story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "You are in the hub.\nIt is raining.\nThe shop is open.", sec.Text)
+	assert.Equal(t, []string{"Leave", "Talk about the weather", "Buy", "Sell"}, sec.Opts)
+	assert.Equal(t, []string{"weather__i__c", "shop__counter__i__c"}, ctx.Threads)
+
+	// resume from the choice point again
+	sec, err = story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(sec.Opts))
+
+	// pick the option from the thread
+	sec, err = story.Pick(ctx, 1)
+	assert.Nil(t, err)
+	assert.Contains(t, sec.Text, "Terrible weather.")
+	assert.Equal(t, []string{"Leave", "Buy", "Sell"}, sec.Opts)
+
+	// the flow is done after the pick
+	sec, err = story.Pick(ctx, 2)
+	assert.Nil(t, err)
+	assert.Contains(t, sec.Text, "You sell a hat.")
+	assert.True(t, sec.End)
+	assert.Empty(t, ctx.Threads)
+
+	_, err = story.Pick(ctx, 5)
+	assert.Contains(t, err.Error(), "is not an option")
+}
+
+func TestThreadsOnly(t *testing.T) {
+	input := `
+	<- a
+	<- b
+	-> DONE
+	== a
+	* [A] a -> END
+	== b
+	* [B] b -> END
+	`
+
+	story := Default()
+	err := story.Parse(input)
+	assert.Nil(t, err)
+
+	ctx := NewContext()
+	sec, err := story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"A", "B"}, sec.Opts)
+	assert.Equal(t, "done", ctx.Current)
+
+	_, err = story.Pick(ctx, 2)
+	assert.Contains(t, err.Error(), "no option available [b__c] at idx: 1")
+
+	sec, err = story.Pick(ctx, 1)
+	assert.Nil(t, err)
+	assert.Contains(t, sec.Text, "b")
+	assert.True(t, sec.End)
+
+	ctx = NewContext()
+	ctx.Threads = []string{"invalid"}
+	_, err = story.Resume(ctx)
+	assert.Contains(t, err.Error(), "thread path [invalid] is not existed")
+
+	input = `
+	-> DONE
+	`
+
+	story = Default()
+	err = story.Parse(input)
+	assert.Nil(t, err)
+
+	sec, err = story.Resume(NewContext())
+	assert.Nil(t, err)
+	assert.True(t, sec.End)
+	assert.Contains(t, sec.Tags, "DONE")
+}
+
+func TestThreadLoop(t *testing.T) {
+	input := `
+	-> hub
+	== hub
+	<- extras
+	{ hub < 2:
+	  -> hub
+	}
+	* [Stay] -> END
+	== extras
+	* [Look] -> END
+	`
+
+	story := Default()
+	err := story.Parse(input)
+	assert.Nil(t, err)
+	assert.Nil(t, story.PostParsing())
+
+	ctx := NewContext()
+	sec, err := story.Resume(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Stay", "Look"}, sec.Opts)
+	assert.Equal(t, []string{"extras__c"}, ctx.Threads)
+}